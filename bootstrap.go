@@ -0,0 +1,332 @@
+package tox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BootNode is a bootstrap node with its health as seen by a BootstrapManager.
+type BootNode struct {
+	Addr     string // IPv4 address or host name
+	IPv6     string
+	Port     int
+	Pubkey   string
+	TCPPorts []int
+
+	Maintainer string
+	Location   string
+
+	// Good counts the bootstrap attempts with the node that got online, Fails the failed ones since then.
+	Good     int
+	Fails    int
+	LastGood time.Time
+}
+
+// nodesJSON is the nodes.json format of nodes.tox.chat. The health fields
+// are an extension which other readers ignore.
+type nodesJSON struct {
+	LastScan    int64           `json:"last_scan"`
+	LastRefresh int64           `json:"last_refresh"`
+	Nodes       []BootNodeEntry `json:"nodes"`
+}
+
+// BootNodeEntry is a node of the nodes.json format.
+type BootNodeEntry struct {
+	IPv4       string `json:"ipv4"`
+	IPv6       string `json:"ipv6"`
+	Port       int    `json:"port"`
+	TCPPorts   []int  `json:"tcp_ports"`
+	PublicKey  string `json:"public_key"`
+	Maintainer string `json:"maintainer"`
+	Location   string `json:"location"`
+	StatusUDP  bool   `json:"status_udp"`
+	StatusTCP  bool   `json:"status_tcp"`
+	Good       int    `json:"good,omitempty"`
+	Fails      int    `json:"fails,omitempty"`
+	LastGood   int64  `json:"last_good,omitempty"`
+}
+
+// ParseBootNodes decodes nodes in the nodes.json format. Nodes without an address, port or key are skipped.
+func ParseBootNodes(data []byte) ([]*BootNode, error) {
+	var nj nodesJSON
+	if err := json.Unmarshal(data, &nj); err != nil {
+		return nil, err
+	}
+	nodes := []*BootNode{}
+	for _, n := range nj.Nodes {
+		if n.IPv4 == "-" {
+			n.IPv4 = ""
+		}
+		if n.IPv6 == "-" {
+			n.IPv6 = ""
+		}
+		if (n.IPv4 == "" && n.IPv6 == "") || n.Port <= 0 || n.Port > 65535 || len(n.PublicKey) != PublicKeySize*2 {
+			continue
+		}
+		node := &BootNode{Addr: n.IPv4, IPv6: n.IPv6, Port: n.Port, Pubkey: strings.ToUpper(n.PublicKey),
+			TCPPorts: n.TCPPorts, Maintainer: n.Maintainer, Location: n.Location,
+			Good: n.Good, Fails: n.Fails}
+		if n.LastGood > 0 {
+			node.LastGood = time.Unix(n.LastGood, 0)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// LoadBootNodes reads a nodes.json file.
+func LoadBootNodes(fname string) ([]*BootNode, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBootNodes(data)
+}
+
+// SaveBootNodes writes the nodes in the nodes.json format, with their health.
+func SaveBootNodes(fname string, nodes []*BootNode) error {
+	nj := nodesJSON{LastRefresh: time.Now().Unix(), Nodes: []BootNodeEntry{}}
+	for _, node := range nodes {
+		n := BootNodeEntry{IPv4: node.Addr, IPv6: node.IPv6, Port: node.Port, TCPPorts: node.TCPPorts,
+			PublicKey: node.Pubkey, Maintainer: node.Maintainer, Location: node.Location,
+			StatusUDP: true, StatusTCP: len(node.TCPPorts) > 0, Good: node.Good, Fails: node.Fails}
+		if n.IPv4 == "" {
+			n.IPv4 = "-"
+		}
+		if n.IPv6 == "" {
+			n.IPv6 = "-"
+		}
+		if n.TCPPorts == nil {
+			n.TCPPorts = []int{}
+		}
+		if !node.LastGood.IsZero() {
+			n.LastGood = node.LastGood.Unix()
+		}
+		nj.Nodes = append(nj.Nodes, n)
+	}
+	data, err := json.MarshalIndent(&nj, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fname, append(data, '\n'), 0644)
+}
+
+// BootstrapManager bootstraps a Tox instance from a list of nodes and keeps it connected.
+//
+// It bootstraps a random subset of the nodes, preferring nodes which got online
+// before and avoiding nodes which did not. When the instance stays offline for
+// OfflineTimeout it bootstraps another subset, waiting twice as long after each
+// failed attempt up to MaxBackoff. The nodes of an attempt that got online are
+// recorded as good, the nodes of a failed attempt as failed.
+type BootstrapManager struct {
+	// Subset is the number of nodes of one attempt.
+	Subset int
+	// OfflineTimeout is how long to wait for getting online before the next attempt.
+	OfflineTimeout time.Duration
+	// MaxBackoff limits the growing wait between failed attempts.
+	MaxBackoff time.Duration
+	// CheckInterval is how often the goroutine of Start checks the connection.
+	CheckInterval time.Duration
+
+	t     *Tox
+	path  string
+	nodes []*BootNode
+
+	mu          sync.Mutex
+	tried       []*BootNode // nodes of the current attempt
+	online      bool
+	nextAttempt time.Time
+	backoff     time.Duration
+	stopch      chan struct{}
+	wg          sync.WaitGroup
+
+	nowfn       func() time.Time
+	rnd         *rand.Rand
+	bootstrapfn func(node *BootNode) error
+}
+
+// NewBootstrapManager creates a manager for the nodes. If path is not empty, Close saves the nodes there.
+func NewBootstrapManager(t *Tox, nodes []*BootNode, path string) *BootstrapManager {
+	this := &BootstrapManager{t: t, nodes: nodes, path: path}
+	this.Subset = 4
+	this.OfflineTimeout = 30 * time.Second
+	this.MaxBackoff = 5 * time.Minute
+	this.CheckInterval = time.Second
+	this.nowfn = time.Now
+	this.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	this.bootstrapfn = this.bootstrapNode
+	return this
+}
+
+// Nodes returns the nodes, the ones with the best health first.
+func (this *BootstrapManager) Nodes() []*BootNode {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	nodes := append([]*BootNode{}, this.nodes...)
+	sort.SliceStable(nodes, func(i, j int) bool { return betterNode(nodes[i], nodes[j]) })
+	return nodes
+}
+
+// betterNode orders nodes by fewer failures, then by having been good more recently.
+func betterNode(a *BootNode, b *BootNode) bool {
+	if a.Fails != b.Fails {
+		return a.Fails < b.Fails
+	}
+	return a.LastGood.After(b.LastGood)
+}
+
+func (this *BootstrapManager) bootstrapNode(node *BootNode) error {
+	if this.t == nil {
+		return toxerr("no tox instance")
+	}
+	var err error
+	for _, addr := range []string{node.Addr, node.IPv6} {
+		if addr == "" {
+			continue
+		}
+		if _, err1 := this.t.Bootstrap(addr, uint16(node.Port), node.Pubkey); err1 != nil {
+			err = err1
+		}
+		for _, port := range node.TCPPorts {
+			this.t.AddTcpRelay(addr, uint16(port), node.Pubkey)
+		}
+	}
+	return err
+}
+
+// Attach follows the connection status of the Tox instance and bootstraps it.
+func (this *BootstrapManager) Attach() error {
+	this.t.CallbackSelfConnectionStatus(func(t *Tox, status int, userData interface{}) {
+		this.setOnline(status != ConnectionNone)
+	}, nil)
+	return this.Bootstrap()
+}
+
+// Bootstrap bootstraps a new subset of the nodes now.
+func (this *BootstrapManager) Bootstrap() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.attempt()
+}
+
+// attempt bootstraps a subset of the nodes. Call with mu held.
+func (this *BootstrapManager) attempt() error {
+	if len(this.nodes) == 0 {
+		return toxerr("no bootstrap nodes")
+	}
+	nodes := append([]*BootNode{}, this.nodes...)
+	this.rnd.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	sort.SliceStable(nodes, func(i, j int) bool { return betterNode(nodes[i], nodes[j]) })
+
+	this.tried = nil
+	var err error
+	for _, node := range nodes {
+		if len(this.tried) >= this.Subset {
+			break
+		}
+		if err = this.bootstrapfn(node); err != nil {
+			node.Fails++
+			continue
+		}
+		this.tried = append(this.tried, node)
+	}
+
+	// also after a failed attempt, so Check does not retry on every call
+	if this.backoff == 0 {
+		this.backoff = this.OfflineTimeout
+	}
+	this.nextAttempt = this.nowfn().Add(this.backoff)
+	if len(this.tried) == 0 {
+		return toxerrf("bootstrap failed on all nodes: %v", err)
+	}
+	return nil
+}
+
+func (this *BootstrapManager) setOnline(online bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if online == this.online {
+		return
+	}
+	this.online = online
+	now := this.nowfn()
+	if online {
+		for _, node := range this.tried {
+			node.Good++
+			node.Fails = 0
+			node.LastGood = now
+		}
+		this.tried = nil
+		this.backoff = 0
+	} else {
+		// give the connection OfflineTimeout to come back before bootstrapping again
+		this.backoff = this.OfflineTimeout
+		this.nextAttempt = now.Add(this.backoff)
+	}
+}
+
+// Check bootstraps again if the instance is offline for too long. Start calls it periodically,
+// without Start it should be called from the iterate loop.
+func (this *BootstrapManager) Check() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.online || this.nowfn().Before(this.nextAttempt) {
+		return
+	}
+	for _, node := range this.tried {
+		node.Fails++
+	}
+	this.backoff *= 2
+	if this.backoff > this.MaxBackoff {
+		this.backoff = this.MaxBackoff
+	}
+	this.attempt()
+}
+
+// Start attaches the manager and checks the connection from a goroutine,
+// so the Tox instance must be created with ThreadSafe.
+func (this *BootstrapManager) Start() error {
+	err := this.Attach()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.stopch != nil {
+		return err
+	}
+	this.stopch = make(chan struct{})
+	this.wg.Add(1)
+	go func(stopch chan struct{}) {
+		defer this.wg.Done()
+		ticker := time.NewTicker(this.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				this.Check()
+			case <-stopch:
+				return
+			}
+		}
+	}(this.stopch)
+	return err
+}
+
+// Close stops the goroutine of Start and saves the nodes with their health.
+func (this *BootstrapManager) Close() error {
+	this.mu.Lock()
+	stopch := this.stopch
+	this.stopch = nil
+	this.mu.Unlock()
+	if stopch != nil {
+		close(stopch)
+		this.wg.Wait()
+	}
+	if this.path == "" {
+		return nil
+	}
+	return SaveBootNodes(this.path, this.Nodes())
+}
@@ -0,0 +1,54 @@
+// Package passphrase reads the passphrase of the command line tools from
+// an environment variable or a file descriptor.
+package passphrase
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Source is where a passphrase is read from, set by the pass-env and pass-fd flags.
+type Source struct {
+	Env string
+	Fd  int
+}
+
+// NewSource creates a source without environment variable and file descriptor.
+func NewSource() *Source {
+	return &Source{Fd: -1}
+}
+
+// Register adds the prefix+"pass-env" and prefix+"pass-fd" flags, what names the passphrase in their usage.
+func (this *Source) Register(fs *flag.FlagSet, prefix string, what string) {
+	fs.StringVar(&this.Env, prefix+"pass-env", this.Env, "read the "+what+" from this environment variable")
+	fs.IntVar(&this.Fd, prefix+"pass-fd", this.Fd, "read the "+what+" from this file descriptor")
+}
+
+// IsSet reports whether a flag selected a source.
+func (this *Source) IsSet() bool {
+	return this.Env != "" || this.Fd >= 0
+}
+
+// Read returns the passphrase, the first line of the file descriptor without the line break.
+// It returns nil without error if no source is set, the caller decides whether a passphrase is needed.
+func (this *Source) Read() ([]byte, error) {
+	switch {
+	case this.Env != "":
+		v, ok := os.LookupEnv(this.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", this.Env)
+		}
+		return []byte(v), nil
+	case this.Fd >= 0:
+		fp := os.NewFile(uintptr(this.Fd), fmt.Sprintf("fd%d", this.Fd))
+		line, err := bufio.NewReader(fp).ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("read passphrase from fd %d: %v", this.Fd, err)
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,38 @@
+package passphrase
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	s := NewSource()
+	if pass, err := s.Read(); pass != nil || err != nil || s.IsSet() {
+		t.Error("must read nothing without a source", pass, err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	s.Register(fs, "new-", "new passphrase")
+	os.Setenv("TEST_PASSPHRASE", "s3cret")
+	defer os.Unsetenv("TEST_PASSPHRASE")
+	if err := fs.Parse([]string{"-new-pass-env", "TEST_PASSPHRASE"}); err != nil {
+		t.Fatal(err)
+	}
+	if pass, err := s.Read(); string(pass) != "s3cret" || err != nil {
+		t.Error("wrong env passphrase", string(pass), err)
+	}
+	s.Env = "TEST_PASSPHRASE_UNSET"
+	if _, err := s.Read(); err == nil {
+		t.Error("must fail on an unset variable")
+	}
+
+	r, w, _ := os.Pipe()
+	defer r.Close()
+	w.Write([]byte("from fd\r\nnext line\n"))
+	w.Close()
+	s = &Source{Fd: int(r.Fd())}
+	if pass, err := s.Read(); string(pass) != "from fd" || err != nil {
+		t.Error("wrong fd passphrase", string(pass), err)
+	}
+}
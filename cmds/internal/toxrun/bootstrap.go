@@ -0,0 +1,52 @@
+package toxrun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/TokTok/go-toxcore-c"
+)
+
+// DefaultNodes is the default of the -bootstrap flags.
+const DefaultNodes = "205.185.116.116:33445:A179B09749AC826FF01F37A9613F6B57118AE014D4196A0E1105A98F93A54702"
+
+// Node is a bootstrap node, given as host:port:pubkey.
+type Node struct {
+	Host      string
+	Port      uint16
+	PublicKey string
+}
+
+// ParseNodes parses a comma separated list of host:port:pubkey nodes. Empty entries are skipped.
+func ParseNodes(list string) ([]Node, error) {
+	var nodes []Node
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.Split(s, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("bootstrap node %q: want host:port:pubkey", s)
+		}
+		port, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap node %q: invalid port", s)
+		}
+		nodes = append(nodes, Node{Host: parts[0], Port: uint16(port), PublicKey: parts[2]})
+	}
+	return nodes, nil
+}
+
+func (this Node) String() string {
+	return fmt.Sprintf("%s:%d:%s", this.Host, this.Port, this.PublicKey)
+}
+
+// Bootstrap bootstraps from the node and adds it as TCP relay.
+func (this Node) Bootstrap(t *tox.Tox) error {
+	if _, err := t.Bootstrap(this.Host, this.Port, this.PublicKey); err != nil {
+		return err
+	}
+	_, err := t.AddTcpRelay(this.Host, this.Port, this.PublicKey)
+	return err
+}
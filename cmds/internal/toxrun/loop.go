@@ -0,0 +1,43 @@
+// Package toxrun holds the parts shared by the long running command line tools:
+// the iterate loop, the bootstrap nodes and the file transfers.
+package toxrun
+
+import (
+	"time"
+
+	"github.com/TokTok/go-toxcore-c"
+)
+
+// Loop iterates a Tox instance in its own goroutine.
+type Loop struct {
+	t       *tox.Tox
+	stopch  chan struct{}
+	stopped chan struct{}
+}
+
+// StartLoop starts iterating t at the interval it asks for.
+func StartLoop(t *tox.Tox) *Loop {
+	this := &Loop{t: t}
+	this.stopch = make(chan struct{})
+	this.stopped = make(chan struct{})
+	go this.run()
+	return this
+}
+
+func (this *Loop) run() {
+	defer close(this.stopped)
+	for {
+		this.t.Iterate()
+		select {
+		case <-this.stopch:
+			return
+		case <-time.After(time.Duration(this.t.IterationInterval()) * time.Millisecond):
+		}
+	}
+}
+
+// Stop stops the loop and waits for the last iteration, no callback runs afterwards.
+func (this *Loop) Stop() {
+	close(this.stopch)
+	<-this.stopped
+}
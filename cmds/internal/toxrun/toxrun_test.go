@@ -0,0 +1,58 @@
+package toxrun
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := ParseNodes(DefaultNodes + ", ,127.0.0.1:33446:ABCD")
+	if err != nil || len(nodes) != 2 || nodes[0].String() != DefaultNodes || nodes[1].Port != 33446 || nodes[1].PublicKey != "ABCD" {
+		t.Error("wrong nodes", nodes, err)
+	}
+	for _, list := range []string{"127.0.0.1:33445", "127.0.0.1:port:ABCD", "127.0.0.1:65536:ABCD", ":33445:ABCD"} {
+		if _, err := ParseNodes(list); err == nil {
+			t.Error("must reject", list)
+		}
+	}
+	if nodes, err := ParseNodes(""); err != nil || len(nodes) != 0 {
+		t.Error("empty list must give no nodes", nodes, err)
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	fp, err := ioutil.TempFile("", "toxrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+
+	files := &Transfers{ProgressStep: 10, active: map[uint64]*Transfer{}, offers: map[uint64]*Transfer{}}
+	var reports []uint64
+	var finished []error
+	files.OnProgress = func(friendNumber uint32, fileNumber uint32, x *Transfer, done uint64) {
+		reports = append(reports, done)
+	}
+	files.OnFinish = func(friendNumber uint32, fileNumber uint32, x *Transfer, err error) { finished = append(finished, err) }
+
+	x := &Transfer{File: fp, Size: 12}
+	files.active[transferKey(1, 2)] = x
+	for i := 0; i < 3; i++ {
+		files.progress(1, 2, x, 4)
+	}
+	if len(reports) != 1 || reports[0] != 12 {
+		t.Error("wrong progress reports", reports)
+	}
+
+	// a cancel racing with the last chunk finishes the transfer once
+	files.finish(1, 2, x, nil)
+	files.finish(1, 2, x, errors.New("cancelled"))
+	if len(finished) != 1 || finished[0] != nil {
+		t.Error("must finish once", finished)
+	}
+	if _, err := files.Accept(1, 3, ""); err != ErrNoTransfer {
+		t.Error("must not accept an unknown offer", err)
+	}
+}
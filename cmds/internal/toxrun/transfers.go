@@ -0,0 +1,276 @@
+package toxrun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/TokTok/go-toxcore-c"
+)
+
+// ErrNoTransfer is returned for a file which is neither transferred nor offered.
+var ErrNoTransfer = errors.New("no such file transfer")
+
+// Transfer is a file being sent or received.
+type Transfer struct {
+	File    *os.File // nil while the file is only offered
+	Name    string
+	Size    uint64
+	Sending bool
+
+	done     uint64
+	reported uint64
+}
+
+// Transfers answers the file callbacks of a Tox instance. Received offers are kept
+// until Accept or Cancel, other file kinds than data are cancelled.
+//
+// Every sent or accepted file ends with exactly one OnFinish call, also when a cancel
+// races with its last chunk.
+type Transfers struct {
+	t *tox.Tox
+
+	// Dir is where Accept puts a file without path, the current directory by default.
+	Dir string
+	// Perm is the permission of received files, 0600 by default.
+	Perm os.FileMode
+	// ProgressStep is the least number of bytes between two OnProgress calls.
+	ProgressStep uint64
+
+	// OnOffer is called for a received file offer.
+	OnOffer func(friendNumber uint32, fileNumber uint32, x *Transfer)
+	// OnProgress is called with the number of transferred bytes.
+	OnProgress func(friendNumber uint32, fileNumber uint32, x *Transfer, done uint64)
+	// OnFinish is called after the file is closed, with nil if it was transferred completely.
+	OnFinish func(friendNumber uint32, fileNumber uint32, x *Transfer, err error)
+
+	mu     sync.Mutex
+	active map[uint64]*Transfer // accepted and sent files
+	offers map[uint64]*Transfer // received offers, not accepted yet
+}
+
+// NewTransfers registers the file callbacks of t. Set the callbacks of the
+// returned Transfers before t is iterated.
+func NewTransfers(t *tox.Tox) *Transfers {
+	this := &Transfers{t: t, Dir: ".", Perm: 0600}
+	this.active = make(map[uint64]*Transfer)
+	this.offers = make(map[uint64]*Transfer)
+
+	t.CallbackFileRecv(func(t *tox.Tox, friendNumber uint32, fileNumber uint32, kind uint32, fileSize uint64, fileName string, userData interface{}) {
+		this.recv(friendNumber, fileNumber, kind, fileSize, fileName)
+	}, nil)
+	t.CallbackFileRecvChunk(func(t *tox.Tox, friendNumber uint32, fileNumber uint32, position uint64, data []byte, userData interface{}) {
+		this.recvChunk(friendNumber, fileNumber, position, data)
+	}, nil)
+	t.CallbackFileChunkRequest(func(t *tox.Tox, friendNumber uint32, fileNumber uint32, position uint64, length int, userData interface{}) {
+		this.chunkRequest(friendNumber, fileNumber, position, length)
+	}, nil)
+	t.CallbackFileRecvControl(func(t *tox.Tox, friendNumber uint32, fileNumber uint32, control int, userData interface{}) {
+		if control != tox.FileControlCancel {
+			return
+		}
+		k := transferKey(friendNumber, fileNumber)
+		this.mu.Lock()
+		x := this.active[k]
+		delete(this.offers, k)
+		this.mu.Unlock()
+		if x != nil {
+			this.finish(friendNumber, fileNumber, x, fmt.Errorf("cancelled by the friend"))
+		}
+	}, nil)
+	return this
+}
+
+func transferKey(friendNumber uint32, fileNumber uint32) uint64 {
+	return uint64(friendNumber)<<32 | uint64(fileNumber)
+}
+
+// Send offers the regular file at path to the friend under name, and returns the file number.
+func (this *Transfers) Send(friendNumber uint32, path string, name string) (uint32, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := fp.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%s is not a regular file", path)
+	}
+	if err != nil {
+		fp.Close()
+		return 0, err
+	}
+
+	// hold the lock so the first chunk request finds the transfer
+	this.mu.Lock()
+	fileNumber, err := this.t.FileSend(friendNumber, tox.FileKindData, uint64(fi.Size()), "", name)
+	if err == nil {
+		this.active[transferKey(friendNumber, fileNumber)] = &Transfer{File: fp, Name: name, Size: uint64(fi.Size()), Sending: true}
+	}
+	this.mu.Unlock()
+	if err != nil {
+		fp.Close()
+		return 0, err
+	}
+	return fileNumber, nil
+}
+
+// Accept receives an offered file into path, which must not exist yet. An empty path is the offered name in Dir.
+func (this *Transfers) Accept(friendNumber uint32, fileNumber uint32, path string) (*Transfer, error) {
+	k := transferKey(friendNumber, fileNumber)
+	this.mu.Lock()
+	x := this.offers[k]
+	delete(this.offers, k)
+	this.mu.Unlock()
+	if x == nil {
+		return nil, ErrNoTransfer
+	}
+
+	if path == "" {
+		path = filepath.Join(this.Dir, filepath.Base(x.Name))
+	}
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, this.Perm)
+	if err != nil {
+		return nil, err
+	}
+	x.File = fp
+	this.mu.Lock()
+	this.active[k] = x
+	this.mu.Unlock()
+	if _, err := this.t.FileControl(friendNumber, fileNumber, tox.FileControlResume); err != nil {
+		this.mu.Lock()
+		delete(this.active, k)
+		this.mu.Unlock()
+		fp.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return x, nil
+}
+
+// Cancel cancels a transfer, which finishes with reason, or rejects an offer.
+func (this *Transfers) Cancel(friendNumber uint32, fileNumber uint32, reason error) error {
+	k := transferKey(friendNumber, fileNumber)
+	this.mu.Lock()
+	x := this.active[k]
+	_, offered := this.offers[k]
+	delete(this.offers, k)
+	this.mu.Unlock()
+	if x == nil && !offered {
+		return ErrNoTransfer
+	}
+	_, err := this.t.FileControl(friendNumber, fileNumber, tox.FileControlCancel)
+	if x != nil {
+		this.finish(friendNumber, fileNumber, x, reason)
+	}
+	return err
+}
+
+// Close closes the files of all transfers without calling OnFinish. Stop the iterate loop before.
+func (this *Transfers) Close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, x := range this.active {
+		x.File.Close()
+	}
+	this.active = map[uint64]*Transfer{}
+	this.offers = map[uint64]*Transfer{}
+}
+
+func (this *Transfers) recv(friendNumber uint32, fileNumber uint32, kind uint32, fileSize uint64, fileName string) {
+	if kind != tox.FileKindData {
+		this.t.FileControl(friendNumber, fileNumber, tox.FileControlCancel)
+		return
+	}
+	x := &Transfer{Name: fileName, Size: fileSize}
+	this.mu.Lock()
+	this.offers[transferKey(friendNumber, fileNumber)] = x
+	this.mu.Unlock()
+	if this.OnOffer != nil {
+		this.OnOffer(friendNumber, fileNumber, x)
+	}
+}
+
+func (this *Transfers) recvChunk(friendNumber uint32, fileNumber uint32, position uint64, data []byte) {
+	this.mu.Lock()
+	x := this.active[transferKey(friendNumber, fileNumber)]
+	this.mu.Unlock()
+	if x == nil || x.Sending {
+		return
+	}
+	if len(data) == 0 {
+		var err error
+		this.mu.Lock()
+		if x.done != x.Size {
+			err = fmt.Errorf("got %d of %d bytes", x.done, x.Size)
+		}
+		this.mu.Unlock()
+		this.finish(friendNumber, fileNumber, x, err)
+		return
+	}
+	if _, err := x.File.WriteAt(data, int64(position)); err != nil {
+		this.t.FileControl(friendNumber, fileNumber, tox.FileControlCancel)
+		this.finish(friendNumber, fileNumber, x, err)
+		return
+	}
+	this.progress(friendNumber, fileNumber, x, len(data))
+}
+
+func (this *Transfers) chunkRequest(friendNumber uint32, fileNumber uint32, position uint64, length int) {
+	this.mu.Lock()
+	x := this.active[transferKey(friendNumber, fileNumber)]
+	this.mu.Unlock()
+	if x == nil || !x.Sending {
+		return
+	}
+	if length == 0 {
+		this.finish(friendNumber, fileNumber, x, nil)
+		return
+	}
+	buf := make([]byte, length)
+	n, err := x.File.ReadAt(buf, int64(position))
+	if err != nil && err != io.EOF {
+		this.t.FileControl(friendNumber, fileNumber, tox.FileControlCancel)
+		this.finish(friendNumber, fileNumber, x, err)
+		return
+	}
+	if _, err := this.t.FileSendChunk(friendNumber, fileNumber, position, buf[:n]); err == nil {
+		this.progress(friendNumber, fileNumber, x, n)
+	}
+}
+
+// progress records transferred bytes and calls OnProgress in steps of ProgressStep.
+func (this *Transfers) progress(friendNumber uint32, fileNumber uint32, x *Transfer, n int) {
+	this.mu.Lock()
+	x.done += uint64(n)
+	report := x.done-x.reported >= this.ProgressStep
+	if report {
+		x.reported = x.done
+	}
+	done := x.done
+	this.mu.Unlock()
+	if report && this.OnProgress != nil {
+		this.OnProgress(friendNumber, fileNumber, x, done)
+	}
+}
+
+// finish removes the transfer, closes the file and calls OnFinish.
+// Only the first call for a transfer does so, as a cancel may race with its last chunk.
+func (this *Transfers) finish(friendNumber uint32, fileNumber uint32, x *Transfer, err error) {
+	k := transferKey(friendNumber, fileNumber)
+	this.mu.Lock()
+	if this.active[k] != x {
+		this.mu.Unlock()
+		return
+	}
+	delete(this.active, k)
+	this.mu.Unlock()
+	if cerr := x.File.Close(); err == nil {
+		err = cerr
+	}
+	if this.OnFinish != nil {
+		this.OnFinish(friendNumber, fileNumber, x, err)
+	}
+}
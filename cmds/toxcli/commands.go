@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/toxrun"
+)
+
+type command struct {
+	// nargs is the number of arguments, the last one takes the rest of the line.
+	nargs int
+	// optional is the number of trailing arguments which may be left out.
+	optional int
+	usage    string
+	help     string
+	fn       func(this *client, args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	// set in init, the help command refers to the table itself
+	commands = map[string]*command{
+		"/help":        {0, 0, "", "list the commands", (*client).cmdHelp},
+		"/id":          {0, 0, "", "show the own tox id", (*client).cmdID},
+		"/add":         {2, 1, "<toxid> [message]", "send a friend request", (*client).cmdAdd},
+		"/accept":      {1, 0, "<request>", "accept a received friend request", (*client).cmdAccept},
+		"/requests":    {0, 0, "", "list the received friend requests", (*client).cmdRequests},
+		"/del":         {1, 0, "<friend>", "delete a friend", (*client).cmdDel},
+		"/friends":     {0, 0, "", "list the friends", (*client).cmdFriends},
+		"/msg":         {2, 0, "<friend> <text>", "send a message", (*client).cmdMsg},
+		"/send-file":   {2, 0, "<friend> <path>", "send a file", (*client).cmdSendFile},
+		"/recv-file":   {3, 1, "<friend> <file> [path]", "accept a file offer", (*client).cmdRecvFile},
+		"/conf-new":    {1, 1, "[title]", "create a conference", (*client).cmdConfNew},
+		"/conf-invite": {2, 0, "<conference> <friend>", "invite a friend to a conference", (*client).cmdConfInvite},
+		"/conf-join":   {1, 0, "<invite>", "join a conference of a received invite", (*client).cmdConfJoin},
+		"/conf-msg":    {2, 0, "<conference> <text>", "send a message to a conference", (*client).cmdConfMsg},
+		"/confs":       {0, 0, "", "list the conferences", (*client).cmdConfs},
+		"/status":      {2, 2, "[online|away|busy] [message]", "show or set the status and status message", (*client).cmdStatus},
+		"/nick":        {1, 0, "<name>", "set the own name", (*client).cmdNick},
+		"/save":        {0, 0, "", "save the profile now", (*client).cmdSave},
+		"/wait":        {1, 0, "<duration>", "wait, e.g. 5s, while events are processed", (*client).cmdWait},
+		"/wait-online": {2, 1, "<friend> [timeout]", "wait until a friend is online, 1m by default", (*client).cmdWaitOnline},
+		"/quit":        {0, 0, "", "save and exit", nil},
+	}
+}
+
+// exec runs one command line.
+func (this *client) exec(line string) error {
+	name := strings.Fields(line)[0]
+	cmd, ok := commands[name]
+	if !ok || cmd.fn == nil {
+		return fmt.Errorf("unknown command %s, see /help", name)
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(line, name))
+	var args []string
+	if cmd.nargs > 0 && rest != "" {
+		args = strings.SplitN(rest, " ", cmd.nargs)
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+	}
+	if len(args) < cmd.nargs-cmd.optional {
+		return fmt.Errorf("usage: %s %s", name, cmd.usage)
+	}
+	return cmd.fn(this, args)
+}
+
+// friendArg resolves a friend number or public key.
+func (this *client) friendArg(arg string) (uint32, error) {
+	if n, err := strconv.ParseUint(arg, 10, 32); err == nil {
+		if !this.t.FriendExists(uint32(n)) {
+			return 0, fmt.Errorf("no friend #%d", n)
+		}
+		return uint32(n), nil
+	}
+	if len(arg) >= tox.PublicKeySize*2 {
+		return this.t.FriendByPublicKey(arg[:tox.PublicKeySize*2])
+	}
+	return 0, fmt.Errorf("want a friend number or public key, not %q", arg)
+}
+
+func numberArg(arg string) (uint32, error) {
+	n, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("want a number, not %q", arg)
+	}
+	return uint32(n), nil
+}
+
+func (this *client) cmdHelp(args []string) error {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		this.printf("%-13s %-30s %s", name, cmd.usage, cmd.help)
+	}
+	this.printf("<friend> is a friend number or public key.")
+	return nil
+}
+
+func (this *client) cmdID(args []string) error {
+	this.printf("%s", this.t.SelfGetAddress())
+	return nil
+}
+
+func (this *client) cmdAdd(args []string) error {
+	message := "Hi, this is toxcli"
+	if len(args) > 1 && args[1] != "" {
+		message = args[1]
+	}
+	n, err := this.t.FriendAdd(args[0], message)
+	if err != nil {
+		return err
+	}
+	this.printf("added friend #%d", n)
+	return nil
+}
+
+func (this *client) cmdAccept(args []string) error {
+	i, err := numberArg(args[0])
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	if int(i) >= len(this.requests) || this.requests[i].pubkey == "" {
+		this.mu.Unlock()
+		return fmt.Errorf("no friend request %d", i)
+	}
+	req := this.requests[i]
+	this.requests[i] = friendRequest{}
+	this.mu.Unlock()
+
+	n, err := this.t.FriendAddNorequest(req.pubkey)
+	if err != nil {
+		return err
+	}
+	this.printf("accepted %s as friend #%d", req.pubkey, n)
+	return nil
+}
+
+func (this *client) cmdRequests(args []string) error {
+	this.mu.Lock()
+	requests := append([]friendRequest{}, this.requests...)
+	this.mu.Unlock()
+	for i, req := range requests {
+		if req.pubkey != "" {
+			this.printf("%d: %s %s", i, req.pubkey, req.message)
+		}
+	}
+	return nil
+}
+
+func (this *client) cmdDel(args []string) error {
+	n, err := this.friendArg(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = this.t.FriendDelete(n)
+	return err
+}
+
+func (this *client) cmdFriends(args []string) error {
+	for _, n := range this.t.SelfGetFriendList() {
+		pubkey, _ := this.t.FriendGetPublicKey(n)
+		name, _ := this.t.FriendGetName(n)
+		status, _ := this.t.FriendGetConnectionStatus(n)
+		stmsg, _ := this.t.FriendGetStatusMessage(n)
+		this.printf("#%d %s %s %s %s", n, pubkey, tox.ConnStatusString(status), name, stmsg)
+	}
+	return nil
+}
+
+func (this *client) cmdMsg(args []string) error {
+	n, err := this.friendArg(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = this.t.FriendSendMessage(n, args[1])
+	return err
+}
+
+func (this *client) cmdSendFile(args []string) error {
+	n, err := this.friendArg(args[0])
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(args[1])
+	fileNumber, err := this.files.Send(n, args[1], name)
+	if err != nil {
+		return err
+	}
+	this.printf("offered %s to %s as file %d", name, this.friendName(n), fileNumber)
+	return nil
+}
+
+func (this *client) cmdRecvFile(args []string) error {
+	n, err := this.friendArg(args[0])
+	if err != nil {
+		return err
+	}
+	fileNumber, err := numberArg(args[1])
+	if err != nil {
+		return err
+	}
+	path := ""
+	if len(args) > 2 {
+		path = args[2]
+	}
+	x, err := this.files.Accept(n, fileNumber, path)
+	if err == toxrun.ErrNoTransfer {
+		return fmt.Errorf("no file offer %d from %s", fileNumber, this.friendName(n))
+	}
+	if err != nil {
+		return err
+	}
+	this.printf("receiving %s to %s", x.Name, x.File.Name())
+	return nil
+}
+
+func (this *client) cmdConfNew(args []string) error {
+	n, err := this.t.ConferenceNew()
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 && args[0] != "" {
+		if _, err := this.t.ConferenceSetTitle(n, args[0]); err != nil {
+			return err
+		}
+	}
+	this.printf("created conference %d", n)
+	return nil
+}
+
+func (this *client) cmdConfInvite(args []string) error {
+	conf, err := numberArg(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := this.friendArg(args[1])
+	if err != nil {
+		return err
+	}
+	_, err = this.t.ConferenceInvite(n, conf)
+	return err
+}
+
+func (this *client) cmdConfJoin(args []string) error {
+	i, err := numberArg(args[0])
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	if int(i) >= len(this.invites) || this.invites[i].cookie == "" {
+		this.mu.Unlock()
+		return fmt.Errorf("no conference invite %d", i)
+	}
+	inv := this.invites[i]
+	this.invites[i] = conferenceInvite{}
+	this.mu.Unlock()
+
+	conf, err := this.t.ConferenceJoin(inv.friendNumber, inv.cookie)
+	if err != nil {
+		return err
+	}
+	this.printf("joined conference %d", conf)
+	return nil
+}
+
+func (this *client) cmdConfMsg(args []string) error {
+	conf, err := numberArg(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = this.t.ConferenceSendMessage(conf, tox.MessageTypeNormal, args[1])
+	return err
+}
+
+func (this *client) cmdConfs(args []string) error {
+	for _, conf := range this.t.ConferenceGetChatlist() {
+		title, _ := this.t.ConferenceGetTitle(conf)
+		this.printf("%d: %s (%d peers)", conf, title, this.t.ConferencePeerCount(conf))
+	}
+	return nil
+}
+
+var userStatuses = map[string]int{"online": tox.UserStatusNone, "away": tox.UserStatusAway, "busy": tox.UserStatusBusy}
+
+func (this *client) cmdStatus(args []string) error {
+	if len(args) == 0 {
+		stmsg, _ := this.t.SelfGetStatusMessage()
+		status := this.t.SelfGetStatus()
+		for name, s := range userStatuses {
+			if s == status {
+				this.printf("%s %s", name, stmsg)
+			}
+		}
+		return nil
+	}
+	status, ok := userStatuses[args[0]]
+	if !ok {
+		return fmt.Errorf("status must be online, away or busy")
+	}
+	this.t.SelfSetStatus(uint8(status))
+	if len(args) > 1 {
+		if _, err := this.t.SelfSetStatusMessage(args[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *client) cmdNick(args []string) error {
+	return this.t.SelfSetName(args[0])
+}
+
+func (this *client) cmdSave(args []string) error {
+	return this.store.SaveTox(this.t)
+}
+
+func (this *client) cmdWait(args []string) error {
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func (this *client) cmdWaitOnline(args []string) error {
+	n, err := this.friendArg(args[0])
+	if err != nil {
+		return err
+	}
+	timeout := time.Minute
+	if len(args) > 1 && args[1] != "" {
+		if timeout, err = time.ParseDuration(args[1]); err != nil {
+			return err
+		}
+	}
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if status, _ := this.t.FriendGetConnectionStatus(n); status != tox.ConnectionNone {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not online after %s", this.friendName(n), timeout)
+}
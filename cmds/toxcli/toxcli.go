@@ -0,0 +1,238 @@
+package main
+
+//  line oriented tox client, for debugging bots by hand or from scripts
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/passphrase"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/toxrun"
+)
+
+func init() {
+	log.SetFlags(log.Flags() ^ log.Ldate ^ log.Ltime)
+}
+
+var profile = "./toxcli.tox"
+var passSource = passphrase.NewSource()
+var bootstrap = toxrun.DefaultNodes
+var downloads = "."
+var batch bool
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, `Usage: toxcli [options]
+
+Reads commands from stdin, one per line, type /help for the list.
+With -batch, or when stdin is not a terminal, the commands are run as a
+script: no prompt is printed, and toxcli exits with status 1 after the
+last command if any command failed.
+
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = printHelp
+	flag.StringVar(&profile, "profile", profile, "profile file, created if it does not exist")
+	passSource.Register(flag.CommandLine, "", "profile passphrase")
+	flag.StringVar(&bootstrap, "bootstrap", bootstrap, "comma separated bootstrap nodes, host:port:pubkey")
+	flag.StringVar(&downloads, "downloads", downloads, "directory for received files")
+	flag.BoolVar(&batch, "batch", false, "run the commands of stdin as a script")
+	flag.Parse()
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		batch = true
+	}
+
+	nodes, err := toxrun.ParseNodes(bootstrap)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pass, err := passSource.Read()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	c, err := newClient(profile, pass, os.Stdout)
+	tox.WipeBytes(pass)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, node := range nodes {
+		if err := node.Bootstrap(c.t); err != nil {
+			c.printf("bootstrap %s: %v", node, err)
+		}
+	}
+	c.printf("Tox ID: %s", c.t.SelfGetAddress())
+
+	failed := c.run(os.Stdin, !batch)
+	if err := c.close(); err != nil {
+		log.Println("save:", err)
+		failed = true
+	}
+	if failed && batch {
+		os.Exit(1)
+	}
+}
+
+type friendRequest struct {
+	pubkey  string
+	message string
+}
+
+type conferenceInvite struct {
+	friendNumber uint32
+	cookie       string
+}
+
+type client struct {
+	t     *tox.Tox
+	store *tox.SaveStore
+	files *toxrun.Transfers
+	loop  *toxrun.Loop
+	out   io.Writer
+
+	mu       sync.Mutex
+	requests []friendRequest
+	invites  []conferenceInvite
+}
+
+func newClient(profile string, pass []byte, out io.Writer) (*client, error) {
+	this := &client{out: out}
+
+	this.store = tox.NewSaveStore(profile, pass)
+	opts := tox.NewToxOptions()
+	opts.ThreadSafe = true
+	if err := this.store.LoadOptions(opts); err != nil {
+		return nil, err
+	}
+	this.t = tox.NewTox(opts)
+	if this.t == nil {
+		return nil, fmt.Errorf("cannot create the tox instance")
+	}
+	if err := this.store.SaveTox(this.t); err != nil {
+		this.t.Kill()
+		return nil, err
+	}
+	this.store.OnError = func(err error) { this.printf("save: %v", err) }
+	this.store.Attach(this.t)
+	this.setupCallbacks()
+
+	this.loop = toxrun.StartLoop(this.t)
+	return this, nil
+}
+
+// close stops the tox loop, saves the profile and kills the instance.
+func (this *client) close() error {
+	this.loop.Stop()
+	this.files.Close()
+	err := this.store.Close()
+	this.t.Kill()
+	return err
+}
+
+func (this *client) printf(format string, args ...interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fmt.Fprintf(this.out, format+"\n", args...)
+}
+
+// run executes the commands read from in until EOF or /quit, and reports whether any command failed.
+func (this *client) run(in io.Reader, interactive bool) bool {
+	failed := false
+	scanner := bufio.NewScanner(in)
+	for {
+		if interactive {
+			fmt.Fprint(this.out, "> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "/quit" || line == "/exit" {
+			break
+		}
+		if err := this.exec(line); err != nil {
+			this.printf("error: %v", err)
+			failed = true
+		}
+	}
+	return failed
+}
+
+func (this *client) friendName(friendNumber uint32) string {
+	name, err := this.t.FriendGetName(friendNumber)
+	if err != nil || name == "" {
+		return fmt.Sprintf("#%d", friendNumber)
+	}
+	return fmt.Sprintf("%s(#%d)", name, friendNumber)
+}
+
+func (this *client) setupCallbacks() {
+	t := this.t
+	t.CallbackSelfConnectionStatus(func(t *tox.Tox, status int, userData interface{}) {
+		this.printf("* connection: %s", tox.ConnStatusString(status))
+	}, nil)
+	t.CallbackFriendRequest(func(t *tox.Tox, pubkey string, message string, userData interface{}) {
+		this.mu.Lock()
+		this.requests = append(this.requests, friendRequest{pubkey, message})
+		n := len(this.requests) - 1
+		this.mu.Unlock()
+		this.printf("* friend request %d from %s: %s (/accept %d)", n, pubkey, message, n)
+	}, nil)
+	t.CallbackFriendMessage(func(t *tox.Tox, friendNumber uint32, message string, userData interface{}) {
+		this.printf("<%s> %s", this.friendName(friendNumber), message)
+	}, nil)
+	t.CallbackFriendConnectionStatus(func(t *tox.Tox, friendNumber uint32, status int, userData interface{}) {
+		this.printf("* %s is now %s", this.friendName(friendNumber), tox.ConnStatusString(status))
+	}, nil)
+	t.CallbackFriendName(func(t *tox.Tox, friendNumber uint32, newName string, userData interface{}) {
+		this.printf("* #%d is now known as %s", friendNumber, newName)
+	}, nil)
+
+	t.CallbackConferenceInvite(func(t *tox.Tox, friendNumber uint32, itype uint8, cookie string, userData interface{}) {
+		this.mu.Lock()
+		this.invites = append(this.invites, conferenceInvite{friendNumber, cookie})
+		n := len(this.invites) - 1
+		this.mu.Unlock()
+		this.printf("* conference invite %d from %s (/conf-join %d)", n, this.friendName(friendNumber), n)
+	}, nil)
+	t.CallbackConferenceMessage(func(t *tox.Tox, groupNumber uint32, peerNumber uint32, message string, userData interface{}) {
+		name, _ := t.ConferencePeerGetName(groupNumber, peerNumber)
+		this.printf("[conf %d] <%s> %s", groupNumber, name, message)
+	}, nil)
+
+	this.files = toxrun.NewTransfers(t)
+	this.files.Dir = downloads
+	this.files.Perm = 0644
+	this.files.OnOffer = func(friendNumber uint32, fileNumber uint32, x *toxrun.Transfer) {
+		this.printf("* %s offers file %d: %s (%d bytes) (/recv-file %d %d)",
+			this.friendName(friendNumber), fileNumber, x.Name, x.Size, friendNumber, fileNumber)
+	}
+	this.files.OnFinish = func(friendNumber uint32, fileNumber uint32, x *toxrun.Transfer, err error) {
+		switch {
+		case x.Sending && err == nil:
+			this.printf("* sent %s to %s", x.Name, this.friendName(friendNumber))
+		case x.Sending:
+			this.printf("* sending %s to %s: %v", x.Name, this.friendName(friendNumber), err)
+		default:
+			this.printf("* received %s: %v", x.File.Name(), errString(err))
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return err.Error()
+}
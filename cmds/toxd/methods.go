@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/toxrun"
+)
+
+type method func(c *rpcConn, params json.RawMessage) (interface{}, error)
+
+var methods = map[string]method{
+	"subscribe":   subscribe,
+	"unsubscribe": unsubscribe,
+
+	"profile.list":            profileList,
+	"self.get":                selfGet,
+	"self.set_name":           selfSetName,
+	"self.set_status":         selfSetStatus,
+	"self.set_status_message": selfSetStatusMessage,
+
+	"friend.list":   friendList,
+	"friend.add":    friendAdd,
+	"friend.accept": friendAccept,
+	"friend.delete": friendDelete,
+	"message.send":  messageSend,
+
+	"file.send":   fileSend,
+	"file.accept": fileAccept,
+	"file.cancel": fileCancel,
+
+	"conference.new":    conferenceNew,
+	"conference.invite": conferenceInvite,
+	"conference.join":   conferenceJoin,
+	"conference.send":   conferenceSend,
+	"conference.list":   conferenceList,
+}
+
+// profileParams selects the profile of a request, it can be left out with only one profile.
+type profileParams struct {
+	Profile string `json:"profile"`
+}
+
+// decode unmarshals the params of a request and returns its profile.
+func decode(c *rpcConn, params json.RawMessage, v interface{}) (*profile, error) {
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, v); err != nil {
+			return nil, invalidParams("%v", err)
+		}
+	}
+	var pp profileParams
+	if len(params) > 0 {
+		json.Unmarshal(params, &pp)
+	}
+	return c.d.profileByName(pp.Profile)
+}
+
+func (this *profile) checkFriend(friendNumber uint32) error {
+	if !this.t.FriendExists(friendNumber) {
+		return invalidParams("no friend %d", friendNumber)
+	}
+	return nil
+}
+
+func subscribe(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	f := &filter{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, f); err != nil {
+			return nil, invalidParams("%v", err)
+		}
+	}
+	for _, name := range f.Profiles {
+		if _, ok := c.d.profiles[name]; !ok {
+			return nil, invalidParams("no profile %q", name)
+		}
+	}
+	c.mu.Lock()
+	c.filter = f
+	c.mu.Unlock()
+	return nil, nil
+}
+
+func unsubscribe(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	c.mu.Lock()
+	c.filter = nil
+	c.mu.Unlock()
+	return nil, nil
+}
+
+type selfInfo struct {
+	Profile       string `json:"profile"`
+	Address       string `json:"address"`
+	PublicKey     string `json:"public_key"`
+	Name          string `json:"name"`
+	StatusMessage string `json:"status_message"`
+	Status        int    `json:"status"`
+	Connection    string `json:"connection"`
+}
+
+func (this *profile) selfInfo() *selfInfo {
+	stmsg, _ := this.t.SelfGetStatusMessage()
+	return &selfInfo{
+		Profile:       this.name,
+		Address:       this.t.SelfGetAddress(),
+		PublicKey:     this.t.SelfGetPublicKey(),
+		Name:          this.t.SelfGetName(),
+		StatusMessage: stmsg,
+		Status:        this.t.SelfGetStatus(),
+		Connection:    tox.ConnStatusString(this.t.SelfGetConnectionStatus()),
+	}
+}
+
+func profileList(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	infos := []*selfInfo{}
+	for _, name := range c.d.order {
+		infos = append(infos, c.d.profiles[name].selfInfo())
+	}
+	return infos, nil
+}
+
+func selfGet(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	p, err := decode(c, params, &struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	return p.selfInfo(), nil
+}
+
+func selfSetName(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Name string }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	return nil, p.t.SelfSetName(args.Name)
+}
+
+func selfSetStatus(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Status int }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if args.Status != tox.UserStatusNone && args.Status != tox.UserStatusAway && args.Status != tox.UserStatusBusy {
+		return nil, invalidParams("invalid status %d", args.Status)
+	}
+	p.t.SelfSetStatus(uint8(args.Status))
+	return nil, nil
+}
+
+func selfSetStatusMessage(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Message string }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.t.SelfSetStatusMessage(args.Message)
+	return nil, err
+}
+
+type friendInfo struct {
+	Friend        uint32 `json:"friend"`
+	PublicKey     string `json:"public_key"`
+	Name          string `json:"name"`
+	StatusMessage string `json:"status_message"`
+	Connection    string `json:"connection"`
+	LastOnline    uint64 `json:"last_online"`
+}
+
+func friendList(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	p, err := decode(c, params, &struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	infos := []friendInfo{}
+	for _, n := range p.t.SelfGetFriendList() {
+		fi := friendInfo{Friend: n}
+		fi.PublicKey, _ = p.t.FriendGetPublicKey(n)
+		fi.Name, _ = p.t.FriendGetName(n)
+		fi.StatusMessage, _ = p.t.FriendGetStatusMessage(n)
+		status, _ := p.t.FriendGetConnectionStatus(n)
+		fi.Connection = tox.ConnStatusString(status)
+		fi.LastOnline, _ = p.t.FriendGetLastOnline(n)
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+type friendResult struct {
+	Friend uint32 `json:"friend"`
+}
+
+func friendAdd(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Address, Message string }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Address) != tox.AddressSize*2 {
+		return nil, invalidParams("address must be %d hex digits", tox.AddressSize*2)
+	}
+	if args.Message == "" {
+		args.Message = "Hi"
+	}
+	n, err := p.t.FriendAdd(args.Address, args.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &friendResult{n}, nil
+}
+
+func friendAccept(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		PublicKey string `json:"public_key"`
+	}
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.PublicKey) != tox.PublicKeySize*2 {
+		return nil, invalidParams("public_key must be %d hex digits", tox.PublicKeySize*2)
+	}
+	n, err := p.t.FriendAddNorequest(args.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &friendResult{n}, nil
+}
+
+func friendDelete(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Friend uint32 }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkFriend(args.Friend); err != nil {
+		return nil, err
+	}
+	_, err = p.t.FriendDelete(args.Friend)
+	return nil, err
+}
+
+func messageSend(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Friend uint32
+		Text   string
+		Action bool
+	}
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkFriend(args.Friend); err != nil {
+		return nil, err
+	}
+	var id uint32
+	if args.Action {
+		id, err = p.t.FriendSendAction(args.Friend, args.Text)
+	} else {
+		id, err = p.t.FriendSendMessage(args.Friend, args.Text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]uint32{"message_id": id}, nil
+}
+
+type fileResult struct {
+	File uint32 `json:"file"`
+}
+
+func fileSend(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Friend uint32
+		Path   string
+		Name   string
+	}
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkFriend(args.Friend); err != nil {
+		return nil, err
+	}
+	if args.Name == "" {
+		args.Name = filepath.Base(args.Path)
+	}
+	fileNumber, err := p.files.Send(args.Friend, args.Path, args.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileResult{fileNumber}, nil
+}
+
+func fileAccept(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Friend uint32
+		File   uint32
+		Path   string
+	}
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	x, err := p.files.Accept(args.Friend, args.File, args.Path)
+	if err == toxrun.ErrNoTransfer {
+		return nil, invalidParams("no offer of file %d from friend %d", args.File, args.Friend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"path": x.File.Name()}, nil
+}
+
+func fileCancel(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Friend, File uint32 }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	err = p.files.Cancel(args.Friend, args.File, fmt.Errorf("cancelled"))
+	if err == toxrun.ErrNoTransfer {
+		return nil, invalidParams("no transfer of file %d with friend %d", args.File, args.Friend)
+	}
+	return nil, err
+}
+
+type conferenceResult struct {
+	Conference uint32 `json:"conference"`
+}
+
+func conferenceNew(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Title string }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	n, err := p.t.ConferenceNew()
+	if err != nil {
+		return nil, err
+	}
+	if args.Title != "" {
+		if _, err := p.t.ConferenceSetTitle(n, args.Title); err != nil {
+			return nil, err
+		}
+	}
+	return &conferenceResult{n}, nil
+}
+
+func conferenceInvite(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct{ Conference, Friend uint32 }
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkFriend(args.Friend); err != nil {
+		return nil, err
+	}
+	_, err = p.t.ConferenceInvite(args.Friend, args.Conference)
+	return nil, err
+}
+
+func conferenceJoin(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Friend uint32
+		Cookie string
+	}
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	n, err := p.t.ConferenceJoin(args.Friend, args.Cookie)
+	if err != nil {
+		return nil, err
+	}
+	return &conferenceResult{n}, nil
+}
+
+func conferenceSend(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Conference uint32
+		Text       string
+		Action     bool
+	}
+	p, err := decode(c, params, &args)
+	if err != nil {
+		return nil, err
+	}
+	mtype := tox.MessageTypeNormal
+	if args.Action {
+		mtype = tox.MessageTypeAction
+	}
+	_, err = p.t.ConferenceSendMessage(args.Conference, mtype, args.Text)
+	return nil, err
+}
+
+func conferenceList(c *rpcConn, params json.RawMessage) (interface{}, error) {
+	p, err := decode(c, params, &struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	type conferenceInfo struct {
+		Conference uint32 `json:"conference"`
+		Title      string `json:"title"`
+		Peers      uint32 `json:"peers"`
+	}
+	infos := []conferenceInfo{}
+	for _, n := range p.t.ConferenceGetChatlist() {
+		title, _ := p.t.ConferenceGetTitle(n)
+		infos = append(infos, conferenceInfo{n, title, p.t.ConferencePeerCount(n)})
+	}
+	return infos, nil
+}
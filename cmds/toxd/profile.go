@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/toxrun"
+)
+
+// progressStep is the least number of bytes between two file.progress events.
+const progressStep = 256 * 1024
+
+// profile is one Tox instance of the daemon.
+type profile struct {
+	d     *daemon
+	name  string
+	t     *tox.Tox
+	store *tox.SaveStore
+	files *toxrun.Transfers
+	loop  *toxrun.Loop
+}
+
+func newProfile(d *daemon, name string, path string, pass []byte, nodes []toxrun.Node) (*profile, error) {
+	this := &profile{d: d, name: name}
+	this.store = tox.NewSaveStore(path, pass)
+	opts := tox.NewToxOptions()
+	opts.ThreadSafe = true
+	if err := this.store.LoadOptions(opts); err != nil {
+		return nil, err
+	}
+	this.t = tox.NewTox(opts)
+	if this.t == nil {
+		return nil, fmt.Errorf("cannot create the tox instance")
+	}
+	if err := this.store.SaveTox(this.t); err != nil {
+		this.t.Kill()
+		return nil, err
+	}
+	this.store.OnError = func(err error) { this.publish("profile.error", "", map[string]interface{}{"error": err.Error()}) }
+	this.store.Attach(this.t)
+	this.setupCallbacks()
+
+	for _, node := range nodes {
+		if err := node.Bootstrap(this.t); err != nil {
+			log.Println(name, "bootstrap", node, err)
+		}
+	}
+	this.loop = toxrun.StartLoop(this.t)
+	return this, nil
+}
+
+// close stops the tox loop, cancels the transfers, saves the profile and kills the instance.
+func (this *profile) close() error {
+	this.loop.Stop()
+	this.files.Close()
+	err := this.store.Close()
+	this.t.Kill()
+	return err
+}
+
+func (this *profile) publish(typ string, friend string, params map[string]interface{}) {
+	this.d.publish(&event{Type: typ, Profile: this.name, Friend: friend, Params: params})
+}
+
+// friendKey returns the public key of the friend, empty if it is unknown.
+func (this *profile) friendKey(friendNumber uint32) string {
+	pubkey, _ := this.t.FriendGetPublicKey(friendNumber)
+	return pubkey
+}
+
+func (this *profile) setupCallbacks() {
+	t := this.t
+	t.CallbackSelfConnectionStatus(func(t *tox.Tox, status int, userData interface{}) {
+		this.publish("self.connection", "", map[string]interface{}{"status": tox.ConnStatusString(status)})
+	}, nil)
+	t.CallbackFriendRequest(func(t *tox.Tox, pubkey string, message string, userData interface{}) {
+		this.publish("friend.request", pubkey, map[string]interface{}{"public_key": pubkey, "message": message})
+	}, nil)
+	t.CallbackFriendMessage(func(t *tox.Tox, friendNumber uint32, message string, userData interface{}) {
+		this.publish("friend.message", this.friendKey(friendNumber), map[string]interface{}{
+			"friend": friendNumber, "public_key": this.friendKey(friendNumber), "text": message,
+		})
+	}, nil)
+	t.CallbackFriendConnectionStatus(func(t *tox.Tox, friendNumber uint32, status int, userData interface{}) {
+		this.publish("friend.connection", this.friendKey(friendNumber), map[string]interface{}{
+			"friend": friendNumber, "public_key": this.friendKey(friendNumber), "status": tox.ConnStatusString(status),
+		})
+	}, nil)
+	t.CallbackFriendName(func(t *tox.Tox, friendNumber uint32, newName string, userData interface{}) {
+		this.publish("friend.name", this.friendKey(friendNumber), map[string]interface{}{"friend": friendNumber, "name": newName})
+	}, nil)
+	t.CallbackFriendStatusMessage(func(t *tox.Tox, friendNumber uint32, statusText string, userData interface{}) {
+		this.publish("friend.status_message", this.friendKey(friendNumber), map[string]interface{}{"friend": friendNumber, "status_message": statusText})
+	}, nil)
+
+	t.CallbackConferenceInvite(func(t *tox.Tox, friendNumber uint32, itype uint8, cookie string, userData interface{}) {
+		this.publish("conference.invite", this.friendKey(friendNumber), map[string]interface{}{
+			"friend": friendNumber, "type": itype, "cookie": cookie,
+		})
+	}, nil)
+	t.CallbackConferenceMessage(func(t *tox.Tox, groupNumber uint32, peerNumber uint32, message string, userData interface{}) {
+		name, _ := t.ConferencePeerGetName(groupNumber, peerNumber)
+		this.publish("conference.message", "", map[string]interface{}{
+			"conference": groupNumber, "peer": peerNumber, "peer_name": name, "text": message,
+		})
+	}, nil)
+
+	this.files = toxrun.NewTransfers(t)
+	this.files.Dir = downloads
+	this.files.ProgressStep = progressStep
+	this.files.OnOffer = func(friendNumber uint32, fileNumber uint32, x *toxrun.Transfer) {
+		this.publish("file.offer", this.friendKey(friendNumber), map[string]interface{}{
+			"friend": friendNumber, "file": fileNumber, "name": x.Name, "size": x.Size,
+		})
+	}
+	this.files.OnProgress = func(friendNumber uint32, fileNumber uint32, x *toxrun.Transfer, done uint64) {
+		this.publish("file.progress", this.friendKey(friendNumber), map[string]interface{}{
+			"friend": friendNumber, "file": fileNumber, "name": x.Name, "size": x.Size, "transferred": done, "sending": x.Sending,
+		})
+	}
+	// publishes file.done, or file.cancelled with the error
+	this.files.OnFinish = func(friendNumber uint32, fileNumber uint32, x *toxrun.Transfer, err error) {
+		params := map[string]interface{}{"friend": friendNumber, "file": fileNumber, "name": x.Name, "path": x.File.Name(), "sending": x.Sending}
+		if err != nil {
+			params["error"] = err.Error()
+			this.publish("file.cancelled", this.friendKey(friendNumber), params)
+		} else {
+			this.publish("file.done", this.friendKey(friendNumber), params)
+		}
+	}
+}
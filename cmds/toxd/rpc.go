@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	errParse          = -32700
+	errInvalidRequest = -32600
+	errMethodNotFound = -32601
+	errInvalidParams  = -32602
+	errTox            = -32000
+)
+
+// outQueueSize is how many responses and events may wait for a slow client before events are dropped.
+const outQueueSize = 256
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (this *rpcError) Error() string { return this.Message }
+
+func invalidParams(format string, args ...interface{}) error {
+	return &rpcError{errInvalidParams, fmt.Sprintf(format, args...)}
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcNotification struct {
+	JSONRPC string                 `json:"jsonrpc"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+// event is a notification of a profile.
+type event struct {
+	Type    string
+	Profile string
+	// Friend is the public key of the friend the event is about, if any.
+	Friend string
+	Params map[string]interface{}
+}
+
+// filter selects the events a client receives. Empty lists match everything.
+type filter struct {
+	Events   []string `json:"events"`
+	Profiles []string `json:"profiles"`
+	Friends  []string `json:"friends"`
+}
+
+func (this *filter) match(evt *event) bool {
+	ok := len(this.Events) == 0
+	for _, e := range this.Events {
+		if e == "*" || e == evt.Type || (strings.HasSuffix(e, ".*") && strings.HasPrefix(evt.Type, e[:len(e)-1])) {
+			ok = true
+			break
+		}
+	}
+	return ok && matchAny(this.Profiles, evt.Profile) && (evt.Friend == "" || matchAny(this.Friends, evt.Friend))
+}
+
+func matchAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// rpcConn is one client connection.
+type rpcConn struct {
+	d    *daemon
+	conn net.Conn
+	out  chan []byte
+	done chan struct{}
+	// wdone is closed when writeLoop exits
+	wdone chan struct{}
+
+	mu      sync.Mutex
+	filter  *filter // nil until the client subscribes
+	dropped int
+	closed  bool
+}
+
+func newRPCConn(d *daemon, conn net.Conn) *rpcConn {
+	this := &rpcConn{d: d, conn: conn}
+	this.out = make(chan []byte, outQueueSize)
+	this.done = make(chan struct{})
+	this.wdone = make(chan struct{})
+	return this
+}
+
+// serve reads requests until the connection is closed, and flushes the responses.
+func (this *rpcConn) serve() {
+	go this.writeLoop()
+	defer func() {
+		select {
+		case this.out <- nil:
+		case <-this.done:
+		}
+		<-this.wdone
+		this.close()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(this.conn))
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err != io.EOF && !this.isClosed() {
+				this.send(&rpcResponse{Error: &rpcError{errParse, err.Error()}, ID: json.RawMessage("null")})
+			}
+			return
+		}
+
+		raw = bytes.TrimSpace(raw)
+		if len(raw) > 0 && raw[0] == '[' {
+			var batch []json.RawMessage
+			if err := json.Unmarshal(raw, &batch); err != nil || len(batch) == 0 {
+				this.send(&rpcResponse{Error: &rpcError{errInvalidRequest, "invalid batch"}, ID: json.RawMessage("null")})
+				continue
+			}
+			resps := []*rpcResponse{}
+			for _, r := range batch {
+				if resp := this.handle(r); resp != nil {
+					resps = append(resps, resp)
+				}
+			}
+			if len(resps) > 0 {
+				this.send(resps)
+			}
+		} else if resp := this.handle(raw); resp != nil {
+			this.send(resp)
+		}
+	}
+}
+
+// handle runs one request and returns its response, or nil for a notification.
+func (this *rpcConn) handle(raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{errInvalidRequest, "invalid request"}, ID: json.RawMessage("null")}
+	}
+
+	var result interface{}
+	var err error
+	if m, ok := methods[req.Method]; ok {
+		result, err = m(this, req.Params)
+	} else {
+		err = &rpcError{errMethodNotFound, "method not found: " + req.Method}
+	}
+	if req.ID == nil {
+		return nil
+	}
+
+	resp := &rpcResponse{JSONRPC: "2.0", ID: req.ID}
+	if err != nil {
+		rerr, ok := err.(*rpcError)
+		if !ok {
+			rerr = &rpcError{errTox, err.Error()}
+		}
+		resp.Error = rerr
+	} else if result == nil {
+		resp.Result = struct{}{}
+	} else {
+		resp.Result = result
+	}
+	return resp
+}
+
+// send queues a response, waiting for room in the queue.
+func (this *rpcConn) send(v interface{}) {
+	if resp, ok := v.(*rpcResponse); ok {
+		resp.JSONRPC = "2.0"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	select {
+	case this.out <- append(data, '\n'):
+	case <-this.done:
+	}
+}
+
+func (this *rpcConn) subscribed(evt *event) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.filter != nil && this.filter.match(evt)
+}
+
+// notify queues an event without waiting, it is dropped if the client does not keep up.
+func (this *rpcConn) notify(evt *event) {
+	params := map[string]interface{}{"profile": evt.Profile}
+	for k, v := range evt.Params {
+		params[k] = v
+	}
+	data, err := json.Marshal(&rpcNotification{"2.0", evt.Type, params})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	select {
+	case this.out <- append(data, '\n'):
+	default:
+		this.mu.Lock()
+		this.dropped++
+		this.mu.Unlock()
+	}
+}
+
+// writeLoop writes the queued messages until a nil message or close.
+func (this *rpcConn) writeLoop() {
+	defer close(this.wdone)
+	for {
+		select {
+		case data := <-this.out:
+			if data == nil {
+				return
+			}
+			if _, err := this.conn.Write(data); err != nil {
+				this.close()
+				return
+			}
+		case <-this.done:
+			return
+		}
+	}
+}
+
+func (this *rpcConn) isClosed() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.closed
+}
+
+func (this *rpcConn) close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return
+	}
+	this.closed = true
+	close(this.done)
+	this.conn.Close()
+	if this.dropped > 0 {
+		log.Printf("client dropped %d events", this.dropped)
+	}
+}
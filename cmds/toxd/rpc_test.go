@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient is a client connection to a daemon with the profiles a and b, without Tox instances.
+type testClient struct {
+	t    *testing.T
+	d    *daemon
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newTestClient(t *testing.T) *testClient {
+	d := newDaemon()
+	for _, name := range []string{"a", "b"} {
+		d.profiles[name] = &profile{d: d, name: name}
+		d.order = append(d.order, name)
+	}
+	server, client := net.Pipe()
+	c := newRPCConn(d, server)
+	d.clients[c] = true
+	go c.serve()
+	return &testClient{t: t, d: d, conn: client, rd: bufio.NewReader(client)}
+}
+
+func (this *testClient) write(line string) {
+	this.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := this.conn.Write([]byte(line + "\n")); err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+func (this *testClient) read() string {
+	this.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := this.rd.ReadString('\n')
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestRPC(t *testing.T) {
+	c := newTestClient(t)
+	defer c.conn.Close()
+
+	c.write(`{"jsonrpc":"2.0","method":"unsubscribe","id":1}`)
+	if resp := c.read(); resp != `{"jsonrpc":"2.0","result":{},"id":1}` {
+		t.Error("wrong response", resp)
+	}
+	c.write(`{"jsonrpc":"2.0","method":"nope","id":"x"}`)
+	if resp := c.read(); !strings.Contains(resp, `"code":-32601`) || !strings.HasSuffix(resp, `"id":"x"}`) {
+		t.Error("wrong error", resp)
+	}
+	c.write(`{"method":"unsubscribe","id":2}`)
+	if resp := c.read(); !strings.Contains(resp, `"code":-32600`) || !strings.HasSuffix(resp, `"id":null}`) {
+		t.Error("must reject a request without version", resp)
+	}
+
+	// a null id is still answered, a notification is not
+	c.write(`{"jsonrpc":"2.0","method":"unsubscribe","id":null}`)
+	if resp := c.read(); resp != `{"jsonrpc":"2.0","result":{},"id":null}` {
+		t.Error("wrong response to a null id", resp)
+	}
+	c.write(`{"jsonrpc":"2.0","method":"unsubscribe"}`)
+	c.write(`{"jsonrpc":"2.0","method":"nope"}`)
+	c.write(`{"jsonrpc":"2.0","method":"unsubscribe","id":3}`)
+	if resp := c.read(); resp != `{"jsonrpc":"2.0","result":{},"id":3}` {
+		t.Error("must not answer notifications", resp)
+	}
+
+	c.write(`[{"jsonrpc":"2.0","method":"unsubscribe","id":4},{"jsonrpc":"2.0","method":"unsubscribe"},` +
+		`{"jsonrpc":"2.0","method":"nope","id":5},{"bad":1}]`)
+	var resps []rpcResponse
+	if err := json.Unmarshal([]byte(c.read()), &resps); err != nil {
+		t.Fatal(err)
+	}
+	if len(resps) != 3 || string(resps[0].ID) != "4" || resps[1].Error == nil || string(resps[1].ID) != "5" ||
+		resps[2].Error == nil || resps[2].Error.Code != errInvalidRequest {
+		t.Error("wrong batch responses", resps)
+	}
+	c.write(`[]`)
+	if resp := c.read(); !strings.Contains(resp, `"code":-32600`) {
+		t.Error("must reject an empty batch", resp)
+	}
+	c.write(`[{"jsonrpc":"2.0","method":"unsubscribe"}]`)
+	c.write(`{"jsonrpc":"2.0","method":"unsubscribe","id":6}`)
+	if resp := c.read(); !strings.HasSuffix(resp, `"id":6}`) {
+		t.Error("must not answer a batch of notifications", resp)
+	}
+
+	c.write(`{"jsonrpc":"2.0","method":"subscribe","params":{"profiles":["c"]},"id":7}`)
+	if resp := c.read(); !strings.Contains(resp, `"code":-32602`) {
+		t.Error("must reject an unknown profile", resp)
+	}
+	c.write(`{"jsonrpc":"2.0","method":"subscribe","params":{"events":["friend.*"],"profiles":["a"],"friends":["ABCD"]},"id":8}`)
+	if resp := c.read(); !strings.HasSuffix(resp, `"id":8}`) {
+		t.Fatal("wrong subscribe response", resp)
+	}
+	c.d.publish(&event{Type: "self.connection", Profile: "a"})
+	c.d.publish(&event{Type: "friend.message", Profile: "b", Friend: "ABCD"})
+	c.d.publish(&event{Type: "friend.message", Profile: "a", Friend: "EF01"})
+	c.d.publish(&event{Type: "friend.message", Profile: "a", Friend: "abcd", Params: map[string]interface{}{"text": "hi"}})
+	if evt := c.read(); evt != `{"jsonrpc":"2.0","method":"friend.message","params":{"profile":"a","text":"hi"}}` {
+		t.Error("wrong event", evt)
+	}
+
+	c.write(`{"jsonrpc":"2.0","method":"unsubscribe","id":9}`)
+	c.read()
+	c.d.publish(&event{Type: "friend.message", Profile: "a", Friend: "ABCD"})
+	c.write(`{"jsonrpc":"2.0","method":"unsubscribe","id":10}`)
+	if resp := c.read(); !strings.HasSuffix(resp, `"id":10}`) {
+		t.Error("must not send events after unsubscribe", resp)
+	}
+
+	c.write(`{"jsonrpc":}`)
+	if resp := c.read(); !strings.Contains(resp, `"code":-32700`) {
+		t.Error("wrong parse error", resp)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := &filter{}
+	if !f.match(&event{Type: "file.done", Profile: "a", Friend: "AB"}) {
+		t.Error("empty filter must match everything")
+	}
+	f = &filter{Events: []string{"file.*", "self.connection"}, Friends: []string{"AB"}}
+	for _, c := range []struct {
+		evt    event
+		expect bool
+	}{
+		{event{Type: "file.done", Friend: "ab"}, true},
+		{event{Type: "file.done", Friend: "CD"}, false},
+		{event{Type: "filesystem", Friend: "AB"}, false},
+		{event{Type: "self.connection"}, true}, // not about a friend
+		{event{Type: "self.name", Profile: "any"}, false},
+	} {
+		if f.match(&c.evt) != c.expect {
+			t.Error("wrong match", c.evt)
+		}
+	}
+}
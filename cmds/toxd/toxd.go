@@ -0,0 +1,212 @@
+package main
+
+//  tox daemon, exposes profiles over a JSON-RPC 2.0 unix socket
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/passphrase"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/toxrun"
+)
+
+func init() {
+	log.SetFlags(log.Flags() | log.Lshortfile)
+}
+
+type profileFlags map[string]string
+
+func (this profileFlags) String() string {
+	return fmt.Sprint(map[string]string(this))
+}
+
+func (this profileFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("want name=path, not %q", v)
+	}
+	if _, ok := this[v[:i]]; ok {
+		return fmt.Errorf("profile %s given twice", v[:i])
+	}
+	this[v[:i]] = v[i+1:]
+	return nil
+}
+
+var profiles = profileFlags{}
+var socketPath = defaultSocketPath()
+var passSource = passphrase.NewSource()
+var bootstrap = toxrun.DefaultNodes
+var downloads = "."
+
+func defaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "toxd.sock")
+	}
+	return "./toxd.sock"
+}
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, `Usage: toxd -profile name=path [-profile name=path...] [options]
+
+Runs the profiles and serves JSON-RPC 2.0 requests on a unix socket, one
+JSON value per line. Events are sent as notifications to the clients which
+subscribed to them with the "subscribe" method.
+
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = printHelp
+	flag.Var(profiles, "profile", "profile name=path, created if the file does not exist, can be repeated")
+	flag.StringVar(&socketPath, "socket", socketPath, "unix socket path")
+	passSource.Register(flag.CommandLine, "", "passphrase of the profiles")
+	flag.StringVar(&bootstrap, "bootstrap", bootstrap, "comma separated bootstrap nodes, host:port:pubkey")
+	flag.StringVar(&downloads, "downloads", downloads, "default directory for received files")
+	flag.Parse()
+	if len(profiles) == 0 {
+		printHelp()
+		os.Exit(1)
+	}
+
+	nodes, err := toxrun.ParseNodes(bootstrap)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pass, err := passSource.Read()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	d := newDaemon()
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, err := newProfile(d, name, profiles[name], pass, nodes)
+		if err != nil {
+			d.close()
+			log.Fatalln(name, err)
+		}
+		d.profiles[name] = p
+		d.order = append(d.order, name)
+		log.Println("profile", name, p.t.SelfGetAddress())
+	}
+	tox.WipeBytes(pass)
+
+	// a stale socket of a crashed daemon is replaced, a live one is not
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		d.close()
+		log.Fatalln("another daemon is listening on", socketPath)
+	}
+	os.Remove(socketPath)
+	oldmask := syscall.Umask(0077)
+	ln, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldmask)
+	if err != nil {
+		d.close()
+		log.Fatalln(err)
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Println("exiting on", <-sigch)
+		ln.Close()
+	}()
+
+	d.serve(ln)
+	os.Remove(socketPath)
+	d.close()
+}
+
+// daemon owns the profiles and the connected clients.
+type daemon struct {
+	profiles map[string]*profile
+	order    []string
+
+	mu      sync.Mutex
+	clients map[*rpcConn]bool
+}
+
+func newDaemon() *daemon {
+	this := &daemon{}
+	this.profiles = make(map[string]*profile)
+	this.clients = make(map[*rpcConn]bool)
+	return this
+}
+
+func (this *daemon) serve(ln net.Listener) {
+	var wg sync.WaitGroup
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		c := newRPCConn(this, conn)
+		this.mu.Lock()
+		this.clients[c] = true
+		this.mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serve()
+			this.mu.Lock()
+			delete(this.clients, c)
+			this.mu.Unlock()
+		}()
+	}
+
+	this.mu.Lock()
+	for c := range this.clients {
+		c.close()
+	}
+	this.mu.Unlock()
+	wg.Wait()
+}
+
+// publish sends the event to every client subscribed to it.
+func (this *daemon) publish(evt *event) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for c := range this.clients {
+		if c.subscribed(evt) {
+			c.notify(evt)
+		}
+	}
+}
+
+func (this *daemon) close() {
+	for _, name := range this.order {
+		if err := this.profiles[name].close(); err != nil {
+			log.Println(name, "save:", err)
+		}
+	}
+}
+
+// profileByName returns the named profile, or the only one if the name is empty.
+func (this *daemon) profileByName(name string) (*profile, error) {
+	if name == "" {
+		if len(this.order) != 1 {
+			return nil, invalidParams("profile is required, there are %d profiles", len(this.order))
+		}
+		name = this.order[0]
+	}
+	p, ok := this.profiles[name]
+	if !ok {
+		return nil, invalidParams("no profile %q", name)
+	}
+	return p, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxRequestBody limits the size of requests to the HTTP endpoint.
+const maxRequestBody = 64 * 1024
+
+// messenger sends messages to friends, implemented by bridge and by a fake in the tests.
+type messenger interface {
+	// SendMessage sends a message to the friend with the public key, errNoFriend if there is none.
+	SendMessage(pubkey string, text string, action bool) (uint32, error)
+}
+
+type httpError struct {
+	status  int
+	message string
+}
+
+func (this *httpError) Error() string { return this.message }
+
+var errNoFriend = &httpError{http.StatusNotFound, "no friend with this public key"}
+
+// sendRequest is the body of POST /messages.
+type sendRequest struct {
+	PublicKey string `json:"public_key"`
+	Text      string `json:"text"`
+	Action    bool   `json:"action"`
+}
+
+// server is the HTTP endpoint for outgoing messages.
+type server struct {
+	m     messenger
+	token string
+}
+
+func (this *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/messages" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only POST"})
+		return
+	}
+	if this.token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(this.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "bad token"})
+			return
+		}
+	}
+
+	var req sendRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody))
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad request: " + err.Error()})
+		return
+	}
+	if len(req.PublicKey) != 64 || req.Text == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "need a 64 digit public_key and a text"})
+		return
+	}
+
+	id, err := this.m.SendMessage(strings.ToUpper(req.PublicKey), req.Text, req.Action)
+	if err != nil {
+		status := http.StatusBadGateway
+		if herr, ok := err.(*httpError); ok {
+			status = herr.status
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint32{"message_id": id})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,260 @@
+package main
+
+//  tox webhook bridge, posts incoming messages to webhooks and sends messages posted to an HTTP endpoint
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/passphrase"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/toxrun"
+)
+
+func init() {
+	log.SetFlags(log.Flags() | log.Lshortfile)
+}
+
+type listFlag []string
+
+func (this *listFlag) String() string     { return strings.Join(*this, ",") }
+func (this *listFlag) Set(v string) error { *this = append(*this, v); return nil }
+
+var webhooks listFlag
+var profile = "./toxhook.tox"
+var passSource = passphrase.NewSource()
+var secretEnv string
+var tokenEnv string
+var listen = "127.0.0.1:8080"
+var bootstrap = toxrun.DefaultNodes
+var retries = 5
+var acceptRequests bool
+var joinInvites bool
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, `Usage: toxhook -webhook URL [-webhook URL...] [options]
+
+Posts incoming friend and conference messages as JSON to the webhooks, signed
+with the secret of -secret-env in the %s header, and serves
+POST /messages {"public_key": ..., "text": ..., "action": false}
+to send messages to friends, guarded by the bearer token of -token-env.
+
+`, headerSignature)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = printHelp
+	flag.Var(&webhooks, "webhook", "webhook URL, can be repeated")
+	flag.StringVar(&profile, "profile", profile, "profile file, created if it does not exist")
+	passSource.Register(flag.CommandLine, "", "profile passphrase")
+	flag.StringVar(&secretEnv, "secret-env", "", "read the webhook signing secret from this environment variable")
+	flag.StringVar(&tokenEnv, "token-env", "", "read the HTTP endpoint bearer token from this environment variable")
+	flag.StringVar(&listen, "listen", listen, "HTTP endpoint address, empty to disable")
+	flag.StringVar(&bootstrap, "bootstrap", bootstrap, "comma separated bootstrap nodes, host:port:pubkey")
+	flag.IntVar(&retries, "retries", retries, "retries of a failed webhook delivery")
+	flag.BoolVar(&acceptRequests, "accept", false, "accept all friend requests")
+	flag.BoolVar(&joinInvites, "join", false, "join the conferences friends invite to")
+	flag.Parse()
+	if len(webhooks) == 0 && listen == "" {
+		printHelp()
+		os.Exit(1)
+	}
+
+	nodes, err := toxrun.ParseNodes(bootstrap)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pass, err := passSource.Read()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	secret, token := lookupEnv(secretEnv), lookupEnv(tokenEnv)
+	store := tox.NewSaveStore(profile, pass)
+	tox.WipeBytes(pass)
+	opts := tox.NewToxOptions()
+	opts.ThreadSafe = true
+	if err := store.LoadOptions(opts); err != nil {
+		log.Fatalln(err)
+	}
+	t := tox.NewTox(opts)
+	if t == nil {
+		log.Fatalln("cannot create the tox instance")
+	}
+	if err := store.SaveTox(t); err != nil {
+		log.Fatalln(err)
+	}
+	store.OnError = func(err error) { log.Println("save:", err) }
+	store.Attach(t)
+	for _, node := range nodes {
+		if err := node.Bootstrap(t); err != nil {
+			log.Println("bootstrap", node, err)
+		}
+	}
+	log.Println("Tox ID:", t.SelfGetAddress())
+
+	hooks := []*webhook{}
+	for _, url := range webhooks {
+		h := newWebhook(url, []byte(secret))
+		h.Retries = retries
+		h.start()
+		hooks = append(hooks, h)
+	}
+	b := &bridge{t: t, hooks: hooks}
+	b.setupCallbacks()
+
+	var srv *http.Server
+	if listen != "" {
+		srv = &http.Server{Addr: listen, Handler: &server{m: b, token: token}}
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
+	loop := toxrun.StartLoop(t)
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("exiting on", <-sigch)
+	loop.Stop()
+
+	if srv != nil {
+		srv.Close()
+	}
+	for _, h := range hooks {
+		h.stop()
+	}
+	if err := store.Close(); err != nil {
+		log.Println("save:", err)
+	}
+	t.Kill()
+}
+
+// lookupEnv returns the value of the named environment variable, and exits if it is not set.
+// An empty name gives an empty value.
+func lookupEnv(name string) string {
+	if name == "" {
+		return ""
+	}
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		log.Fatalln("environment variable", name, "is not set")
+	}
+	return v
+}
+
+// bridge connects the Tox instance to the webhooks and the HTTP endpoint.
+type bridge struct {
+	t     *tox.Tox
+	hooks []*webhook
+}
+
+// friendEvent is the webhook body of a friend message.
+type friendEvent struct {
+	Event     string `json:"event"`
+	Time      string `json:"time"`
+	Self      string `json:"self"`
+	Friend    uint32 `json:"friend"`
+	PublicKey string `json:"public_key"`
+	Name      string `json:"name"`
+	Text      string `json:"text"`
+}
+
+// conferenceEvent is the webhook body of a conference message.
+type conferenceEvent struct {
+	Event      string `json:"event"`
+	Time       string `json:"time"`
+	Self       string `json:"self"`
+	Conference uint32 `json:"conference"`
+	Title      string `json:"title"`
+	Peer       uint32 `json:"peer"`
+	PeerName   string `json:"peer_name"`
+	Text       string `json:"text"`
+}
+
+func (this *bridge) post(event string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, h := range this.hooks {
+		h.post(event, body)
+	}
+}
+
+func (this *bridge) setupCallbacks() {
+	this.t.CallbackFriendRequest(func(t *tox.Tox, pubkey string, message string, userData interface{}) {
+		if !acceptRequests {
+			return
+		}
+		if _, err := t.FriendAddNorequest(pubkey); err != nil {
+			log.Println("accept", pubkey, err)
+		}
+	}, nil)
+	this.t.CallbackConferenceInvite(func(t *tox.Tox, friendNumber uint32, itype uint8, cookie string, userData interface{}) {
+		joinInvite(t, friendNumber, itype, cookie)
+	}, nil)
+	this.t.CallbackFriendMessage(func(t *tox.Tox, friendNumber uint32, message string, userData interface{}) {
+		pubkey, _ := t.FriendGetPublicKey(friendNumber)
+		name, _ := t.FriendGetName(friendNumber)
+		this.post("friend.message", &friendEvent{
+			Event: "friend.message", Time: time.Now().UTC().Format(time.RFC3339), Self: t.SelfGetPublicKey(),
+			Friend: friendNumber, PublicKey: pubkey, Name: name, Text: message,
+		})
+	}, nil)
+	this.t.CallbackConferenceMessage(func(t *tox.Tox, groupNumber uint32, peerNumber uint32, message string, userData interface{}) {
+		if t.ConferencePeerNumberIsOurs(groupNumber, peerNumber) {
+			return
+		}
+		title, _ := t.ConferenceGetTitle(groupNumber)
+		peerName, _ := t.ConferencePeerGetName(groupNumber, peerNumber)
+		this.post("conference.message", &conferenceEvent{
+			Event: "conference.message", Time: time.Now().UTC().Format(time.RFC3339), Self: t.SelfGetPublicKey(),
+			Conference: groupNumber, Title: title, Peer: peerNumber, PeerName: peerName, Text: message,
+		})
+	}, nil)
+}
+
+// conferenceJoiner joins conferences, implemented by tox.Tox and by a fake in the tests.
+type conferenceJoiner interface {
+	ConferenceJoin(friendNumber uint32, cookie string) (uint32, error)
+	JoinAVGroupChat(friendNumber uint32, cookie string) (int, error)
+}
+
+// joinInvite joins the conference of an invite with -join. Invites only come from
+// friends, so these are the ones accepted with -accept or added before.
+func joinInvite(j conferenceJoiner, friendNumber uint32, itype uint8, cookie string) {
+	if !joinInvites {
+		return
+	}
+	var err error
+	if itype == tox.ConferenceTypeAV {
+		_, err = j.JoinAVGroupChat(friendNumber, cookie)
+	} else {
+		_, err = j.ConferenceJoin(friendNumber, cookie)
+	}
+	if err != nil {
+		log.Println("join conference of friend", friendNumber, err)
+	}
+}
+
+func (this *bridge) SendMessage(pubkey string, text string, action bool) (uint32, error) {
+	friendNumber, err := this.t.FriendByPublicKey(pubkey)
+	if err != nil {
+		return 0, errNoFriend
+	}
+	if action {
+		return this.t.FriendSendAction(friendNumber, text)
+	}
+	return this.t.FriendSendMessage(friendNumber, text)
+}
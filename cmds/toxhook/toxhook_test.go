@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TokTok/go-toxcore-c"
+)
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("s3cret")
+	var mu sync.Mutex
+	var bodies []string
+	statuses := []int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sig := sign(secret, r.Header.Get(headerTimestamp), body)
+		if !hmac.Equal([]byte(sig), []byte(r.Header.Get(headerSignature))) {
+			t.Error("bad signature", r.Header.Get(headerSignature))
+		}
+		if r.Header.Get(headerEvent) != "friend.message" || r.Header.Get(headerDelivery) == "" {
+			t.Error("missing headers", r.Header)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	h := newWebhook(srv.URL, secret)
+	sleeps := []time.Duration{}
+	h.sleepfn = func(d time.Duration) { sleeps = append(sleeps, d) }
+	h.Retries = 3
+
+	t.Run("retry", func(t *testing.T) {
+		bodies, sleeps = nil, nil
+		statuses = []int{500, 429, 200}
+		if err := h.deliver("friend.message", []byte(`{"text":"hi"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if len(bodies) != 3 || bodies[2] != `{"text":"hi"}` {
+			t.Error("wrong deliveries", bodies)
+		}
+		if len(sleeps) != 2 || sleeps[1] != 2*h.Backoff {
+			t.Error("wrong backoff", sleeps)
+		}
+	})
+
+	t.Run("give up", func(t *testing.T) {
+		bodies = nil
+		statuses = []int{503, 503, 503, 503, 503}
+		if err := h.deliver("friend.message", []byte(`{}`)); err == nil {
+			t.Error("must fail after the retries")
+		}
+		if len(bodies) != h.Retries+1 {
+			t.Error("wrong attempts", len(bodies))
+		}
+	})
+
+	t.Run("client error", func(t *testing.T) {
+		bodies = nil
+		statuses = []int{400}
+		if err := h.deliver("friend.message", []byte(`{}`)); err == nil || len(bodies) != 1 {
+			t.Error("must not retry a client error", err, len(bodies))
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		bodies = nil
+		statuses = nil
+		h.start()
+		h.post("friend.message", []byte(`1`))
+		h.post("friend.message", []byte(`2`))
+		h.stop()
+		if strings.Join(bodies, ",") != "1,2" {
+			t.Error("wrong queued deliveries", bodies)
+		}
+	})
+}
+
+type fakeMessenger struct {
+	sent []sendRequest
+}
+
+func (this *fakeMessenger) SendMessage(pubkey string, text string, action bool) (uint32, error) {
+	if !strings.HasPrefix(pubkey, "AA") {
+		return 0, errNoFriend
+	}
+	this.sent = append(this.sent, sendRequest{pubkey, text, action})
+	return uint32(len(this.sent)), nil
+}
+
+func TestServer(t *testing.T) {
+	m := &fakeMessenger{}
+	srv := httptest.NewServer(&server{m: m, token: "tok"})
+	defer srv.Close()
+
+	friend := strings.Repeat("aa", 32)
+	post := func(path string, token string, body string) (int, string) {
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if status, body := post("/messages", "tok", `{"public_key":"`+friend+`","text":"hello"}`); status != 200 || !strings.Contains(body, `"message_id":1`) {
+		t.Error("send failed", status, body)
+	}
+	if len(m.sent) != 1 || m.sent[0].PublicKey != strings.ToUpper(friend) || m.sent[0].Text != "hello" {
+		t.Error("wrong message", m.sent)
+	}
+	if status, _ := post("/messages", "", `{}`); status != http.StatusUnauthorized {
+		t.Error("must require the token", status)
+	}
+	if status, _ := post("/messages", "wrong", `{}`); status != http.StatusUnauthorized {
+		t.Error("must reject a wrong token", status)
+	}
+	if status, _ := post("/messages", "tok", `{"public_key":"`+strings.Repeat("bb", 32)+`","text":"x"}`); status != http.StatusNotFound {
+		t.Error("must report an unknown friend", status)
+	}
+	if status, _ := post("/messages", "tok", `{"text":"x"}`); status != http.StatusBadRequest {
+		t.Error("must reject a missing public key", status)
+	}
+	if status, _ := post("/other", "tok", `{}`); status != http.StatusNotFound {
+		t.Error("wrong path", status)
+	}
+	if resp, err := http.Get(srv.URL + "/messages"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("must only allow POST", err)
+	}
+}
+
+type fakeJoiner struct {
+	joined []string
+}
+
+func (this *fakeJoiner) ConferenceJoin(friendNumber uint32, cookie string) (uint32, error) {
+	this.joined = append(this.joined, "text:"+cookie)
+	return 0, nil
+}
+
+func (this *fakeJoiner) JoinAVGroupChat(friendNumber uint32, cookie string) (int, error) {
+	this.joined = append(this.joined, "av:"+cookie)
+	return 0, errors.New("no av")
+}
+
+func TestJoinInvite(t *testing.T) {
+	j := &fakeJoiner{}
+	joinInvite(j, 0, tox.ConferenceTypeText, "c1")
+	if len(j.joined) != 0 {
+		t.Error("must not join without -join", j.joined)
+	}
+
+	defer func() { joinInvites = false }()
+	joinInvites = true
+	joinInvite(j, 0, tox.ConferenceTypeText, "c2")
+	joinInvite(j, 1, tox.ConferenceTypeAV, "c3")
+	if strings.Join(j.joined, ",") != "text:c2,av:c3" {
+		t.Error("wrong joins", j.joined)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of the webhook requests. The signature is the hex HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the shared secret.
+const (
+	headerEvent     = "X-Toxhook-Event"
+	headerDelivery  = "X-Toxhook-Delivery"
+	headerTimestamp = "X-Toxhook-Timestamp"
+	headerSignature = "X-Toxhook-Signature"
+)
+
+// sign returns the signature header value of a webhook body.
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type delivery struct {
+	event string
+	body  []byte
+}
+
+// webhook posts events to one URL from its own queue, so a slow receiver does not delay the others.
+type webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+
+	// Retries is how often a failed delivery is retried, Backoff the wait before the first retry, doubled for each further one.
+	Retries int
+	Backoff time.Duration
+
+	queue chan delivery
+	wg    sync.WaitGroup
+	// sleepfn waits between retries, replaced in tests
+	sleepfn func(d time.Duration)
+}
+
+func newWebhook(url string, secret []byte) *webhook {
+	this := &webhook{url: url, secret: secret}
+	this.client = &http.Client{Timeout: 10 * time.Second}
+	this.Retries = 5
+	this.Backoff = time.Second
+	this.queue = make(chan delivery, 1024)
+	this.sleepfn = time.Sleep
+	return this
+}
+
+func (this *webhook) start() {
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+		for d := range this.queue {
+			if err := this.deliver(d.event, d.body); err != nil {
+				log.Printf("webhook %s: %s dropped: %v", this.url, d.event, err)
+			}
+		}
+	}()
+}
+
+// post queues an event, dropping it if the queue is full.
+func (this *webhook) post(event string, body []byte) {
+	select {
+	case this.queue <- delivery{event, body}:
+	default:
+		log.Printf("webhook %s: queue full, %s dropped", this.url, event)
+	}
+}
+
+// stop delivers the queued events and stops.
+func (this *webhook) stop() {
+	close(this.queue)
+	this.wg.Wait()
+}
+
+// deliver posts the body, retrying on network errors, 429 and 5xx responses.
+func (this *webhook) deliver(event string, body []byte) error {
+	var id [8]byte
+	rand.Read(id[:])
+	backoff := this.Backoff
+	var err error
+	for attempt := 0; attempt <= this.Retries; attempt++ {
+		if attempt > 0 {
+			this.sleepfn(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		if retry, err = this.try(event, hex.EncodeToString(id[:]), body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// try makes one attempt and reports whether a failure is worth retrying.
+func (this *webhook) try(event string, id string, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", this.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerEvent, event)
+	req.Header.Set(headerDelivery, id)
+	req.Header.Set(headerTimestamp, timestamp)
+	if len(this.secret) > 0 {
+		req.Header.Set(headerSignature, sign(this.secret, timestamp, body))
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("status %s", resp.Status)
+}
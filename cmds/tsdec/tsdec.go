@@ -3,143 +3,293 @@ package main
 //  tox save data decrypt/encrypt
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 
 	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/passphrase"
+	"github.com/TokTok/go-toxcore-c/savedata"
 )
 
 func init() {
 	log.SetFlags(log.Flags() ^ log.Ldate ^ log.Ltime)
 }
 
-var tsfile string = "tox_save.tox"
-var pass string
-var tofile string = "./tsdec.bin"
+// exit codes
+const (
+	exitOK = iota
+	exitUsage
+	exitIO
+	exitPassphrase
+	exitInvalid
+)
+
+type exitError struct {
+	code int
+	err  error
+}
 
-var crypt_mode string // enc/dec
-var decrypt_mode = false
-var encrypt_mode = false
+func (this *exitError) Error() string { return this.err.Error() }
+
+func fail(code int, err error) error {
+	return &exitError{code, err}
+}
 
 func printHelp() {
-	log.Println("For help: /path/to/tsdec [options] <tsfile> -h")
+	fmt.Fprintf(os.Stderr, `Usage: tsdec <command> [options] <tsfile>
+
+Commands:
+  decrypt   decrypt the save file
+  encrypt   encrypt the save file
+  rekey     change the passphrase of an encrypted save file
+  verify    check that the save file decrypts and parses
+
+The passphrase is read from -pass-env, -pass-fd or a terminal prompt,
+the new passphrase of rekey from -new-pass-env, -new-pass-fd or a prompt.
+Output goes to -o, or replaces the save file with -i, both atomically.
+
+Exit codes: 0 ok, 1 usage, 2 i/o error, 3 wrong passphrase, 4 invalid save data.
+Run tsdec <command> -h for the options of a command.
+`)
 }
 
 func main() {
-	// flag.StringVar(&tsfile, "tsfile", "", "tox save data file")
-	flag.StringVar(&pass, "pass", pass, "tox save data password")
-	flag.StringVar(&tofile, "tofile", tofile, "result file")
+	if len(os.Args) < 2 {
+		printHelp()
+		os.Exit(exitUsage)
+	}
 
-	flag.Parse()
-	// log.Println(flag.Args())
-	if len(flag.Args()) < 1 {
+	var err error
+	switch os.Args[1] {
+	case "decrypt", "encrypt", "rekey":
+		err = convert(os.Args[1], os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	case "-h", "-help", "--help", "help":
 		printHelp()
-		flag.Usage()
 		return
+	default:
+		printHelp()
+		err = fail(exitUsage, fmt.Errorf("unknown command %q", os.Args[1]))
 	}
-	tsfile = flag.Arg(0)
 
-	data, err := ioutil.ReadFile(tsfile)
 	if err != nil {
 		log.Println(err)
-		return
+		if e, ok := err.(*exitError); ok {
+			os.Exit(e.code)
+		}
+		os.Exit(exitIO)
 	}
+}
 
-	isencrypt := tox.IsDataEncrypted(data)
-	log.Println("Is encrypt: ", isencrypt)
-	if isencrypt && pass == "" {
-		log.Println("Need -pass argument.")
-		flag.Usage()
-		return
-	}
+type passSource struct {
+	passphrase.Source
+}
 
-	if isencrypt {
-		ok, err, salt := tox.GetSalt(data)
-		if err != nil {
-			log.Println(ok, err, len(salt), salt)
+func (this *passSource) flags(fs *flag.FlagSet, prefix string, what string) {
+	this.Fd = -1
+	this.Register(fs, prefix, what)
+}
+
+// read returns the passphrase from the configured source, or prompts for it on the terminal.
+func (this *passSource) read(prompt string, confirm bool) ([]byte, error) {
+	var pass []byte
+	var err error
+	if this.IsSet() {
+		if pass, err = this.Read(); err != nil {
+			if this.Env != "" {
+				return nil, fail(exitUsage, err)
+			}
+			return nil, fail(exitIO, err)
 		}
-		pkey, err := tox.DeriveWithSalt([]byte(pass), salt)
-		defer pkey.Free()
-		if err != nil {
-			log.Println(err)
+	} else {
+		if pass, err = promptPassphrase(prompt); err != nil {
+			return nil, err
 		}
-		ok, err, datad := pkey.Decrypt(data)
-		if err != nil {
-			// log.Println(ok, err, len(datad), datad[0:32])
-			log.Println("Decrypt error, check your -pass:", err)
-			return
+		if confirm {
+			again, err := promptPassphrase("Repeat " + prompt)
+			if err != nil {
+				return nil, err
+			}
+			same := bytes.Equal(pass, again)
+			tox.WipeBytes(again)
+			if !same {
+				tox.WipeBytes(pass)
+				return nil, fail(exitPassphrase, fmt.Errorf("passphrases do not match"))
+			}
 		}
+	}
+	if len(pass) == 0 {
+		return nil, fail(exitPassphrase, fmt.Errorf("empty passphrase"))
+	}
+	return pass, nil
+}
 
-		data = datad
+// promptPassphrase reads a line from the terminal with echo turned off.
+func promptPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fail(exitUsage, fmt.Errorf("no terminal for the passphrase prompt, use -pass-env or -pass-fd"))
 	}
+	defer tty.Close()
 
-	opts := tox.NewToxOptions()
-	opts.Savedata_type = tox.SAVEDATA_TYPE_TOX_SAVE
-	opts.Savedata_data = data
-	t := tox.NewTox(opts)
-	fnums := t.SelfGetFriendList()
-	log.Println(fnums, t)
-	log.Println("Self Name:", t.SelfGetName())
-	log.Println("Self ID:", t.SelfGetAddress())
-	mystmsg, err := t.SelfGetStatusMessage()
-	log.Println("Status:", mystmsg)
-	log.Println("------------------------------------------")
-	log.Println("Friend Count:", len(fnums))
+	fmt.Fprint(tty, prompt+": ")
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return nil, fail(exitIO, fmt.Errorf("cannot turn off terminal echo: %v", err))
+	}
+	line, err := bufio.NewReader(tty).ReadBytes('\n')
+	stty("echo")
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, fail(exitIO, err)
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
 
-	if tox.FileExist(tofile) {
-		log.Println(os.ErrExist, tofile)
-		// return
+func convert(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	var pass, newPass passSource
+	var outfile string
+	var inplace, force bool
+	pass.flags(fs, "", "passphrase")
+	if cmd == "rekey" {
+		newPass.flags(fs, "new-", "new passphrase")
+	}
+	fs.StringVar(&outfile, "o", "", "write the result to this file")
+	fs.BoolVar(&inplace, "i", false, "replace the save file with the result")
+	fs.BoolVar(&force, "f", false, "overwrite an existing -o file")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return fail(exitUsage, fmt.Errorf("usage: tsdec %s [options] <tsfile>", cmd))
+	}
+	tsfile := fs.Arg(0)
+	if inplace == (outfile != "") {
+		return fail(exitUsage, fmt.Errorf("need exactly one of -o or -i"))
+	}
+	if inplace {
+		outfile = tsfile
+	} else if tox.FileExist(outfile) && !force {
+		return fail(exitIO, fmt.Errorf("%s exists, use -f to overwrite", outfile))
 	}
 
-	if isencrypt { // do decrypt
-		log.Println("Decrypting...")
-		err := t.WriteSavedata(tofile)
+	data, err := ioutil.ReadFile(tsfile)
+	if err != nil {
+		return fail(exitIO, err)
+	}
+	encrypted := len(data) > 0 && tox.IsDataEncrypted(data)
+
+	var result []byte
+	switch cmd {
+	case "decrypt":
+		if !encrypted {
+			return fail(exitInvalid, fmt.Errorf("%s is not encrypted", tsfile))
+		}
+		p, err := pass.read("Passphrase", false)
 		if err != nil {
-			log.Println(err)
-		} else {
-			log.Println("Save decrypted data OK: ", tofile)
+			return err
 		}
-	} else { // do encrypt
-		log.Println("Encrypting...")
-
-		// first time, there is no salt
-		salt := make([]byte, tox.PASS_KEY_LENGTH)
-		_, err, salt := tox.GetSalt(data)
+		result, err = tox.PassDecrypt(data, p)
+		tox.WipeBytes(p)
 		if err != nil {
-			log.Println(err, "GetSalt")
-			// return
+			return fail(exitPassphrase, fmt.Errorf("decrypt failed, wrong passphrase? %v", err))
 		}
-		_ = salt
-
-		// pakey, err = tox.DeriveWithSalt([]byte(pass), salt)
-		pakey, err := tox.Derive([]byte(pass))
-		defer pakey.Free()
+		defer tox.WipeBytes(result)
+	case "encrypt":
+		if encrypted {
+			return fail(exitInvalid, fmt.Errorf("%s is already encrypted, use rekey", tsfile))
+		}
+		if _, err := savedata.Parse(data); err != nil {
+			return fail(exitInvalid, fmt.Errorf("%s: %v", tsfile, err))
+		}
+		p, err := pass.read("New passphrase", true)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
-		_, err, encdata := pakey.Encrypt(data)
+		result, err = tox.PassEncrypt(data, p)
+		tox.WipeBytes(p)
 		if err != nil {
-			log.Println(err)
-			return
+			return fail(exitIO, err)
 		}
-
-		err = ioutil.WriteFile(tofile, encdata, 0755)
+	case "rekey":
+		if !encrypted {
+			return fail(exitInvalid, fmt.Errorf("%s is not encrypted, use encrypt", tsfile))
+		}
+		p, err := pass.read("Old passphrase", false)
+		if err != nil {
+			return err
+		}
+		np, err := newPass.read("New passphrase", true)
 		if err != nil {
-			log.Println(err)
-		} else {
-			log.Println("Save encrypted data OK: ", tofile)
+			tox.WipeBytes(p)
+			return err
+		}
+		result, err = tox.ChangePassphrase(data, p, np)
+		tox.WipeBytes(p)
+		tox.WipeBytes(np)
+		if err != nil {
+			return fail(exitPassphrase, fmt.Errorf("rekey failed, wrong passphrase? %v", err))
 		}
 	}
-}
-
-func encrypt() {
 
+	if err := tox.WriteFileAtomic(outfile, result, 0600); err != nil {
+		return fail(exitIO, err)
+	}
+	log.Printf("%sed %s to %s", cmd, tsfile, outfile)
+	return nil
 }
 
-// @param pt plain tox
-func decrypt(pt *tox.Tox) {
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var pass passSource
+	pass.flags(fs, "", "passphrase")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return fail(exitUsage, fmt.Errorf("usage: tsdec verify [options] <tsfile>"))
+	}
+	tsfile := fs.Arg(0)
 
+	data, err := ioutil.ReadFile(tsfile)
+	if err != nil {
+		return fail(exitIO, err)
+	}
+	encrypted := len(data) > 0 && tox.IsDataEncrypted(data)
+	if encrypted {
+		p, err := pass.read("Passphrase", false)
+		if err != nil {
+			return err
+		}
+		data, err = tox.PassDecrypt(data, p)
+		tox.WipeBytes(p)
+		if err != nil {
+			return fail(exitPassphrase, fmt.Errorf("decrypt failed, wrong passphrase? %v", err))
+		}
+		defer tox.WipeBytes(data)
+	}
+
+	sd, err := savedata.Parse(data)
+	if err != nil {
+		return fail(exitInvalid, fmt.Errorf("%s: %v", tsfile, err))
+	}
+	keys, err := sd.Keys()
+	if err != nil {
+		return fail(exitInvalid, fmt.Errorf("%s: %v", tsfile, err))
+	}
+	friends, err := sd.Friends()
+	if err != nil {
+		return fail(exitInvalid, fmt.Errorf("%s: %v", tsfile, err))
+	}
+	log.Println("Is encrypt:", encrypted)
+	log.Println("Self ID:", keys.Address())
+	log.Println("Self Name:", sd.Name())
+	log.Println("Friend Count:", len(friends))
+	return nil
 }
@@ -1,100 +1,314 @@
 package main
 
-//  tox save data explorer
+//  tox save data explorer, reads the profile offline and exports it as JSON or CSV
 
 import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/passphrase"
+	"github.com/TokTok/go-toxcore-c/savedata"
 )
 
 func init() {
 	log.SetFlags(log.Flags() ^ log.Ldate ^ log.Ltime)
 }
 
-var tsfile string
-var pass string
+var format = "json"
+var table = "friends"
+var outfile string
+var passSource = passphrase.NewSource()
 
 func printHelp() {
-	log.Println("For help: /path/to/rsexp -h")
+	fmt.Fprintf(os.Stderr, `Usage: tsexp [options] <tsfile>
+
+Exports the self info, friends, conferences and stored nodes of a save file.
+The file is parsed offline, no tox instance is started.
+The passphrase of an encrypted file is read from -pass-env or -pass-fd.
+CSV output contains one -table: self, friends, conferences or nodes.
+
+`)
+	flag.PrintDefaults()
 }
 
 func main() {
-	// flag.StringVar(&tsfile, "tsfile", "", "tox save data file")
-	flag.StringVar(&pass, "pass", pass, "tox save data password")
+	flag.Usage = printHelp
+	flag.StringVar(&format, "format", format, "output format, json or csv")
+	flag.StringVar(&table, "table", table, "table for csv output: self, friends, conferences or nodes")
+	flag.StringVar(&outfile, "o", "", "write to this file instead of stdout")
+	passSource.Register(flag.CommandLine, "", "passphrase")
 	flag.Parse()
-	// log.Println(flag.Args())
-	if len(flag.Args()) < 1 {
+	if len(flag.Args()) != 1 || (format != "json" && format != "csv") {
 		printHelp()
-		flag.Usage()
-		return
+		os.Exit(1)
 	}
-	tsfile = flag.Arg(0)
 
-	data, err := ioutil.ReadFile(tsfile)
+	exp, err := load(flag.Arg(0))
 	if err != nil {
 		log.Println(err)
-		return
+		os.Exit(2)
 	}
-	isencrypt := tox.IsDataEncrypted(data)
-	log.Println("Is encrypt: ", isencrypt)
-	if isencrypt {
-		ok, err, salt := tox.GetSalt(data)
+
+	out := io.Writer(os.Stdout)
+	if outfile != "" {
+		fp, err := os.Create(outfile)
 		if err != nil {
-			log.Println(ok, err, len(salt), salt)
+			log.Println(err)
+			os.Exit(2)
 		}
-		pkey, err := tox.DeriveWithSalt([]byte(pass), salt)
-		defer pkey.Free()
+		defer fp.Close()
+		out = fp
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(exp)
+	} else {
+		err = exp.writeCSV(out, table)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+}
+
+type selfInfo struct {
+	Address       string `json:"address"`
+	PublicKey     string `json:"public_key"`
+	Nospam        string `json:"nospam"`
+	Name          string `json:"name"`
+	StatusMessage string `json:"status_message"`
+	Status        string `json:"status"`
+}
+
+type friendInfo struct {
+	Number         int    `json:"number"`
+	PublicKey      string `json:"public_key"`
+	Name           string `json:"name"`
+	StatusMessage  string `json:"status_message"`
+	Status         string `json:"status"`
+	UserStatus     string `json:"user_status"`
+	LastSeen       string `json:"last_seen,omitempty"`
+	RequestMessage string `json:"request_message,omitempty"`
+}
+
+type peerInfo struct {
+	PublicKey string `json:"public_key"`
+	Nick      string `json:"nick"`
+}
+
+type conferenceInfo struct {
+	Number int        `json:"number"`
+	Type   string     `json:"type"`
+	ID     string     `json:"id"`
+	Title  string     `json:"title"`
+	Peers  []peerInfo `json:"peers"`
+}
+
+type nodeInfo struct {
+	Kind      string `json:"-"`
+	Protocol  string `json:"protocol"`
+	IP        string `json:"ip"`
+	Port      uint16 `json:"port"`
+	PublicKey string `json:"public_key"`
+}
+
+type export struct {
+	Encrypted   bool             `json:"encrypted"`
+	Self        selfInfo         `json:"self"`
+	Friends     []friendInfo     `json:"friends"`
+	Conferences []conferenceInfo `json:"conferences"`
+	DHTNodes    []nodeInfo       `json:"dht_nodes"`
+	TCPRelays   []nodeInfo       `json:"tcp_relays"`
+	PathNodes   []nodeInfo       `json:"path_nodes"`
+}
+
+// load reads, decrypts and decodes the save file.
+func load(tsfile string) (*export, error) {
+	data, err := ioutil.ReadFile(tsfile)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s: empty save file", tsfile)
+	}
+	// shorter data can not be encrypted, and IsDataEncrypted would read past it
+	exp := &export{Encrypted: len(data) >= tox.PASS_ENCRYPTION_EXTRA_LENGTH && tox.IsDataEncrypted(data)}
+	if exp.Encrypted {
+		pass, err := readPassphrase()
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
-		ok, err, datad := pkey.Decrypt(data)
+		data, err = tox.PassDecrypt(data, pass)
+		tox.WipeBytes(pass)
 		if err != nil {
-			// log.Println(ok, err, len(datad), datad[0:32])
-			log.Println("Decrypt error, check your -pass:", err)
-			return
+			return nil, fmt.Errorf("decrypt failed, wrong passphrase? %v", err)
+		}
+		defer tox.WipeBytes(data)
+	}
+
+	sd, err := savedata.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", tsfile, err)
+	}
+	keys, err := sd.Keys()
+	if err != nil {
+		return nil, err
+	}
+	exp.Self = selfInfo{
+		Address:       keys.Address(),
+		PublicKey:     hexString(keys.PublicKey[:]),
+		Nospam:        fmt.Sprintf("%08X", keys.Nospam),
+		Name:          sd.Name(),
+		StatusMessage: sd.StatusMessage(),
+		Status:        userStatusString(sd.Status()),
+	}
+
+	friends, err := sd.Friends()
+	if err != nil {
+		return nil, err
+	}
+	exp.Friends = []friendInfo{}
+	for i, f := range friends {
+		fi := friendInfo{
+			Number:         i,
+			PublicKey:      hexString(f.PublicKey[:]),
+			Name:           f.Name,
+			StatusMessage:  f.StatusMessage,
+			Status:         friendStatusString(f.Status),
+			UserStatus:     userStatusString(f.UserStatus),
+			RequestMessage: string(f.RequestMessage),
+		}
+		if f.LastSeen > 0 {
+			fi.LastSeen = time.Unix(int64(f.LastSeen), 0).UTC().Format(time.RFC3339)
 		}
+		exp.Friends = append(exp.Friends, fi)
+	}
+
+	confs, err := sd.Conferences()
+	if err != nil {
+		return nil, err
+	}
+	exp.Conferences = []conferenceInfo{}
+	for i, c := range confs {
+		ci := conferenceInfo{Number: i, Type: "text", ID: hexString(c.ID[:]), Title: c.Title, Peers: []peerInfo{}}
+		if c.Type == tox.ConferenceTypeAV {
+			ci.Type = "av"
+		}
+		for _, p := range c.Peers {
+			ci.Peers = append(ci.Peers, peerInfo{hexString(p.PublicKey[:]), p.Nick})
+		}
+		exp.Conferences = append(exp.Conferences, ci)
+	}
 
-		data = datad
-	}
-
-	opts := tox.NewToxOptions()
-	opts.Savedata_type = tox.SAVEDATA_TYPE_TOX_SAVE
-	opts.Savedata_data = data
-	t := tox.NewTox(opts)
-	fnums := t.SelfGetFriendList()
-	log.Println("Self Name:", t.SelfGetName())
-	log.Println("Self ID:", t.SelfGetAddress())
-	mystmsg, err := t.SelfGetStatusMessage()
-	log.Println("Status:", mystmsg)
-	log.Println("------------------------------------------")
-	log.Println("Friend Count:", len(fnums))
-
-	if len(fnums) > 0 {
-		log.Println("num\tname\tID\tseen\tstatus\tstmsg")
-	}
-	for i := 0; i < len(fnums); i++ {
-		pubkey, err := t.FriendGetPublicKey(fnums[i])
-		tm, err := t.FriendGetLastOnline(fnums[i])
-		fname, err := t.FriendGetName(fnums[i])
-		stmsg, err := t.FriendGetStatusMessage(fnums[i])
-		status, err := t.FriendGetConnectionStatus(fnums[i])
+	for _, sec := range []struct {
+		kind string
+		get  func() ([]savedata.Node, error)
+		dst  *[]nodeInfo
+	}{
+		{"dht", sd.DHTNodes, &exp.DHTNodes},
+		{"tcp_relay", sd.TCPRelays, &exp.TCPRelays},
+		{"path", sd.PathNodes, &exp.PathNodes},
+	} {
+		nodes, err := sec.get()
 		if err != nil {
-			log.Println("wtf", i)
-		} else {
-			otm := time.Unix(int64(tm), 0)
-			log.Println(fmt.Sprintf("Friend %d: ", fnums[i]),
-				fname, pubkey, otm, tox.ConnStatusString(status), stmsg)
+			return nil, err
+		}
+		*sec.dst = []nodeInfo{}
+		for _, n := range nodes {
+			ni := nodeInfo{Kind: sec.kind, Protocol: "udp", IP: n.IP.String(), Port: n.Port, PublicKey: hexString(n.PublicKey[:])}
+			if n.TCP {
+				ni.Protocol = "tcp"
+			}
+			*sec.dst = append(*sec.dst, ni)
 		}
 	}
-	if len(fnums) > 20 {
-		log.Println("Friend Count:", len(fnums))
+	return exp, nil
+}
+
+func (this *export) writeCSV(out io.Writer, table string) error {
+	w := csv.NewWriter(out)
+	switch table {
+	case "self":
+		s := this.Self
+		w.Write([]string{"address", "public_key", "nospam", "name", "status", "status_message"})
+		w.Write([]string{s.Address, s.PublicKey, s.Nospam, s.Name, s.Status, s.StatusMessage})
+	case "friends":
+		w.Write([]string{"number", "public_key", "name", "status", "user_status", "last_seen", "status_message", "request_message"})
+		for _, f := range this.Friends {
+			w.Write([]string{fmt.Sprint(f.Number), f.PublicKey, f.Name, f.Status, f.UserStatus, f.LastSeen, f.StatusMessage, f.RequestMessage})
+		}
+	case "conferences":
+		w.Write([]string{"number", "type", "id", "title", "peer_count", "peers"})
+		for _, c := range this.Conferences {
+			nicks := []string{}
+			for _, p := range c.Peers {
+				nicks = append(nicks, p.Nick)
+			}
+			w.Write([]string{fmt.Sprint(c.Number), c.Type, c.ID, c.Title, fmt.Sprint(len(c.Peers)), strings.Join(nicks, ";")})
+		}
+	case "nodes":
+		w.Write([]string{"kind", "protocol", "ip", "port", "public_key"})
+		for _, nodes := range [][]nodeInfo{this.DHTNodes, this.TCPRelays, this.PathNodes} {
+			for _, n := range nodes {
+				w.Write([]string{n.Kind, n.Protocol, n.IP, fmt.Sprint(n.Port), n.PublicKey})
+			}
+		}
+	default:
+		return fmt.Errorf("unknown table %q", table)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func readPassphrase() ([]byte, error) {
+	if !passSource.IsSet() {
+		return nil, fmt.Errorf("save file is encrypted, use -pass-env or -pass-fd")
 	}
-	if len(fnums) > 0 {
-		log.Println()
+	p, err := passSource.Read()
+	if err == nil && len(p) == 0 {
+		err = fmt.Errorf("empty passphrase")
+	}
+	return p, err
+}
+
+func hexString(b []byte) string {
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func userStatusString(status uint8) string {
+	switch int(status) {
+	case tox.UserStatusNone:
+		return "none"
+	case tox.UserStatusAway:
+		return "away"
+	case tox.UserStatusBusy:
+		return "busy"
+	}
+	return fmt.Sprint(status)
+}
+
+func friendStatusString(status uint8) string {
+	switch status {
+	case savedata.FriendStatusAdded:
+		return "added"
+	case savedata.FriendStatusRequested:
+		return "requested"
+	case savedata.FriendStatusConfirmed:
+		return "confirmed"
+	case savedata.FriendStatusOnline:
+		return "online"
 	}
+	return fmt.Sprint(status)
 }
@@ -0,0 +1,401 @@
+package main
+
+//  tox profile migration, exports an identity to a portable bundle and imports bundles into a fresh profile
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TokTok/go-toxcore-c"
+	"github.com/TokTok/go-toxcore-c/cmds/internal/passphrase"
+	"github.com/TokTok/go-toxcore-c/savedata"
+)
+
+func init() {
+	log.SetFlags(log.Flags() ^ log.Ldate ^ log.Ltime)
+}
+
+const bundleVersion = 1
+
+// Bundle is the portable form of a profile. It holds the secret key, so it must be kept private.
+type Bundle struct {
+	Version       int            `json:"version"`
+	ExportedAt    string         `json:"exported_at"`
+	Source        string         `json:"source,omitempty"`
+	Address       string         `json:"address"`
+	PublicKey     string         `json:"public_key"`
+	SecretKey     string         `json:"secret_key"`
+	Nospam        string         `json:"nospam"`
+	Name          string         `json:"name"`
+	StatusMessage string         `json:"status_message"`
+	Status        uint8          `json:"status"`
+	Friends       []BundleFriend `json:"friends"`
+}
+
+// BundleFriend is a friend of a Bundle.
+type BundleFriend struct {
+	PublicKey     string `json:"public_key"`
+	Name          string `json:"name,omitempty"`
+	StatusMessage string `json:"status_message,omitempty"`
+	LastSeen      uint64 `json:"last_seen,omitempty"`
+	// Pending is set for friend requests the friend did not accept yet.
+	Pending bool `json:"pending,omitempty"`
+}
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  tsmigrate export [options] <tsfile>
+  tsmigrate import [options] <bundle> [bundle...]
+
+export writes the identity, self info and friends of a save file to a JSON bundle.
+With -salvage it reads as much as possible of a damaged save file.
+
+import creates a new save file from the secret key and nospam of the first bundle
+and adds the friends of all bundles without sending friend requests, so two
+profiles can be merged. Pending friend requests are skipped unless -pending.
+
+The passphrase of encrypted inputs is read from -pass-env or -pass-fd, and is
+used to encrypt the output with -encrypt.
+Run tsmigrate <command> -h for the options of a command.
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printHelp()
+		os.Exit(1)
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = exportCmd(os.Args[2:])
+	case "import":
+		err = importCmd(os.Args[2:])
+	default:
+		printHelp()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+}
+
+type commonFlags struct {
+	source  passphrase.Source
+	outfile string
+	force   bool
+	encrypt bool
+	pass    []byte
+}
+
+func (this *commonFlags) register(fs *flag.FlagSet) {
+	this.source.Fd = -1
+	this.source.Register(fs, "", "passphrase")
+	fs.StringVar(&this.outfile, "o", "", "output file")
+	fs.BoolVar(&this.force, "f", false, "overwrite an existing output file")
+	fs.BoolVar(&this.encrypt, "encrypt", false, "encrypt the output with the passphrase")
+}
+
+// passphrase reads the passphrase once.
+func (this *commonFlags) passphrase() ([]byte, error) {
+	if this.pass != nil {
+		return this.pass, nil
+	}
+	if !this.source.IsSet() {
+		return nil, fmt.Errorf("need a passphrase, use -pass-env or -pass-fd")
+	}
+	pass, err := this.source.Read()
+	if err != nil {
+		return nil, err
+	}
+	if this.pass = pass; len(this.pass) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return this.pass, nil
+}
+
+// readFile reads and decrypts the file if it is encrypted.
+func (this *commonFlags) readFile(fname string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s: empty save file", fname)
+	}
+	// shorter data can not be encrypted, and IsDataEncrypted would read past it
+	if len(data) < tox.PASS_ENCRYPTION_EXTRA_LENGTH || !tox.IsDataEncrypted(data) {
+		return data, nil
+	}
+	pass, err := this.passphrase()
+	if err != nil {
+		return nil, fmt.Errorf("%s is encrypted: %v", fname, err)
+	}
+	plain, err := tox.PassDecrypt(data, pass)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decrypt failed, wrong passphrase? %v", fname, err)
+	}
+	return plain, nil
+}
+
+// writeFile encrypts the data if requested and writes it atomically.
+func (this *commonFlags) writeFile(data []byte) error {
+	if this.outfile == "" {
+		return fmt.Errorf("no output file, use -o")
+	}
+	if tox.FileExist(this.outfile) && !this.force {
+		return fmt.Errorf("%s exists, use -f to overwrite", this.outfile)
+	}
+	if this.encrypt {
+		pass, err := this.passphrase()
+		if err != nil {
+			return err
+		}
+		if data, err = tox.PassEncrypt(data, pass); err != nil {
+			return err
+		}
+	}
+	return tox.WriteFileAtomic(this.outfile, data, 0600)
+}
+
+func (this *commonFlags) wipe() {
+	tox.WipeBytes(this.pass)
+}
+
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	var cf commonFlags
+	var salvage, noFriends bool
+	cf.register(fs)
+	fs.BoolVar(&salvage, "salvage", false, "read the intact part of a damaged save file")
+	fs.BoolVar(&noFriends, "no-friends", false, "leave out the friends")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return fmt.Errorf("usage: tsmigrate export [options] <tsfile>")
+	}
+	defer cf.wipe()
+
+	data, err := cf.readFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer tox.WipeBytes(data)
+
+	var sd *savedata.Savedata
+	if salvage {
+		if sd, err = savedata.Salvage(data); sd == nil {
+			return err
+		} else if err != nil {
+			log.Println("salvaged the sections before:", err)
+		}
+	} else if sd, err = savedata.Parse(data); err != nil {
+		return fmt.Errorf("%v, try -salvage", err)
+	}
+
+	bundle, err := newBundle(sd, salvage)
+	if err != nil {
+		return err
+	}
+	bundle.Source = filepath.Base(fs.Arg(0))
+	if noFriends {
+		bundle.Friends = []BundleFriend{}
+	}
+
+	out, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = cf.writeFile(append(out, '\n')); err != nil {
+		return err
+	}
+	log.Printf("exported %s with %d friends to %s", bundle.Address, len(bundle.Friends), cf.outfile)
+	return nil
+}
+
+// newBundle collects the identity and friends of the savedata. Sections which fail to decode are
+// skipped with a warning if tolerant is set.
+func newBundle(sd *savedata.Savedata, tolerant bool) (*Bundle, error) {
+	keys, err := sd.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("no identity to export: %v", err)
+	}
+	bundle := &Bundle{
+		Version:       bundleVersion,
+		ExportedAt:    time.Now().UTC().Format(time.RFC3339),
+		Address:       keys.Address(),
+		PublicKey:     strings.ToUpper(hex.EncodeToString(keys.PublicKey[:])),
+		SecretKey:     strings.ToUpper(hex.EncodeToString(keys.SecretKey[:])),
+		Nospam:        fmt.Sprintf("%08X", keys.Nospam),
+		Name:          sd.Name(),
+		StatusMessage: sd.StatusMessage(),
+		Status:        sd.Status(),
+		Friends:       []BundleFriend{},
+	}
+
+	friends, err := sd.Friends()
+	if err != nil {
+		if !tolerant {
+			return nil, err
+		}
+		log.Println("skipping the friends:", err)
+	}
+	for _, f := range friends {
+		bundle.Friends = append(bundle.Friends, BundleFriend{
+			PublicKey:     strings.ToUpper(hex.EncodeToString(f.PublicKey[:])),
+			Name:          f.Name,
+			StatusMessage: f.StatusMessage,
+			LastSeen:      f.LastSeen,
+			Pending:       f.Status == savedata.FriendStatusAdded || f.Status == savedata.FriendStatusRequested,
+		})
+	}
+	return bundle, nil
+}
+
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	var cf commonFlags
+	var noFriends, pending bool
+	var exclude string
+	cf.register(fs)
+	fs.BoolVar(&noFriends, "no-friends", false, "do not add any friends")
+	fs.BoolVar(&pending, "pending", false, "also add friends whose request is pending")
+	fs.StringVar(&exclude, "exclude", "", "comma separated public keys of friends to leave out")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 1 {
+		return fmt.Errorf("usage: tsmigrate import [options] <bundle> [bundle...]")
+	}
+	defer cf.wipe()
+
+	bundles := []*Bundle{}
+	for _, fname := range fs.Args() {
+		data, err := cf.readFile(fname)
+		if err != nil {
+			return err
+		}
+		bundle := &Bundle{}
+		err = json.Unmarshal(data, bundle)
+		tox.WipeBytes(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+		if bundle.Version != bundleVersion {
+			return fmt.Errorf("%s: unsupported bundle version %d", fname, bundle.Version)
+		}
+		bundles = append(bundles, bundle)
+	}
+
+	skip := map[string]bool{}
+	for _, pk := range strings.Split(exclude, ",") {
+		if pk = strings.TrimSpace(pk); pk != "" {
+			skip[strings.ToUpper(pk)] = true
+		}
+	}
+	friends := []BundleFriend{}
+	if !noFriends {
+		seen := map[string]bool{strings.ToUpper(bundles[0].PublicKey): true}
+		for _, b := range bundles {
+			for _, f := range b.Friends {
+				pk := strings.ToUpper(f.PublicKey)
+				if seen[pk] || skip[pk] || (f.Pending && !pending) {
+					continue
+				}
+				seen[pk] = true
+				f.PublicKey = pk
+				friends = append(friends, f)
+			}
+		}
+	}
+
+	data, err := buildProfile(bundles[0], friends)
+	if err != nil {
+		return err
+	}
+	defer tox.WipeBytes(data)
+	if err = cf.writeFile(data); err != nil {
+		return err
+	}
+	log.Printf("imported %s with %d friends to %s", bundles[0].Address, len(friends), cf.outfile)
+	return nil
+}
+
+// buildProfile creates a fresh savedata for the identity of the bundle and adds the friends.
+func buildProfile(bundle *Bundle, friends []BundleFriend) ([]byte, error) {
+	secretKey, err := hex.DecodeString(bundle.SecretKey)
+	if err != nil || len(secretKey) != tox.SecretKeySize {
+		return nil, fmt.Errorf("bad secret key in bundle")
+	}
+	defer tox.WipeBytes(secretKey)
+	nospam, err := strconv.ParseUint(bundle.Nospam, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad nospam in bundle: %v", err)
+	}
+
+	// no network is needed to build the profile
+	opts := tox.NewToxOptions()
+	opts.SavedataType = tox.SavedataTypeSecretKey
+	opts.SavedataData = secretKey
+	opts.UDPEnabled = false
+	opts.LocalDiscoveryEnabled = false
+	opts.HolePunchingEnabled = false
+	t := tox.NewTox(opts)
+	if t == nil {
+		return nil, fmt.Errorf("cannot create a tox instance for the secret key")
+	}
+	defer t.Kill()
+
+	if pk := t.SelfGetPublicKey(); !strings.EqualFold(pk, bundle.PublicKey) {
+		return nil, fmt.Errorf("secret key does not match public key %s", bundle.PublicKey)
+	}
+	t.SelfSetNospam(uint32(nospam))
+	if err := t.SelfSetName(bundle.Name); err != nil {
+		return nil, err
+	}
+	if _, err := t.SelfSetStatusMessage(bundle.StatusMessage); err != nil {
+		return nil, err
+	}
+	t.SelfSetStatus(bundle.Status)
+	for _, f := range friends {
+		if _, err := t.FriendAddNorequest(f.PublicKey); err != nil {
+			log.Printf("skipping friend %s: %v", f.PublicKey, err)
+		}
+	}
+
+	// toxcore only learns friend names from the friends themselves, restore them in the savedata
+	sd, err := savedata.Parse(t.GetSavedata())
+	if err != nil {
+		return nil, err
+	}
+	saved, err := sd.Friends()
+	if err != nil {
+		return nil, err
+	}
+	byKey := map[string]BundleFriend{}
+	for _, f := range friends {
+		byKey[f.PublicKey] = f
+	}
+	for i := range saved {
+		f, ok := byKey[strings.ToUpper(hex.EncodeToString(saved[i].PublicKey[:]))]
+		if !ok {
+			continue
+		}
+		if len(f.Name) <= savedata.MaxNameLength {
+			saved[i].Name = f.Name
+		}
+		if len(f.StatusMessage) <= savedata.MaxStatusMessageLength {
+			saved[i].StatusMessage = f.StatusMessage
+		}
+		saved[i].LastSeen = f.LastSeen
+	}
+	if err := sd.SetFriends(saved); err != nil {
+		return nil, err
+	}
+	return sd.Bytes(), nil
+}
@@ -0,0 +1,375 @@
+package tox
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ToxConfig holds the options and bootstrap nodes of a deployment, loaded from
+// a JSON or TOML file and the environment, so they can change without code changes.
+//
+// A TOML config looks like:
+//
+//	udp_enabled = false
+//	proxy_type = "socks5"
+//	proxy_host = "127.0.0.1"
+//	proxy_port = 9050
+//	nodes_file = "/etc/tox/nodes.json"
+//
+//	[[nodes]]
+//	ipv4 = "tox.example.org"
+//	port = 33445
+//	tcp_ports = [443, 3389]
+//	public_key = "..."
+//
+// The JSON config has the same keys, the nodes are entries of the nodes.json format.
+type ToxConfig struct {
+	IPv6Enabled           bool   `json:"ipv6_enabled"`
+	UDPEnabled            bool   `json:"udp_enabled"`
+	LocalDiscoveryEnabled bool   `json:"local_discovery_enabled"`
+	HolePunchingEnabled   bool   `json:"hole_punching_enabled"`
+	ProxyType             string `json:"proxy_type"` // none, http or socks5
+	ProxyHost             string `json:"proxy_host"`
+	ProxyPort             int    `json:"proxy_port"`
+	StartPort             int    `json:"start_port"`
+	EndPort               int    `json:"end_port"`
+	TCPPort               int    `json:"tcp_port"`
+
+	// NodesFile is a nodes.json file with more nodes, relative to the config file.
+	NodesFile string          `json:"nodes_file"`
+	Nodes     []BootNodeEntry `json:"nodes"`
+}
+
+// NewToxConfig returns a config with the defaults of NewToxOptions.
+func NewToxConfig() *ToxConfig {
+	opts := NewToxOptions()
+	return &ToxConfig{
+		IPv6Enabled:           opts.IPv6Enabled,
+		UDPEnabled:            opts.UDPEnabled,
+		LocalDiscoveryEnabled: opts.LocalDiscoveryEnabled,
+		HolePunchingEnabled:   opts.HolePunchingEnabled,
+		ProxyType:             "none",
+		StartPort:             int(opts.StartPort),
+		EndPort:               int(opts.EndPort),
+		TCPPort:               int(opts.TCPPort),
+	}
+}
+
+// LoadToxConfig reads a config file over the defaults, as TOML if the name ends with .toml, otherwise as JSON.
+func LoadToxConfig(fname string) (*ToxConfig, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	this := NewToxConfig()
+	if strings.HasSuffix(fname, ".toml") {
+		err = this.ParseTOML(data)
+	} else {
+		err = this.ParseJSON(data)
+	}
+	if err != nil {
+		return nil, toxerrf("%s: %v", fname, err)
+	}
+	if this.NodesFile != "" && !filepath.IsAbs(this.NodesFile) {
+		this.NodesFile = filepath.Join(filepath.Dir(fname), this.NodesFile)
+	}
+	return this, nil
+}
+
+// ParseJSON sets the config from JSON, unknown keys are errors.
+func (this *ToxConfig) ParseJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(this)
+}
+
+// ParseTOML sets the config from TOML. Only the TOML of the config is supported:
+// keys with strings, integers, booleans and arrays, and [[nodes]] tables.
+func (this *ToxConfig) ParseTOML(data []byte) error {
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		return err
+	}
+	jdata, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return this.ParseJSON(jdata)
+}
+
+// LoadEnv overrides the config from environment variables named by the prefix and
+// the upper case key, like TOX_UDP_ENABLED=false. TOX_NODES takes comma separated
+// host:port:public_key nodes, which replace the nodes of the file.
+func (this *ToxConfig) LoadEnv(prefix string) error {
+	v := reflect.ValueOf(this).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		name := prefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return toxerrf("%s: %v", name, err)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return toxerrf("%s: %v", name, err)
+			}
+			field.SetBool(b)
+		default: // nodes
+			nodes, err := parseNodeList(value)
+			if err != nil {
+				return toxerrf("%s: %v", name, err)
+			}
+			this.Nodes = nodes
+		}
+	}
+	return nil
+}
+
+func parseNodeList(s string) ([]BootNodeEntry, error) {
+	nodes := []BootNodeEntry{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		keypos := strings.LastIndex(item, ":")
+		portpos := -1
+		if keypos > 0 {
+			portpos = strings.LastIndex(item[:keypos], ":")
+		}
+		if portpos < 0 {
+			return nil, toxerrf("bad node %q, need host:port:public_key", item)
+		}
+		port, err := strconv.Atoi(item[portpos+1 : keypos])
+		if err != nil {
+			return nil, toxerrf("bad node %q: %v", item, err)
+		}
+		host := strings.Trim(item[:portpos], "[]")
+		node := BootNodeEntry{IPv4: host, IPv6: "-", Port: port, PublicKey: item[keypos+1:]}
+		if strings.Contains(host, ":") {
+			node.IPv4, node.IPv6 = "-", host
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Options returns the config as options for NewToxOptionsWith.
+func (this *ToxConfig) Options() ([]ToxOption, error) {
+	options := []ToxOption{
+		WithIPv6(this.IPv6Enabled),
+		WithUDP(this.UDPEnabled),
+		WithLocalDiscovery(this.LocalDiscoveryEnabled),
+		WithHolePunching(this.HolePunchingEnabled),
+	}
+	for _, port := range []int{this.ProxyPort, this.StartPort, this.EndPort, this.TCPPort} {
+		if port < 0 || port > 65535 {
+			return nil, toxerrf("invalid port %d", port)
+		}
+	}
+	switch strings.ToLower(this.ProxyType) {
+	case "", "none":
+	case "http":
+		options = append(options, WithProxy(ProxyTypeHTTP, this.ProxyHost, uint16(this.ProxyPort)))
+	case "socks5":
+		options = append(options, WithProxy(ProxyTypeSOCKS5, this.ProxyHost, uint16(this.ProxyPort)))
+	default:
+		return nil, toxerrf("invalid proxy type %q, need none, http or socks5", this.ProxyType)
+	}
+	if this.StartPort != 0 || this.EndPort != 0 {
+		options = append(options, WithPortRange(uint16(this.StartPort), uint16(this.EndPort)))
+	}
+	options = append(options, WithTCPRelay(uint16(this.TCPPort)))
+	return options, nil
+}
+
+// ToxOptions returns the config as validated options, changed by the given ones.
+func (this *ToxConfig) ToxOptions(options ...ToxOption) (*ToxOptions, error) {
+	cfgopts, err := this.Options()
+	if err != nil {
+		return nil, err
+	}
+	return NewToxOptionsWith(append(cfgopts, options...)...)
+}
+
+// BootNodes returns the nodes of the nodes file followed by the nodes of the config.
+func (this *ToxConfig) BootNodes() ([]*BootNode, error) {
+	nodes := []*BootNode{}
+	if this.NodesFile != "" {
+		var err error
+		if nodes, err = LoadBootNodes(this.NodesFile); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(&nodesJSON{Nodes: this.Nodes})
+	if err != nil {
+		return nil, err
+	}
+	more, err := ParseBootNodes(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(more) != len(this.Nodes) {
+		return nil, toxerrf("%d of the config nodes are invalid", len(this.Nodes)-len(more))
+	}
+	return append(nodes, more...), nil
+}
+
+// parseTOML parses the TOML subset of ToxConfig into maps and slices.
+func parseTOML(s string) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	table := doc
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineno := i + 1
+		line := strings.TrimSpace(stripTOMLComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") && strings.HasSuffix(line, "]]") {
+			name := strings.TrimSpace(line[2 : len(line)-2])
+			arr, ok := doc[name].([]interface{})
+			if _, exists := doc[name]; exists && !ok {
+				return nil, toxerrf("line %d: %s is not an array of tables", lineno, name)
+			}
+			table = map[string]interface{}{}
+			doc[name] = append(arr, table)
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if _, exists := doc[name]; exists {
+				return nil, toxerrf("line %d: duplicate table %s", lineno, name)
+			}
+			table = map[string]interface{}{}
+			doc[name] = table
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, toxerrf("line %d: need key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if unq, err := strconv.Unquote(key); err == nil {
+			key = unq
+		}
+		if key == "" {
+			return nil, toxerrf("line %d: empty key", lineno)
+		}
+		if _, exists := table[key]; exists {
+			return nil, toxerrf("line %d: duplicate key %s", lineno, key)
+		}
+		text := strings.TrimSpace(line[eq+1:])
+		// arrays may span lines
+		for strings.HasPrefix(text, "[") && strings.Count(text, "[") > strings.Count(text, "]") && i+1 < len(lines) {
+			i++
+			text += " " + strings.TrimSpace(stripTOMLComment(lines[i]))
+		}
+		value, rest, err := parseTOMLValue(text)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = toxerrf("unexpected %q", rest)
+		}
+		if err != nil {
+			return nil, toxerrf("line %d: %v", lineno, err)
+		}
+		table[key] = value
+	}
+	return doc, nil
+}
+
+// stripTOMLComment cuts a # comment which is not in a string.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseTOMLValue parses the value at the start of s and returns the rest.
+func parseTOMLValue(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	switch {
+	case s == "":
+		return nil, s, toxerrf("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return nil, s, toxerrf("unterminated string")
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, s, toxerrf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case s[0] == '[':
+		arr := []interface{}{}
+		s = strings.TrimLeft(s[1:], " \t")
+		for !strings.HasPrefix(s, "]") {
+			v, rest, err := parseTOMLValue(s)
+			if err != nil {
+				return nil, s, err
+			}
+			arr = append(arr, v)
+			s = strings.TrimLeft(rest, " \t")
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimLeft(s[1:], " \t")
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, s, toxerrf("need , or ] in array")
+			}
+		}
+		return arr, s[1:], nil
+	}
+
+	end := strings.IndexAny(s, ",] \t")
+	if end < 0 {
+		end = len(s)
+	}
+	word := s[:end]
+	switch word {
+	case "true":
+		return true, s[end:], nil
+	case "false":
+		return false, s[end:], nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), 0, 64)
+	if err != nil {
+		return nil, s, toxerrf("bad value %q", word)
+	}
+	return n, s[end:], nil
+}
@@ -0,0 +1,253 @@
+package tox
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnState is the connectivity of a Tox instance as seen by a ConnMonitor.
+type ConnState struct {
+	// Status is the debounced connection status, ConnectionNone, ConnectionTCP or ConnectionUDP.
+	Status int
+	// Since is when Status was first reported by toxcore.
+	Since time.Time
+	// Raw is the last status reported by toxcore, which may not have settled yet.
+	Raw int
+	// Flaps counts the changes which were reverted within the debounce time.
+	Flaps int
+}
+
+// Connected reports whether the state has a TCP or UDP connection.
+func (this ConnState) Connected() bool { return this.Status != ConnectionNone }
+
+func (this ConnState) String() string { return ConnStatusString(this.Status) }
+
+type connAction struct {
+	after time.Duration
+	fn    func() error
+	done  bool
+}
+
+// ConnMonitor follows the self connection status of a Tox instance.
+//
+// toxcore reports changes which may last a moment only, so a status becomes
+// the state of the monitor when it lasted for Debounce, and the reverted changes
+// are counted as flaps. Actions added with OnDisconnect run once the state is
+// disconnected for their duration, once per disconnection.
+//
+// Check must be called regularly from the goroutine iterating the instance,
+// which should use Tox afterwards, as SwitchTCPOnly replaces the instance.
+// Tox returns nil when SwitchTCPOnly killed the instance and could not create another.
+type ConnMonitor struct {
+	// Debounce is how long a status must last to become the state.
+	Debounce time.Duration
+	// Bootstrap is used by Rebootstrap, and moved to the new instance by SwitchTCPOnly.
+	Bootstrap *BootstrapManager
+
+	// OnChange is called from Check when the state changes.
+	OnChange func(m *ConnMonitor, state ConnState)
+	// OnRecreate is called by SwitchTCPOnly with the killed and the new instance,
+	// to set up the callbacks and attach a SaveStore to the new one. The new instance
+	// is nil if none could be created.
+	OnRecreate func(old *Tox, t *Tox)
+	// OnError is called with the errors of the actions, they are logged by default.
+	OnError func(err error)
+
+	mu      sync.Mutex
+	t       *Tox
+	state   ConnState
+	rawAt   time.Time
+	actions []*connAction
+
+	nowfn func() time.Time
+}
+
+// NewConnMonitor creates a monitor for t and registers its status callback.
+func NewConnMonitor(t *Tox) *ConnMonitor {
+	this := &ConnMonitor{t: t}
+	this.Debounce = 5 * time.Second
+	this.OnError = func(err error) { log.Println(err) }
+	this.nowfn = time.Now
+	now := this.nowfn()
+	this.state = ConnState{Status: ConnectionNone, Since: now, Raw: ConnectionNone}
+	this.rawAt = now
+	if t != nil {
+		this.attach(t)
+	}
+	return this
+}
+
+func (this *ConnMonitor) attach(t *Tox) {
+	t.CallbackSelfConnectionStatus(func(t *Tox, status int, userData interface{}) {
+		this.setStatus(status)
+	}, nil)
+}
+
+// Tox returns the monitored instance, nil if SwitchTCPOnly could not recreate it.
+func (this *ConnMonitor) Tox() *Tox {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.t
+}
+
+// State returns the current state.
+func (this *ConnMonitor) State() ConnState {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.state
+}
+
+// TimeInState returns how long the current state lasts.
+func (this *ConnMonitor) TimeInState() time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.nowfn().Sub(this.state.Since)
+}
+
+// OnDisconnect adds an action to run when the state is disconnected for after,
+// like m.OnDisconnect(time.Minute, m.Rebootstrap).
+func (this *ConnMonitor) OnDisconnect(after time.Duration, action func() error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.actions = append(this.actions, &connAction{after: after, fn: action})
+	sort.SliceStable(this.actions, func(i, j int) bool { return this.actions[i].after < this.actions[j].after })
+}
+
+func (this *ConnMonitor) setStatus(status int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if status == this.state.Raw {
+		return
+	}
+	if this.state.Raw != this.state.Status && status == this.state.Status {
+		// went back before the change settled
+		this.state.Flaps++
+	}
+	this.state.Raw = status
+	this.rawAt = this.nowfn()
+}
+
+// Check settles the state and runs the due actions.
+func (this *ConnMonitor) Check() {
+	this.mu.Lock()
+	now := this.nowfn()
+	var changed bool
+	if this.state.Raw != this.state.Status && now.Sub(this.rawAt) >= this.Debounce {
+		this.state.Status = this.state.Raw
+		this.state.Since = this.rawAt
+		changed = true
+		if this.state.Connected() {
+			for _, a := range this.actions {
+				a.done = false
+			}
+		}
+	}
+	state := this.state
+	var due []func() error
+	if !state.Connected() {
+		for _, a := range this.actions {
+			if !a.done && now.Sub(state.Since) >= a.after {
+				a.done = true
+				due = append(due, a.fn)
+			}
+		}
+	}
+	this.mu.Unlock()
+
+	if changed && this.OnChange != nil {
+		this.OnChange(this, state)
+	}
+	for _, fn := range due {
+		if err := fn(); err != nil && this.OnError != nil {
+			this.OnError(err)
+		}
+	}
+}
+
+// Rebootstrap bootstraps the instance from a new subset of the nodes of Bootstrap.
+func (this *ConnMonitor) Rebootstrap() error {
+	if this.Bootstrap == nil {
+		return toxerr("no bootstrap manager")
+	}
+	if this.Tox() == nil {
+		return toxerr("no tox instance")
+	}
+	return this.Bootstrap.Bootstrap()
+}
+
+// SwitchTCPOnly replaces the instance with one created from its savedata with UDP disabled.
+// The instance is killed, callbacks and SaveStores must be set up again in OnRecreate.
+//
+// The new instance is created while the old one still runs, so a failure leaves the old
+// one in place. Only if the old instance holds the TCP relay port it is killed first;
+// then the instance is recreated with UDP if TCP only fails, and if that fails too,
+// Tox returns nil and the Bootstrap manager is closed.
+func (this *ConnMonitor) SwitchTCPOnly() error {
+	this.mu.Lock()
+	old := this.t
+	this.mu.Unlock()
+	if old == nil {
+		return toxerr("no tox instance")
+	}
+	if !old.opts.UDPEnabled {
+		return nil
+	}
+
+	opts := *old.opts
+	opts.UDPEnabled = false
+	opts.SavedataType = SavedataTypeToxSave
+	opts.SavedataData = old.GetSavedata()
+	t := NewTox(&opts)
+	if t == nil && opts.TCPPort != 0 {
+		// the new instance may need the TCP relay port of the old one
+		old.Kill()
+		if t = NewTox(&opts); t == nil {
+			opts.UDPEnabled = true
+			t = NewTox(&opts)
+			this.replace(old, t)
+			if t == nil {
+				return toxerr("cannot recreate the instance")
+			}
+			return toxerr("cannot create a TCP only instance")
+		}
+	} else if t == nil {
+		return toxerr("cannot create a TCP only instance")
+	} else {
+		old.Kill()
+	}
+	this.replace(old, t)
+	return nil
+}
+
+// replace switches to the new instance t, which is nil if none could be created.
+func (this *ConnMonitor) replace(old *Tox, t *Tox) {
+	this.mu.Lock()
+	this.t = t
+	this.state.Raw = ConnectionNone
+	this.rawAt = this.nowfn()
+	this.mu.Unlock()
+	if t != nil {
+		this.attach(t)
+	}
+
+	if this.Bootstrap != nil {
+		this.Bootstrap.mu.Lock()
+		this.Bootstrap.t = t
+		this.Bootstrap.online = false
+		this.Bootstrap.mu.Unlock()
+		var err error
+		if t != nil {
+			err = this.Bootstrap.Attach()
+		} else {
+			err = this.Bootstrap.Close()
+		}
+		if err != nil && this.OnError != nil {
+			this.OnError(err)
+		}
+	}
+	if this.OnRecreate != nil {
+		this.OnRecreate(old, t)
+	}
+}
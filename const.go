@@ -201,6 +201,36 @@ const (
 	FriendCallStateAcceptingVideo = int(C.TOXAV_FRIEND_CALL_STATE_ACCEPTING_V)
 )
 
+const (
+	// Resume a previously paused call. Only valid if the pause was caused by
+	// this client, if not, this control is ignored. Not valid before the call
+	// is accepted.
+	CallControlResume = int(C.TOXAV_CALL_CONTROL_RESUME)
+
+	// Put a call on hold. Not valid before the call is accepted.
+	CallControlPause = int(C.TOXAV_CALL_CONTROL_PAUSE)
+
+	// Reject a call if it was not answered, yet. Cancel a call after it was
+	// answered.
+	CallControlCancel = int(C.TOXAV_CALL_CONTROL_CANCEL)
+
+	// Request that the friend stops sending audio. Regardless of the friend's
+	// compliance, this will cause the audio receive handler to not be triggered
+	// on receiving an audio frame from the friend.
+	CallControlMuteAudio = int(C.TOXAV_CALL_CONTROL_MUTE_AUDIO)
+
+	// Calling this control will notify client to start sending audio again.
+	CallControlUnmuteAudio = int(C.TOXAV_CALL_CONTROL_UNMUTE_AUDIO)
+
+	// Request that the friend stops sending video. Regardless of the friend's
+	// compliance, this will cause the video receive handler to not be triggered
+	// on receiving a video frame from the friend.
+	CallControlHideVideo = int(C.TOXAV_CALL_CONTROL_HIDE_VIDEO)
+
+	// Calling this control will notify client to start sending video again.
+	CallControlShowVideo = int(C.TOXAV_CALL_CONTROL_SHOW_VIDEO)
+)
+
 type MessageType int
 
 const (
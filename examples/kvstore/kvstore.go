@@ -0,0 +1,174 @@
+package main
+
+// Host several bot profiles in one process, persisted in a small embedded
+// key-value store through tox.KVBackend.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/TokTok/go-toxcore-c"
+)
+
+func init() {
+	log.SetFlags(log.Flags() | log.Lshortfile)
+}
+
+// logKV is an append-only log of put and delete records, replayed into memory on open.
+// Every record is: op byte, key length uint32, value length uint32, key, value.
+type logKV struct {
+	mu   sync.Mutex
+	fp   *os.File
+	data map[string][]byte
+}
+
+const (
+	opPut    = 1
+	opDelete = 2
+
+	// maxRecordLen bounds the key and value length of a record, a larger one is corrupt.
+	maxRecordLen = 64 << 20
+)
+
+func openLogKV(path string) (*logKV, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	kv := &logKV{fp: fp, data: make(map[string][]byte)}
+
+	rd := bufio.NewReader(fp)
+	hdr := make([]byte, 9)
+	var good int64 // end of the last complete record
+	for {
+		if _, err := io.ReadFull(rd, hdr); err != nil {
+			break
+		}
+		keyLen, valueLen := binary.LittleEndian.Uint32(hdr[1:]), binary.LittleEndian.Uint32(hdr[5:])
+		if (hdr[0] != opPut && hdr[0] != opDelete) || keyLen > maxRecordLen || valueLen > maxRecordLen {
+			break
+		}
+		key := make([]byte, keyLen)
+		value := make([]byte, valueLen)
+		if _, err := io.ReadFull(rd, key); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(rd, value); err != nil {
+			break
+		}
+		if hdr[0] == opPut {
+			kv.data[string(key)] = value
+		} else {
+			delete(kv.data, string(key))
+		}
+		good += int64(len(hdr)) + int64(keyLen) + int64(valueLen)
+	}
+
+	// drop a torn or corrupt tail, so that new records are not appended behind it
+	if err := fp.Truncate(good); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (this *logKV) append(op byte, key []byte, value []byte) error {
+	rec := make([]byte, 9, 9+len(key)+len(value))
+	rec[0] = op
+	binary.LittleEndian.PutUint32(rec[1:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(rec[5:], uint32(len(value)))
+	rec = append(append(rec, key...), value...)
+	if _, err := this.fp.Write(rec); err != nil {
+		return err
+	}
+	return this.fp.Sync()
+}
+
+func (this *logKV) Get(key []byte) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if v, ok := this.data[string(key)]; ok {
+		return append([]byte{}, v...), nil
+	}
+	return nil, nil
+}
+
+func (this *logKV) Put(key []byte, value []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err := this.append(opPut, key, value); err != nil {
+		return err
+	}
+	this.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (this *logKV) Delete(key []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err := this.append(opDelete, key, nil); err != nil {
+		return err
+	}
+	delete(this.data, string(key))
+	return nil
+}
+
+func (this *logKV) Keys(prefix []byte) ([][]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var keys [][]byte
+	for k := range this.data {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, []byte(k))
+		}
+	}
+	return keys, nil
+}
+
+func (this *logKV) Close() error {
+	return this.fp.Close()
+}
+
+var dbfile = "./bots.kv"
+var nbots = 3
+
+func main() {
+	flag.StringVar(&dbfile, "db", dbfile, "key-value store file")
+	flag.IntVar(&nbots, "n", nbots, "number of bot profiles")
+	flag.Parse()
+
+	kv, err := openLogKV(dbfile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer kv.Close()
+	backend := tox.NewKVBackend(kv, "profile/")
+
+	for i := 0; i < nbots; i++ {
+		name := fmt.Sprintf("bot%d", i)
+		opts := tox.NewToxOptions()
+		if err := tox.LoadOptionsFrom(backend, name, opts); err != nil {
+			log.Fatalln(name, err)
+		}
+		t := tox.NewTox(opts)
+		if t == nil {
+			log.Fatalln(name, "create failed")
+		}
+		t.SelfSetName(name)
+		log.Println(name, t.SelfGetAddress())
+		if err := t.SaveSavedataTo(backend, name); err != nil {
+			log.Println(name, err)
+		}
+		t.Kill()
+	}
+
+	names, _ := backend.List()
+	log.Println("stored profiles:", names)
+}
@@ -21,36 +21,71 @@ var server = []interface{}{
 	"205.185.116.116", uint16(33445), "A179B09749AC826FF01F37A9613F6B57118AE014D4196A0E1105A98F93A54702",
 }
 var fname = "./toxecho.data"
+var nodesFile = "./nodes.json"
+var configFile = "./toxecho.toml"
 var debug = false
 var nickPrefix = "EchoBot."
 var statusText = "Send me text, file, audio, video."
 
 func main() {
-	opt := tox.NewToxOptions()
+	// the options and nodes can be set in toxecho.toml and TOX_* environment variables
+	cfg := tox.NewToxConfig()
+	cfg.TCPPort = 33445
+	if tox.FileExist(configFile) {
+		var err error
+		if cfg, err = tox.LoadToxConfig(configFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := cfg.LoadEnv("TOX_"); err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.NodesFile == "" && tox.FileExist(nodesFile) {
+		cfg.NodesFile = nodesFile
+	}
+
+	var options []tox.ToxOption
 	if tox.FileExist(fname) {
 		data, err := ioutil.ReadFile(fname)
 		if err != nil {
 			log.Println(err)
 		} else {
-			opt.Savedata_data = data
-			opt.Savedata_type = tox.SAVEDATA_TYPE_TOX_SAVE
+			options = append(options, tox.WithSavedata(tox.SavedataTypeToxSave, data))
 		}
 	}
-	opt.Tcp_port = 33445
+	opt, err := cfg.ToxOptions(options...)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	var t *tox.Tox
 	for i := 0; i < 5; i++ {
 		t = tox.NewTox(opt)
-		if t == nil {
-			opt.Tcp_port += 1
+		if t == nil && opt.TCPPort != 0 {
+			opt.TCPPort += 1
 		} else {
 			break
 		}
 	}
+	if t == nil {
+		log.Fatalln("cannot create the tox instance")
+	}
 
-	r, err := t.Bootstrap(server[0].(string), server[1].(uint16), server[2].(string))
-	r2, err := t.AddTcpRelay(server[0].(string), server[1].(uint16), server[2].(string))
-	if debug {
-		log.Println("bootstrap:", r, err, r2)
+	// the manager saves the nodes which worked back to the nodes file
+	var bsm *tox.BootstrapManager
+	if nodes, err := cfg.BootNodes(); err != nil {
+		log.Println(err)
+	} else if len(nodes) > 0 {
+		bsm = tox.NewBootstrapManager(t, nodes, cfg.NodesFile)
+		if err := bsm.Attach(); err != nil {
+			log.Println("bootstrap:", err)
+		}
+	}
+	if bsm == nil {
+		r, err := t.Bootstrap(server[0].(string), server[1].(uint16), server[2].(string))
+		r2, err := t.AddTcpRelay(server[0].(string), server[1].(uint16), server[2].(string))
+		if debug {
+			log.Println("bootstrap:", r, err, r2)
+		}
 	}
 
 	pubkey := t.SelfGetPublicKey()
@@ -68,7 +103,7 @@ func main() {
 	}
 	humanName = t.SelfGetName()
 	if debug {
-		log.Println(humanName, defaultName, err)
+		log.Println(humanName, defaultName)
 	}
 
 	defaultStatusText, err := t.SelfGetStatusMessage()
@@ -192,17 +227,17 @@ func main() {
 			log.Println("on recv file control:", friendNumber, fileNumber, control, friendId, err)
 		}
 		key := uint64(uint64(friendNumber)<<32 | uint64(fileNumber))
-		if control == tox.FILE_CONTROL_RESUME {
+		if control == tox.FileControlResume {
 			if fno, ok := sendFiles[key]; ok {
-				t.FileControl(friendNumber, fno, tox.FILE_CONTROL_RESUME)
+				t.FileControl(friendNumber, fno, tox.FileControlResume)
 			}
-		} else if control == tox.FILE_CONTROL_PAUSE {
+		} else if control == tox.FileControlPause {
 			if fno, ok := sendFiles[key]; ok {
-				t.FileControl(friendNumber, fno, tox.FILE_CONTROL_PAUSE)
+				t.FileControl(friendNumber, fno, tox.FileControlPause)
 			}
-		} else if control == tox.FILE_CONTROL_CANCEL {
+		} else if control == tox.FileControlCancel {
 			if fno, ok := sendFiles[key]; ok {
-				t.FileControl(friendNumber, fno, tox.FILE_CONTROL_CANCEL)
+				t.FileControl(friendNumber, fno, tox.FileControlCancel)
 			}
 		}
 	}, nil)
@@ -346,6 +381,9 @@ func main() {
 		}
 
 		t.Iterate()
+		if bsm != nil {
+			bsm.Check()
+		}
 		status := t.SelfGetConnectionStatus()
 		if loopc%5500 == 0 {
 			if status == 0 {
@@ -362,6 +400,9 @@ func main() {
 		time.Sleep(1000 * 50 * time.Microsecond)
 	}
 
+	if bsm != nil {
+		bsm.Close()
+	}
 	t.Kill()
 }
 
@@ -10,7 +10,7 @@ import (
 func TestIssue6(t *testing.T) {
 	opts := NewToxOptions()
 	opts.ThreadSafe = true
-	opts.Tcp_port = 34567
+	opts.TCPPort = 34567
 	_t1 := NewTox(opts)
 	log.Println(_t1)
 	go func() {
@@ -22,7 +22,7 @@ func TestIssue6(t *testing.T) {
 
 	opts2 := NewToxOptions()
 	opts2.ThreadSafe = true
-	opts2.Tcp_port = 34568
+	opts2.TCPPort = 34568
 	_t2 := NewTox(opts2)
 	log.Println(_t2)
 	_t2.CallbackGroupInviteAdd(func(_ *Tox, friendNumber uint32, itype uint8, data string, userData interface{}) {
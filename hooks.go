@@ -5,6 +5,10 @@ type callHookMethods struct {
 	ConferenceDelete   func(groupNumber uint32)
 	ConferenceNew      func(groupNumber uint32)
 	ConferenceSetTitle func(groupNumber uint32, title string)
+	FriendAdd          func(friendNumber uint32)
+	FriendDelete       func(friendNumber uint32)
+	SelfSetName        func(name string)
+	SelfSetNospam      func(nospam uint32)
 }
 
 // include av group
@@ -23,3 +27,20 @@ func (this *Tox) HookConferenceNew(fn func(groupNumber uint32)) {
 func (this *Tox) HookConferenceSetTitle(fn func(groupNumber uint32, title string)) {
 	this.hooks.ConferenceSetTitle = fn
 }
+
+// HookFriendAdd is called after FriendAdd or FriendAddNorequest succeeded.
+func (this *Tox) HookFriendAdd(fn func(friendNumber uint32)) {
+	this.hooks.FriendAdd = fn
+}
+
+func (this *Tox) HookFriendDelete(fn func(friendNumber uint32)) {
+	this.hooks.FriendDelete = fn
+}
+
+func (this *Tox) HookSelfSetName(fn func(name string)) {
+	this.hooks.SelfSetName = fn
+}
+
+func (this *Tox) HookSelfSetNospam(fn func(nospam uint32)) {
+	this.hooks.SelfSetNospam = fn
+}
@@ -8,7 +8,10 @@ package tox
 extern void toxCallbackLog(Tox*, TOX_LOG_LEVEL, char*, uint32_t, char*, char*);
 */
 import "C"
-import "unsafe"
+import (
+	"strings"
+	"unsafe"
+)
 
 // Type of savedata to create the Tox instance from.
 const (
@@ -182,7 +185,7 @@ func (this *ToxOptions) toCToxOptions() *C.struct_Tox_Options {
 	C.tox_options_set_ipv6_enabled(toxopts, (C._Bool)(this.IPv6Enabled))
 	C.tox_options_set_udp_enabled(toxopts, (C._Bool)(this.UDPEnabled))
 
-	if this.SavedataData != nil {
+	if len(this.SavedataData) > 0 {
 		C.tox_options_set_savedata_data(toxopts, (*C.uint8_t)(&this.SavedataData[0]), C.size_t(len(this.SavedataData)))
 		C.tox_options_set_savedata_type(toxopts, C.TOX_SAVEDATA_TYPE(this.SavedataType))
 	}
@@ -204,6 +207,41 @@ func (this *ToxOptions) toCToxOptions() *C.struct_Tox_Options {
 	return toxopts
 }
 
+// freeCToxOptions frees options made by toCToxOptions, with the proxy host they own.
+func freeCToxOptions(toxopts *C.struct_Tox_Options) {
+	if host := C.tox_options_get_proxy_host(toxopts); host != nil {
+		C.free(unsafe.Pointer(host))
+	}
+	C.tox_options_free(toxopts)
+}
+
+// Validate checks the options which toxcore would reject or silently misuse.
+func (this *ToxOptions) Validate() error {
+	switch int(this.ProxyType) {
+	case ProxyTypeNone:
+	case ProxyTypeHTTP, ProxyTypeSOCKS5:
+		if this.ProxyHost == "" || len(this.ProxyHost) > 255 || strings.IndexByte(this.ProxyHost, 0) >= 0 {
+			return toxerrf("invalid proxy host %q", this.ProxyHost)
+		}
+		if this.ProxyPort == 0 {
+			return toxerrf("proxy port must not be 0")
+		}
+	default:
+		return toxerrf("invalid proxy type %d", this.ProxyType)
+	}
+
+	switch this.SavedataType {
+	case SavedataTypeNone, SavedataTypeToxSave: // an empty savedata creates a new profile
+	case SavedataTypeSecretKey:
+		if len(this.SavedataData) != SecretKeySize {
+			return toxerrf("secret key savedata must be %d bytes, not %d", SecretKeySize, len(this.SavedataData))
+		}
+	default:
+		return toxerrf("invalid savedata type %d", this.SavedataType)
+	}
+	return nil
+}
+
 //export toxCallbackLog
 func toxCallbackLog(ctox *C.Tox, level C.TOX_LOG_LEVEL, file *C.char, line C.uint32_t, fname *C.char, msg *C.char) {
 	t := cbUserDatas.get(ctox)
@@ -211,9 +249,3 @@ func toxCallbackLog(ctox *C.Tox, level C.TOX_LOG_LEVEL, file *C.char, line C.uin
 		t.opts.LogCallback(t, int(level), C.GoString(file), uint32(line), C.GoString(fname), C.GoString(msg))
 	}
 }
-
-type BootNode struct {
-	Addr   string
-	Port   int
-	Pubkey string
-}
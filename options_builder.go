@@ -0,0 +1,133 @@
+package tox
+
+// ToxOption sets one option of a ToxOptions, failing on invalid values.
+type ToxOption func(opts *ToxOptions) error
+
+// NewToxOptionsWith creates options with the defaults of NewToxOptions changed by the given ones,
+// like NewToxOptionsWith(WithUDP(false), WithProxy(ProxyTypeSOCKS5, "127.0.0.1", 9050)).
+func NewToxOptionsWith(options ...ToxOption) (*ToxOptions, error) {
+	opts := NewToxOptions()
+	if err := opts.Apply(options...); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// Apply sets the options and validates the result.
+func (this *ToxOptions) Apply(options ...ToxOption) error {
+	for _, option := range options {
+		if err := option(this); err != nil {
+			return err
+		}
+	}
+	return this.Validate()
+}
+
+// WithIPv6 enables IPv6 sockets, which allow both IPv4 and IPv6 communication.
+func WithIPv6(enabled bool) ToxOption {
+	return func(opts *ToxOptions) error {
+		opts.IPv6Enabled = enabled
+		return nil
+	}
+}
+
+// WithUDP enables UDP, without it Tox is TCP only.
+func WithUDP(enabled bool) ToxOption {
+	return func(opts *ToxOptions) error {
+		opts.UDPEnabled = enabled
+		return nil
+	}
+}
+
+// WithProxy passes TCP connections through an HTTP or SOCKS5 proxy. It disables UDP, which a proxy cannot carry.
+func WithProxy(proxyType int, host string, port uint16) ToxOption {
+	return func(opts *ToxOptions) error {
+		if proxyType != ProxyTypeHTTP && proxyType != ProxyTypeSOCKS5 {
+			return toxerrf("invalid proxy type %d", proxyType)
+		}
+		if host == "" || len(host) > 255 {
+			return toxerrf("invalid proxy host %q", host)
+		}
+		if port == 0 {
+			return toxerrf("proxy port must not be 0")
+		}
+		opts.ProxyType = int32(proxyType)
+		opts.ProxyHost = host
+		opts.ProxyPort = port
+		opts.UDPEnabled = false
+		return nil
+	}
+}
+
+// WithPortRange sets the range of the local UDP ports to try, start and end included.
+func WithPortRange(start uint16, end uint16) ToxOption {
+	return func(opts *ToxOptions) error {
+		if start == 0 || end == 0 || start > end {
+			return toxerrf("invalid port range %d-%d", start, end)
+		}
+		opts.StartPort = start
+		opts.EndPort = end
+		return nil
+	}
+}
+
+// WithTCPRelay runs a TCP relay for other instances on the port, 0 disables it.
+func WithTCPRelay(port uint16) ToxOption {
+	return func(opts *ToxOptions) error {
+		opts.TCPPort = port
+		return nil
+	}
+}
+
+// WithSavedata creates the instance from a savedata or a secret key.
+func WithSavedata(savedataType int, data []byte) ToxOption {
+	return func(opts *ToxOptions) error {
+		switch savedataType {
+		case SavedataTypeToxSave:
+			if len(data) == 0 {
+				return toxerrf("empty savedata")
+			}
+		case SavedataTypeSecretKey:
+			if len(data) != SecretKeySize {
+				return toxerrf("secret key must be %d bytes, not %d", SecretKeySize, len(data))
+			}
+		default:
+			return toxerrf("invalid savedata type %d", savedataType)
+		}
+		opts.SavedataType = savedataType
+		opts.SavedataData = data
+		return nil
+	}
+}
+
+// WithLocalDiscovery enables looking for peers on the local network.
+func WithLocalDiscovery(enabled bool) ToxOption {
+	return func(opts *ToxOptions) error {
+		opts.LocalDiscoveryEnabled = enabled
+		return nil
+	}
+}
+
+// WithHolePunching enables UDP hole punching.
+func WithHolePunching(enabled bool) ToxOption {
+	return func(opts *ToxOptions) error {
+		opts.HolePunchingEnabled = enabled
+		return nil
+	}
+}
+
+// WithThreadSafe makes the instance safe to use from several goroutines.
+func WithThreadSafe(enabled bool) ToxOption {
+	return func(opts *ToxOptions) error {
+		opts.ThreadSafe = enabled
+		return nil
+	}
+}
+
+// WithLogCallback sets the handler of the toxcore log messages.
+func WithLogCallback(fn func(_ *Tox, level int, file string, line uint32, fname string, msg string)) ToxOption {
+	return func(opts *ToxOptions) error {
+		opts.LogCallback = fn
+		return nil
+	}
+}
@@ -0,0 +1,211 @@
+package savedata
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Friend status values of the friends section.
+const (
+	FriendStatusNone      = 0
+	FriendStatusAdded     = 1 // friend request not sent yet
+	FriendStatusRequested = 2 // friend request sent, not accepted yet
+	FriendStatusConfirmed = 3
+	FriendStatusOnline    = 4
+)
+
+// Friend is one saved friend.
+type Friend struct {
+	Status    uint8
+	PublicKey [PublicKeySize]byte
+	// RequestMessage is the message of a friend request which is not accepted yet.
+	RequestMessage []byte
+	Name           string
+	StatusMessage  string
+	UserStatus     uint8
+	// RequestNospam is the nospam a pending friend request is sent to.
+	RequestNospam uint32
+	// LastSeen is the unix time the friend was last online.
+	LastSeen uint64
+}
+
+// Friends decodes the friends section.
+func (this *Savedata) Friends() ([]Friend, error) {
+	s := this.Section(SectionFriends)
+	if s == nil {
+		return []Friend{}, nil
+	}
+	if len(s.Data)%savedFriendSize != 0 {
+		return nil, fmt.Errorf("friends section has %d bytes, not a multiple of %d", len(s.Data), savedFriendSize)
+	}
+
+	friends := make([]Friend, 0, len(s.Data)/savedFriendSize)
+	for rec := s.Data; len(rec) > 0; rec = rec[savedFriendSize:] {
+		var f Friend
+		f.Status = rec[0]
+		d := rec[1:]
+		copy(f.PublicKey[:], d)
+		d = d[PublicKeySize:]
+		info := d[:friendRequestSize]
+		d = d[friendRequestSize:]
+		f.RequestMessage = append([]byte{}, info[:minInt(int(binary.BigEndian.Uint16(d)), friendRequestSize)]...)
+		d = d[2:]
+		name := d[:MaxNameLength]
+		d = d[MaxNameLength:]
+		f.Name = string(name[:minInt(int(binary.BigEndian.Uint16(d)), MaxNameLength)])
+		d = d[2:]
+		stmsg := d[:MaxStatusMessageLength]
+		d = d[MaxStatusMessageLength:]
+		f.StatusMessage = string(stmsg[:minInt(int(binary.BigEndian.Uint16(d)), MaxStatusMessageLength)])
+		d = d[2:]
+		f.UserStatus = d[0]
+		f.RequestNospam = binary.LittleEndian.Uint32(d[1:])
+		f.LastSeen = binary.BigEndian.Uint64(d[5:])
+		friends = append(friends, f)
+	}
+	return friends, nil
+}
+
+// SetFriends encodes the friends section.
+func (this *Savedata) SetFriends(friends []Friend) error {
+	data := make([]byte, len(friends)*savedFriendSize)
+	for i, f := range friends {
+		if len(f.RequestMessage) > friendRequestSize || len(f.Name) > MaxNameLength || len(f.StatusMessage) > MaxStatusMessageLength {
+			return fmt.Errorf("friend %d: request message, name or status message too long", i)
+		}
+		d := data[i*savedFriendSize:]
+		d[0] = f.Status
+		d = d[1:]
+		copy(d, f.PublicKey[:])
+		d = d[PublicKeySize:]
+		copy(d, f.RequestMessage)
+		d = d[friendRequestSize:]
+		binary.BigEndian.PutUint16(d, uint16(len(f.RequestMessage)))
+		d = d[2:]
+		copy(d, f.Name)
+		d = d[MaxNameLength:]
+		binary.BigEndian.PutUint16(d, uint16(len(f.Name)))
+		d = d[2:]
+		copy(d, f.StatusMessage)
+		d = d[MaxStatusMessageLength:]
+		binary.BigEndian.PutUint16(d, uint16(len(f.StatusMessage)))
+		d = d[2:]
+		d[0] = f.UserStatus
+		binary.LittleEndian.PutUint32(d[1:], f.RequestNospam)
+		binary.BigEndian.PutUint64(d[5:], f.LastSeen)
+	}
+	this.SetSection(SectionFriends, data)
+	return nil
+}
+
+// ConferencePeer is a peer saved with a conference.
+type ConferencePeer struct {
+	PublicKey     [PublicKeySize]byte
+	TempPublicKey [PublicKeySize]byte
+	PeerNumber    uint16
+	LastActive    uint64
+	Nick          string
+}
+
+// Conference is one saved conference.
+type Conference struct {
+	Type               uint8
+	ID                 [32]byte
+	MessageNumber      uint32
+	LossyMessageNumber uint16
+	PeerNumber         uint16
+	Title              string
+	Peers              []ConferencePeer
+}
+
+// Conferences decodes the conferences section.
+func (this *Savedata) Conferences() ([]Conference, error) {
+	s := this.Section(SectionConferences)
+	if s == nil {
+		return []Conference{}, nil
+	}
+
+	confs := []Conference{}
+	d := s.Data
+	for len(d) > 0 {
+		var c Conference
+		if len(d) < 1+32+4+2+2+4+1 {
+			return nil, fmt.Errorf("truncated conference")
+		}
+		c.Type = d[0]
+		copy(c.ID[:], d[1:])
+		c.MessageNumber = binary.LittleEndian.Uint32(d[33:])
+		c.LossyMessageNumber = binary.LittleEndian.Uint16(d[37:])
+		c.PeerNumber = binary.LittleEndian.Uint16(d[39:])
+		npeers := binary.LittleEndian.Uint32(d[41:])
+		titleLen := int(d[45])
+		d = d[46:]
+		if len(d) < titleLen {
+			return nil, fmt.Errorf("truncated conference title")
+		}
+		c.Title = string(d[:titleLen])
+		d = d[titleLen:]
+
+		for i := uint32(0); i < npeers; i++ {
+			var p ConferencePeer
+			if len(d) < 2*PublicKeySize+2+8+1 {
+				return nil, fmt.Errorf("truncated conference peer")
+			}
+			copy(p.PublicKey[:], d)
+			copy(p.TempPublicKey[:], d[PublicKeySize:])
+			p.PeerNumber = binary.LittleEndian.Uint16(d[2*PublicKeySize:])
+			p.LastActive = binary.LittleEndian.Uint64(d[2*PublicKeySize+2:])
+			nickLen := int(d[2*PublicKeySize+10])
+			d = d[2*PublicKeySize+11:]
+			if len(d) < nickLen {
+				return nil, fmt.Errorf("truncated conference peer nick")
+			}
+			p.Nick = string(d[:nickLen])
+			d = d[nickLen:]
+			c.Peers = append(c.Peers, p)
+		}
+		confs = append(confs, c)
+	}
+	return confs, nil
+}
+
+// SetConferences encodes the conferences section.
+func (this *Savedata) SetConferences(confs []Conference) error {
+	var data []byte
+	for i, c := range confs {
+		if len(c.Title) > 255 {
+			return fmt.Errorf("conference %d: title too long", i)
+		}
+		var hdr [46]byte
+		hdr[0] = c.Type
+		copy(hdr[1:], c.ID[:])
+		binary.LittleEndian.PutUint32(hdr[33:], c.MessageNumber)
+		binary.LittleEndian.PutUint16(hdr[37:], c.LossyMessageNumber)
+		binary.LittleEndian.PutUint16(hdr[39:], c.PeerNumber)
+		binary.LittleEndian.PutUint32(hdr[41:], uint32(len(c.Peers)))
+		hdr[45] = byte(len(c.Title))
+		data = append(append(data, hdr[:]...), c.Title...)
+
+		for _, p := range c.Peers {
+			if len(p.Nick) > 255 {
+				return fmt.Errorf("conference %d: peer nick too long", i)
+			}
+			var phdr [2*PublicKeySize + 11]byte
+			copy(phdr[:], p.PublicKey[:])
+			copy(phdr[PublicKeySize:], p.TempPublicKey[:])
+			binary.LittleEndian.PutUint16(phdr[2*PublicKeySize:], p.PeerNumber)
+			binary.LittleEndian.PutUint64(phdr[2*PublicKeySize+2:], p.LastActive)
+			phdr[2*PublicKeySize+10] = byte(len(p.Nick))
+			data = append(append(data, phdr[:]...), p.Nick...)
+		}
+	}
+	this.SetSection(SectionConferences, data)
+	return nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,137 @@
+package savedata
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// address families of packed nodes
+const (
+	familyInet     = 2
+	familyInet6    = 10
+	familyTCPInet  = 130
+	familyTCPInet6 = 138
+)
+
+// Node is a DHT node, TCP relay or onion path node.
+type Node struct {
+	TCP       bool
+	IP        net.IP
+	Port      uint16
+	PublicKey [PublicKeySize]byte
+}
+
+func (this Node) String() string {
+	proto := "udp"
+	if this.TCP {
+		proto = "tcp"
+	}
+	return fmt.Sprintf("%s://%s %s", proto, net.JoinHostPort(this.IP.String(), fmt.Sprint(this.Port)),
+		strings.ToUpper(hex.EncodeToString(this.PublicKey[:])))
+}
+
+// ParseNodes decodes nodes in the packed node format.
+func ParseNodes(data []byte) ([]Node, error) {
+	nodes := []Node{}
+	for len(data) > 0 {
+		var node Node
+		var iplen int
+		switch data[0] {
+		case familyInet, familyTCPInet:
+			iplen = net.IPv4len
+		case familyInet6, familyTCPInet6:
+			iplen = net.IPv6len
+		default:
+			return nil, fmt.Errorf("unknown node address family %d", data[0])
+		}
+		node.TCP = data[0] == familyTCPInet || data[0] == familyTCPInet6
+		if len(data) < 1+iplen+2+PublicKeySize {
+			return nil, fmt.Errorf("truncated node")
+		}
+		node.IP = net.IP(append([]byte{}, data[1:1+iplen]...))
+		node.Port = binary.BigEndian.Uint16(data[1+iplen:])
+		copy(node.PublicKey[:], data[1+iplen+2:])
+		nodes = append(nodes, node)
+		data = data[1+iplen+2+PublicKeySize:]
+	}
+	return nodes, nil
+}
+
+// EncodeNodes encodes nodes in the packed node format.
+func EncodeNodes(nodes []Node) []byte {
+	var out []byte
+	for _, node := range nodes {
+		ip, family := node.IP.To4(), byte(familyInet)
+		if ip == nil {
+			ip, family = node.IP.To16(), familyInet6
+		}
+		if node.TCP {
+			family += 128
+		}
+		out = append(out, family)
+		out = append(out, ip...)
+		out = append(out, byte(node.Port>>8), byte(node.Port))
+		out = append(out, node.PublicKey[:]...)
+	}
+	return out
+}
+
+// DHTNodes decodes the nodes of the DHT section.
+func (this *Savedata) DHTNodes() ([]Node, error) {
+	s := this.Section(SectionDHT)
+	if s == nil {
+		return []Node{}, nil
+	}
+	if len(s.Data) < 4 || binary.LittleEndian.Uint32(s.Data) != dhtCookieGlobal {
+		return nil, fmt.Errorf("bad DHT section cookie")
+	}
+	sections, _, err := parseSections(s.Data[4:], dhtCookieType)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []Node{}
+	for _, sub := range sections {
+		if sub.Type == dhtTypeNodes {
+			n, err := ParseNodes(sub.Data)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, n...)
+		}
+	}
+	return nodes, nil
+}
+
+func (this *Savedata) SetDHTNodes(nodes []Node) {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, dhtCookieGlobal)
+	this.SetSection(SectionDHT, appendSection(data, dhtTypeNodes, dhtCookieType, EncodeNodes(nodes)))
+}
+
+func (this *Savedata) nodeSection(typ uint16) ([]Node, error) {
+	if s := this.Section(typ); s != nil {
+		return ParseNodes(s.Data)
+	}
+	return []Node{}, nil
+}
+
+// TCPRelays decodes the TCP relays the profile was connected to.
+func (this *Savedata) TCPRelays() ([]Node, error) {
+	return this.nodeSection(SectionTCPRelay)
+}
+
+func (this *Savedata) SetTCPRelays(nodes []Node) {
+	this.SetSection(SectionTCPRelay, EncodeNodes(nodes))
+}
+
+// PathNodes decodes the nodes saved for onion paths.
+func (this *Savedata) PathNodes() ([]Node, error) {
+	return this.nodeSection(SectionPathNode)
+}
+
+func (this *Savedata) SetPathNodes(nodes []Node) {
+	this.SetSection(SectionPathNode, EncodeNodes(nodes))
+}
@@ -0,0 +1,276 @@
+// Package savedata parses and serializes the toxcore savedata format without
+// toxcore, so tools can read and edit profiles offline.
+//
+// A savedata is a sequence of sections. Sections are kept as raw bytes and only
+// decoded by the typed accessors, so unknown sections and untouched sections
+// are written back byte for byte.
+package savedata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Section types of the messenger state.
+const (
+	SectionNospamKeys    = 1
+	SectionDHT           = 2
+	SectionFriends       = 3
+	SectionName          = 4
+	SectionStatusMessage = 5
+	SectionStatus        = 6
+	SectionGroups        = 7
+	SectionTCPRelay      = 10
+	SectionPathNode      = 11
+	SectionConferences   = 20
+	SectionEnd           = 255
+)
+
+const (
+	cookieGlobal    = 0x15ed1b1f
+	cookieType      = 0x01ce
+	dhtCookieGlobal = 0x0159000d
+	dhtCookieType   = 0x11ce
+	dhtTypeNodes    = 4
+
+	PublicKeySize          = 32
+	SecretKeySize          = 32
+	AddressSize            = PublicKeySize + 4 + 2
+	MaxNameLength          = 128
+	MaxStatusMessageLength = 1007
+	friendRequestSize      = 1024
+	savedFriendSize        = 1 + PublicKeySize + friendRequestSize + 2 + MaxNameLength + 2 + MaxStatusMessageLength + 2 + 1 + 4 + 8
+)
+
+// encryptedMagic starts data encrypted with toxencryptsave.
+var encryptedMagic = []byte("toxEsave")
+
+// IsEncrypted reports whether the data is encrypted and must be decrypted before Parse.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// Section is one raw section of the savedata.
+type Section struct {
+	Type uint16
+	Data []byte
+}
+
+// Savedata is a parsed savedata.
+type Savedata struct {
+	Sections []Section
+	// Trailing holds bytes after the end section, kept for a byte exact round trip.
+	Trailing []byte
+}
+
+// New returns an empty savedata which only has an end section.
+func New() *Savedata {
+	return &Savedata{Sections: []Section{{Type: SectionEnd}}}
+}
+
+// Parse splits the savedata into its sections.
+func Parse(data []byte) (*Savedata, error) {
+	if IsEncrypted(data) {
+		return nil, fmt.Errorf("savedata is encrypted")
+	}
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != 0 || binary.LittleEndian.Uint32(data[4:]) != cookieGlobal {
+		return nil, fmt.Errorf("not a tox savedata")
+	}
+	sections, rest, err := parseSections(data[8:], cookieType)
+	if err != nil {
+		return nil, err
+	}
+	return &Savedata{Sections: sections, Trailing: rest}, nil
+}
+
+// Salvage reads the sections of a damaged savedata up to the first broken one.
+// It returns the readable sections, completed with an end section, together
+// with the error which stopped it, or a nil error if the savedata is intact.
+func Salvage(data []byte) (*Savedata, error) {
+	if IsEncrypted(data) {
+		return nil, fmt.Errorf("savedata is encrypted")
+	}
+	if len(data) < 8 || binary.LittleEndian.Uint32(data[4:]) != cookieGlobal {
+		return nil, fmt.Errorf("not a tox savedata")
+	}
+	sections, rest, err := parseSections(data[8:], cookieType)
+	if err != nil {
+		sections = append(sections, Section{Type: SectionEnd})
+		rest = nil
+	}
+	return &Savedata{Sections: sections, Trailing: rest}, err
+}
+
+// parseSections reads sections until the end section or the end of data, and returns the bytes after the end section.
+// On error it returns the sections read before the broken one.
+func parseSections(data []byte, cookie uint16) ([]Section, []byte, error) {
+	sections := []Section{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return sections, nil, fmt.Errorf("truncated section header")
+		}
+		length := binary.LittleEndian.Uint32(data)
+		typ := binary.LittleEndian.Uint16(data[4:])
+		if c := binary.LittleEndian.Uint16(data[6:]); c != cookie {
+			return sections, nil, fmt.Errorf("section %d: bad cookie %#x", typ, c)
+		}
+		data = data[8:]
+		if uint64(length) > uint64(len(data)) {
+			return sections, nil, fmt.Errorf("section %d: length %d beyond end of data", typ, length)
+		}
+		sections = append(sections, Section{Type: typ, Data: data[:length:length]})
+		data = data[length:]
+		if typ == SectionEnd && cookie == cookieType {
+			break
+		}
+	}
+	return sections, data, nil
+}
+
+func appendSection(out []byte, typ uint16, cookie uint16, data []byte) []byte {
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint16(hdr[4:], typ)
+	binary.LittleEndian.PutUint16(hdr[6:], cookie)
+	return append(append(out, hdr[:]...), data...)
+}
+
+// Bytes serializes the savedata.
+func (this *Savedata) Bytes() []byte {
+	out := make([]byte, 8, 1024)
+	binary.LittleEndian.PutUint32(out[4:], cookieGlobal)
+	for _, s := range this.Sections {
+		out = appendSection(out, s.Type, cookieType, s.Data)
+	}
+	return append(out, this.Trailing...)
+}
+
+// Section returns the first section of the type, or nil.
+func (this *Savedata) Section(typ uint16) *Section {
+	for i := range this.Sections {
+		if this.Sections[i].Type == typ {
+			return &this.Sections[i]
+		}
+	}
+	return nil
+}
+
+// SetSection replaces the data of the first section of the type, or adds the section before the end section.
+func (this *Savedata) SetSection(typ uint16, data []byte) {
+	if s := this.Section(typ); s != nil {
+		s.Data = data
+		return
+	}
+	at := len(this.Sections)
+	for i, s := range this.Sections {
+		if s.Type == SectionEnd {
+			at = i
+			break
+		}
+	}
+	this.Sections = append(this.Sections, Section{})
+	copy(this.Sections[at+1:], this.Sections[at:])
+	this.Sections[at] = Section{Type: typ, Data: data}
+}
+
+// RemoveSection removes all sections of the type.
+func (this *Savedata) RemoveSection(typ uint16) {
+	sections := this.Sections[:0]
+	for _, s := range this.Sections {
+		if s.Type != typ {
+			sections = append(sections, s)
+		}
+	}
+	this.Sections = sections
+}
+
+// Keys are the long term key pair and the nospam of the profile.
+type Keys struct {
+	// Nospam in the byte order of ToxAddress, like tox_self_get_nospam returns it.
+	Nospam    uint32
+	PublicKey [PublicKeySize]byte
+	SecretKey [SecretKeySize]byte
+}
+
+// Address returns the Tox ID of the keys as upper case hex string.
+func (this *Keys) Address() string {
+	var addr [AddressSize]byte
+	copy(addr[:], this.PublicKey[:])
+	binary.BigEndian.PutUint32(addr[PublicKeySize:], this.Nospam)
+	var checksum [2]byte
+	for i := 0; i < PublicKeySize+4; i++ {
+		checksum[i%2] ^= addr[i]
+	}
+	copy(addr[PublicKeySize+4:], checksum[:])
+	return strings.ToUpper(hex.EncodeToString(addr[:]))
+}
+
+// Keys decodes the nospam and keys section.
+func (this *Savedata) Keys() (*Keys, error) {
+	s := this.Section(SectionNospamKeys)
+	if s == nil {
+		return nil, fmt.Errorf("no keys section")
+	}
+	if len(s.Data) != 4+PublicKeySize+SecretKeySize {
+		return nil, fmt.Errorf("keys section has %d bytes", len(s.Data))
+	}
+	keys := &Keys{}
+	keys.Nospam = binary.BigEndian.Uint32(s.Data)
+	copy(keys.PublicKey[:], s.Data[4:])
+	copy(keys.SecretKey[:], s.Data[4+PublicKeySize:])
+	return keys, nil
+}
+
+func (this *Savedata) SetKeys(keys *Keys) {
+	data := make([]byte, 4+PublicKeySize+SecretKeySize)
+	binary.BigEndian.PutUint32(data, keys.Nospam)
+	copy(data[4:], keys.PublicKey[:])
+	copy(data[4+PublicKeySize:], keys.SecretKey[:])
+	this.SetSection(SectionNospamKeys, data)
+}
+
+func (this *Savedata) stringSection(typ uint16) string {
+	if s := this.Section(typ); s != nil {
+		return string(s.Data)
+	}
+	return ""
+}
+
+func (this *Savedata) Name() string {
+	return this.stringSection(SectionName)
+}
+
+func (this *Savedata) SetName(name string) error {
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("name longer than %d bytes", MaxNameLength)
+	}
+	this.SetSection(SectionName, []byte(name))
+	return nil
+}
+
+func (this *Savedata) StatusMessage() string {
+	return this.stringSection(SectionStatusMessage)
+}
+
+func (this *Savedata) SetStatusMessage(msg string) error {
+	if len(msg) > MaxStatusMessageLength {
+		return fmt.Errorf("status message longer than %d bytes", MaxStatusMessageLength)
+	}
+	this.SetSection(SectionStatusMessage, []byte(msg))
+	return nil
+}
+
+// Status returns the user status, one of the tox UserStatus* values.
+func (this *Savedata) Status() uint8 {
+	if s := this.Section(SectionStatus); s != nil && len(s.Data) > 0 {
+		return s.Data[0]
+	}
+	return 0
+}
+
+func (this *Savedata) SetStatus(status uint8) {
+	this.SetSection(SectionStatus, []byte{status})
+}
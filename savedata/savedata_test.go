@@ -0,0 +1,171 @@
+package savedata
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func sampleSavedata(t *testing.T) *Savedata {
+	sd := New()
+	keys := &Keys{Nospam: 0x12345678}
+	for i := range keys.PublicKey {
+		keys.PublicKey[i], keys.SecretKey[i] = byte(i), byte(255-i)
+	}
+	sd.SetKeys(keys)
+	sd.SetDHTNodes([]Node{
+		{IP: net.ParseIP("127.0.0.1"), Port: 33445, PublicKey: keys.PublicKey},
+		{IP: net.ParseIP("::1"), Port: 33446},
+	})
+	if err := sd.SetFriends([]Friend{
+		{Status: FriendStatusConfirmed, Name: "echo", StatusMessage: "hi", UserStatus: 1, LastSeen: 1500000000},
+		{Status: FriendStatusRequested, RequestMessage: []byte("add me"), RequestNospam: 0xdeadbeef},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sd.SetName("bot")
+	sd.SetStatusMessage("running")
+	sd.SetStatus(2)
+	sd.SetTCPRelays([]Node{{TCP: true, IP: net.ParseIP("10.0.0.1"), Port: 443}})
+	sd.SetPathNodes([]Node{})
+	if err := sd.SetConferences([]Conference{{
+		Type: 1, MessageNumber: 7, PeerNumber: 3, Title: "room",
+		Peers: []ConferencePeer{{PeerNumber: 1, LastActive: 99, Nick: "alice"}, {PeerNumber: 2}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	return sd
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := sampleSavedata(t).Bytes()
+	data = append(data, 1, 2, 3) // junk after the end section survives
+
+	sd, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sd.Bytes(), data) {
+		t.Fatal("round trip differs")
+	}
+	if sd.Sections[len(sd.Sections)-1].Type != SectionEnd || len(sd.Trailing) != 3 {
+		t.Error("end section must be last", sd.Sections)
+	}
+
+	// decoding and encoding every section again is canonical
+	keys, _ := sd.Keys()
+	sd.SetKeys(keys)
+	nodes, _ := sd.DHTNodes()
+	sd.SetDHTNodes(nodes)
+	friends, _ := sd.Friends()
+	sd.SetFriends(friends)
+	relays, _ := sd.TCPRelays()
+	sd.SetTCPRelays(relays)
+	confs, _ := sd.Conferences()
+	sd.SetConferences(confs)
+	if !bytes.Equal(sd.Bytes(), data) {
+		t.Error("re-encoded sections differ")
+	}
+}
+
+func TestSections(t *testing.T) {
+	sd, err := Parse(sampleSavedata(t).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := sd.Keys()
+	if err != nil || keys.Nospam != 0x12345678 || keys.SecretKey[0] != 255 {
+		t.Error("wrong keys", keys, err)
+	}
+	// public key, nospam and xor checksum
+	if addr := keys.Address(); len(addr) != AddressSize*2 || addr[64:72] != "12345678" || addr[72:] != "444C" {
+		t.Error("wrong address", addr)
+	}
+	if sd.Name() != "bot" || sd.StatusMessage() != "running" || sd.Status() != 2 {
+		t.Error("wrong self info", sd.Name(), sd.StatusMessage(), sd.Status())
+	}
+
+	nodes, err := sd.DHTNodes()
+	if err != nil || len(nodes) != 2 || !nodes[0].IP.Equal(net.ParseIP("127.0.0.1")) || nodes[1].Port != 33446 || nodes[0].TCP {
+		t.Error("wrong dht nodes", nodes, err)
+	}
+	relays, err := sd.TCPRelays()
+	if err != nil || len(relays) != 1 || !relays[0].TCP || relays[0].Port != 443 {
+		t.Error("wrong relays", relays, err)
+	}
+
+	friends, err := sd.Friends()
+	if err != nil || len(friends) != 2 {
+		t.Fatal("wrong friends", err)
+	}
+	if f := friends[0]; f.Name != "echo" || f.StatusMessage != "hi" || f.LastSeen != 1500000000 || f.UserStatus != 1 {
+		t.Error("wrong friend", f)
+	}
+	if f := friends[1]; string(f.RequestMessage) != "add me" || f.RequestNospam != 0xdeadbeef || f.Status != FriendStatusRequested {
+		t.Error("wrong friend request", f)
+	}
+
+	confs, err := sd.Conferences()
+	if err != nil || len(confs) != 1 || confs[0].Title != "room" || len(confs[0].Peers) != 2 || confs[0].Peers[0].Nick != "alice" {
+		t.Error("wrong conferences", confs, err)
+	}
+
+	// editing keeps the other sections
+	sd.SetName("renamed")
+	sd.SetFriends(friends[:1])
+	sd2, _ := Parse(sd.Bytes())
+	if sd2.Name() != "renamed" {
+		t.Error("wrong name", sd2.Name())
+	}
+	if f2, _ := sd2.Friends(); !reflect.DeepEqual(f2, friends[:1]) {
+		t.Error("wrong friends after edit", f2)
+	}
+	if k2, _ := sd2.Keys(); *k2 != *keys {
+		t.Error("keys changed")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	data := sampleSavedata(t).Bytes()
+	if _, err := Parse(append([]byte("toxEsave"), data...)); err == nil {
+		t.Error("must reject encrypted data")
+	}
+	if _, err := Parse(data[:20]); err == nil {
+		t.Error("must reject truncated data")
+	}
+	if _, err := Parse([]byte("not a savedata at all")); err == nil {
+		t.Error("must reject garbage")
+	}
+	sd := New()
+	sd.SetSection(SectionFriends, []byte{1, 2, 3})
+	if _, err := sd.Friends(); err == nil {
+		t.Error("must reject short friend")
+	}
+	if err := sd.SetName(string(make([]byte, MaxNameLength+1))); err == nil {
+		t.Error("must reject long name")
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	data := sampleSavedata(t).Bytes()
+	if sd, err := Salvage(data); err != nil || !bytes.Equal(sd.Bytes(), data) {
+		t.Error("intact savedata must salvage completely", err)
+	}
+
+	// cut into the section after the keys, the keys survive
+	sd, err := Salvage(data[:8+8+4+PublicKeySize+SecretKeySize+8+100])
+	if err == nil {
+		t.Fatal("must report the broken section")
+	}
+	if keys, err := sd.Keys(); err != nil || keys.Nospam != 0x12345678 {
+		t.Error("keys not salvaged", keys, err)
+	}
+	if sd.Section(SectionFriends) != nil || sd.Sections[len(sd.Sections)-1].Type != SectionEnd {
+		t.Error("wrong salvaged sections", sd.Sections)
+	}
+	if _, err := Parse(sd.Bytes()); err != nil {
+		t.Error("salvaged savedata must parse", err)
+	}
+}
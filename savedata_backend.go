@@ -0,0 +1,291 @@
+package tox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SavedataBackend stores the savedata of named profiles.
+//
+// Load returns nil data without error for a profile which was never saved.
+type SavedataBackend interface {
+	Load(profile string) ([]byte, error)
+	Save(profile string, data []byte) error
+	Delete(profile string) error
+	List() ([]string, error)
+}
+
+// validProfileName rejects names which could escape the storage location.
+func validProfileName(profile string) error {
+	if profile == "" || profile == "." || profile == ".." || strings.ContainsAny(profile, "/\\\x00") {
+		return toxerrf("Invalid profile name: %q", profile)
+	}
+	return nil
+}
+
+// FileBackend stores a single profile in one file, named like the file without extension.
+type FileBackend struct {
+	path string
+	name string
+	mu   sync.Mutex
+}
+
+// NewFileBackend creates a backend for the profile file at path.
+func NewFileBackend(path string) *FileBackend {
+	base := filepath.Base(path)
+	return &FileBackend{path: path, name: strings.TrimSuffix(base, filepath.Ext(base))}
+}
+
+func (this *FileBackend) check(profile string) error {
+	if profile != this.name {
+		return toxerrf("Unknown profile %q, the file only holds %q", profile, this.name)
+	}
+	return nil
+}
+
+func (this *FileBackend) Load(profile string) ([]byte, error) {
+	if err := this.check(profile); err != nil {
+		return nil, err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return readSavedataFile(this.path)
+}
+
+func (this *FileBackend) Save(profile string, data []byte) error {
+	if err := this.check(profile); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return WriteFileAtomic(this.path, data, 0600)
+}
+
+func (this *FileBackend) Delete(profile string) error {
+	if err := this.check(profile); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return removeSavedataFile(this.path)
+}
+
+func (this *FileBackend) List() ([]string, error) {
+	if !FileExist(this.path) {
+		return nil, nil
+	}
+	return []string{this.name}, nil
+}
+
+// DirBackend stores every profile as <name>.tox in one directory.
+type DirBackend struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewDirBackend creates a backend for the directory, creating it if needed.
+func NewDirBackend(dir string) (*DirBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirBackend{dir: dir}, nil
+}
+
+func (this *DirBackend) path(profile string) (string, error) {
+	if err := validProfileName(profile); err != nil {
+		return "", err
+	}
+	return filepath.Join(this.dir, profile+".tox"), nil
+}
+
+func (this *DirBackend) Load(profile string) ([]byte, error) {
+	path, err := this.path(profile)
+	if err != nil {
+		return nil, err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return readSavedataFile(path)
+}
+
+func (this *DirBackend) Save(profile string, data []byte) error {
+	path, err := this.path(profile)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return WriteFileAtomic(path, data, 0600)
+}
+
+func (this *DirBackend) Delete(profile string) error {
+	path, err := this.path(profile)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return removeSavedataFile(path)
+}
+
+func (this *DirBackend) List() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(this.dir, "*.tox"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		names = append(names, strings.TrimSuffix(filepath.Base(m), ".tox"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// MemoryBackend keeps profiles in memory, for tests and short lived processes.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	profiles map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{profiles: make(map[string][]byte)}
+}
+
+func (this *MemoryBackend) Load(profile string) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if data, ok := this.profiles[profile]; ok {
+		return append([]byte{}, data...), nil
+	}
+	return nil, nil
+}
+
+func (this *MemoryBackend) Save(profile string, data []byte) error {
+	if profile == "" {
+		return toxerrf("Invalid profile name: %q", profile)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.profiles[profile] = append([]byte{}, data...)
+	return nil
+}
+
+func (this *MemoryBackend) Delete(profile string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.profiles, profile)
+	return nil
+}
+
+func (this *MemoryBackend) List() ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	names := make([]string, 0, len(this.profiles))
+	for name := range this.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// KVStore is the subset of an embedded key-value store needed by KVBackend.
+// Get returns nil without error for a missing key.
+type KVStore interface {
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Keys(prefix []byte) ([][]byte, error)
+}
+
+// KVBackend stores profiles in a key-value store, under the key prefix followed by the profile name.
+type KVBackend struct {
+	kv     KVStore
+	prefix string
+}
+
+// NewKVBackend creates a backend storing the profiles in kv, with keys starting with prefix.
+func NewKVBackend(kv KVStore, prefix string) *KVBackend {
+	return &KVBackend{kv: kv, prefix: prefix}
+}
+
+func (this *KVBackend) key(profile string) ([]byte, error) {
+	if profile == "" {
+		return nil, toxerrf("Invalid profile name: %q", profile)
+	}
+	return []byte(this.prefix + profile), nil
+}
+
+func (this *KVBackend) Load(profile string) ([]byte, error) {
+	key, err := this.key(profile)
+	if err != nil {
+		return nil, err
+	}
+	return this.kv.Get(key)
+}
+
+func (this *KVBackend) Save(profile string, data []byte) error {
+	key, err := this.key(profile)
+	if err != nil {
+		return err
+	}
+	return this.kv.Put(key, data)
+}
+
+func (this *KVBackend) Delete(profile string) error {
+	key, err := this.key(profile)
+	if err != nil {
+		return err
+	}
+	return this.kv.Delete(key)
+}
+
+func (this *KVBackend) List() ([]string, error) {
+	keys, err := this.kv.Keys([]byte(this.prefix))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, string(key[len(this.prefix):]))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readSavedataFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func removeSavedataFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SaveSavedataTo writes the savedata of the Tox instance as profile to the backend.
+func (this *Tox) SaveSavedataTo(backend SavedataBackend, profile string) error {
+	this.lock()
+	data := this.GetSavedata()
+	this.unlock()
+	return backend.Save(profile, data)
+}
+
+// LoadOptionsFrom loads the profile from the backend into the options, leaving them untouched for a new profile.
+func LoadOptionsFrom(backend SavedataBackend, profile string, opts *ToxOptions) error {
+	data, err := backend.Load(profile)
+	if err != nil || data == nil {
+		return err
+	}
+	opts.SavedataType = SavedataTypeToxSave
+	opts.SavedataData = data
+	return nil
+}
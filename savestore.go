@@ -0,0 +1,459 @@
+package tox
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SaveStore loads and saves the savedata of a Tox instance in one file.
+//
+// With a passphrase the file is encrypted with a ToxPassKey, which is derived
+// once and reused for every save. Saves go to a temporary file which is synced
+// and renamed over the old file, so a crash leaves either the old or the new
+// savedata. The previous versions are kept as path.1 (newest) to path.N.
+type SaveStore struct {
+	path    string
+	passkey *ToxPassKey
+	salt    []byte
+	pass    []byte
+
+	// Backups is the number of previous versions kept, 0 to keep none.
+	Backups int
+	// SaveDelay is how long Attach waits after a change before saving, to coalesce bursts of changes.
+	SaveDelay time.Duration
+	// OnError is called with errors of automatic saves, if set.
+	OnError func(err error)
+
+	mu      sync.Mutex
+	closed  bool
+	last    []byte // plaintext of the last load or save
+	tox     *Tox
+	changed chan struct{}
+	stopch  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewSaveStore creates a store for the file at path. An empty passphrase stores the savedata unencrypted.
+func NewSaveStore(path string, passphrase []byte) *SaveStore {
+	this := &SaveStore{}
+	this.path = path
+	if len(passphrase) > 0 {
+		this.pass = append([]byte{}, passphrase...)
+	}
+	this.Backups = 3
+	this.SaveDelay = time.Second
+	return this
+}
+
+// Path returns the file the savedata is stored in.
+func (this *SaveStore) Path() string {
+	return this.path
+}
+
+// Load reads and decrypts the savedata. It returns nil data without error if the file does not exist yet.
+//
+// An unencrypted file is accepted even with a passphrase, it is encrypted on the next save.
+func (this *SaveStore) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(this.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return nil, toxerr("save store is closed")
+	}
+	encrypted := len(data) > 0 && IsDataEncrypted(data)
+	if encrypted {
+		if data, err = this.decrypt(data); err != nil {
+			return nil, err
+		}
+	}
+	this.last = nil
+	if encrypted == (this.pass != nil) {
+		this.last = data // otherwise the next save converts the file
+	}
+	return data, nil
+}
+
+// LoadOptions loads the savedata into the options, leaving them untouched for a new profile.
+func (this *SaveStore) LoadOptions(opts *ToxOptions) error {
+	data, err := this.Load()
+	if err != nil || data == nil {
+		return err
+	}
+	opts.SavedataType = SavedataTypeToxSave
+	opts.SavedataData = data
+	return nil
+}
+
+// deriveKey derives the pass key once, with the salt of the encrypted data if it differs. Call with mu held.
+func (this *SaveStore) deriveKey(encrypted []byte) error {
+	var salt []byte
+	if encrypted != nil {
+		var err error
+		if _, err, salt = GetSalt(encrypted); err != nil {
+			return err
+		}
+	}
+	if this.passkey != nil && (salt == nil || bytes.Equal(salt, this.salt)) {
+		return nil
+	}
+	this.passkey.Free()
+	this.passkey = nil
+
+	if salt == nil {
+		passkey, err := Derive(this.pass)
+		if err != nil {
+			return err
+		}
+		// remember the random salt, to skip deriving again for files we wrote
+		_, err, probe := passkey.Encrypt([]byte{0})
+		if err == nil {
+			_, _, salt = GetSalt(probe)
+		}
+		this.passkey = passkey
+	} else {
+		passkey, err := DeriveWithSalt(this.pass, salt)
+		if err != nil {
+			return err
+		}
+		this.passkey = passkey
+	}
+	this.salt = salt
+	return nil
+}
+
+// decrypt decrypts data of the file at path or its backups. Call with mu held.
+func (this *SaveStore) decrypt(data []byte) ([]byte, error) {
+	if this.pass == nil {
+		return nil, toxerrf("%s is encrypted, need a passphrase", this.path)
+	}
+	if err := this.deriveKey(data); err != nil {
+		return nil, err
+	}
+	_, err, plain := this.passkey.Decrypt(data)
+	if err != nil {
+		return nil, toxerrf("%s: decrypt failed, wrong passphrase? %v", this.path, err)
+	}
+	return plain, nil
+}
+
+// encrypt encrypts data with the pass key, or returns it as is without a passphrase. Call with mu held.
+func (this *SaveStore) encrypt(data []byte) ([]byte, error) {
+	if this.pass == nil {
+		return data, nil
+	}
+	if err := this.deriveKey(nil); err != nil {
+		return nil, err
+	}
+	_, err, ciphertext := this.passkey.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return ciphertext, nil
+}
+
+// Save encrypts and writes the savedata, unless it did not change since the last load or save.
+func (this *SaveStore) Save(data []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.save(data)
+}
+
+func (this *SaveStore) save(data []byte) error {
+	if this.closed {
+		return toxerr("save store is closed")
+	}
+	if this.last != nil && bytes.Equal(data, this.last) && FileExist(this.path) {
+		return nil
+	}
+
+	out, err := this.encrypt(data)
+	if err != nil {
+		return err
+	}
+
+	if err := this.rotateBackups(); err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(this.path, out, 0600); err != nil {
+		return err
+	}
+	this.last = append([]byte{}, data...)
+	return nil
+}
+
+// SaveTox saves the current savedata of the Tox instance.
+func (this *SaveStore) SaveTox(t *Tox) error {
+	t.lock()
+	data := t.GetSavedata()
+	t.unlock()
+	return this.Save(data)
+}
+
+func (this *SaveStore) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", this.path, n)
+}
+
+// rotateBackups shifts path.1 .. path.N-1 up by one and links the current file to path.1.
+func (this *SaveStore) rotateBackups() error {
+	if this.Backups <= 0 || !FileExist(this.path) {
+		return nil
+	}
+	for n := this.Backups - 1; n >= 1; n-- {
+		if FileExist(this.backupPath(n)) {
+			if err := os.Rename(this.backupPath(n), this.backupPath(n+1)); err != nil {
+				return err
+			}
+		}
+	}
+	// a hard link keeps the current file in place until the new one is renamed over it
+	os.Remove(this.backupPath(1))
+	if err := os.Link(this.path, this.backupPath(1)); err != nil {
+		return copyFile(this.path, this.backupPath(1))
+	}
+	return nil
+}
+
+// Attach saves the savedata of the Tox instance whenever a friend is added or deleted,
+// or the name or nospam changes, SaveDelay after the change.
+//
+// The previously installed hooks for these changes are still called. The saves
+// run in their own goroutine, so the Tox instance must be created with ThreadSafe.
+func (this *SaveStore) Attach(t *Tox) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.tox != nil {
+		return
+	}
+	this.tox = t
+	this.changed = make(chan struct{}, 1)
+	this.stopch = make(chan struct{})
+
+	notify := func() {
+		select {
+		case this.changed <- struct{}{}:
+		default:
+		}
+	}
+	friendAdd, friendDelete := t.hooks.FriendAdd, t.hooks.FriendDelete
+	selfSetName, selfSetNospam := t.hooks.SelfSetName, t.hooks.SelfSetNospam
+	t.HookFriendAdd(func(friendNumber uint32) {
+		notify()
+		if friendAdd != nil {
+			friendAdd(friendNumber)
+		}
+	})
+	t.HookFriendDelete(func(friendNumber uint32) {
+		notify()
+		if friendDelete != nil {
+			friendDelete(friendNumber)
+		}
+	})
+	t.HookSelfSetName(func(name string) {
+		notify()
+		if selfSetName != nil {
+			selfSetName(name)
+		}
+	})
+	t.HookSelfSetNospam(func(nospam uint32) {
+		notify()
+		if selfSetNospam != nil {
+			selfSetNospam(nospam)
+		}
+	})
+
+	this.wg.Add(1)
+	go this.autoSave(t, this.changed, this.stopch)
+}
+
+func (this *SaveStore) autoSave(t *Tox, changed chan struct{}, stopch chan struct{}) {
+	defer this.wg.Done()
+	for {
+		select {
+		case <-changed:
+		case <-stopch:
+			return
+		}
+		select {
+		case <-time.After(this.SaveDelay):
+		case <-stopch:
+			return // Close saves
+		}
+		if err := this.SaveTox(t); err != nil && this.OnError != nil {
+			this.OnError(err)
+		}
+	}
+}
+
+// Close stops automatic saving, saves the attached Tox instance a last time and frees the pass key.
+// The store can not be used after Close.
+func (this *SaveStore) Close() error {
+	this.mu.Lock()
+	t, stopch := this.tox, this.stopch
+	this.tox, this.stopch = nil, nil
+	this.mu.Unlock()
+
+	var err error
+	if stopch != nil {
+		close(stopch)
+		this.wg.Wait()
+		err = this.SaveTox(t)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.passkey.Free()
+	this.passkey = nil
+	WipeBytes(this.pass)
+	this.pass = nil
+	this.closed = true
+	return err
+}
+
+// ChangePassphrase re-encrypts the stored savedata with a new passphrase, under a new salt.
+// An empty new passphrase stores it unencrypted. Both passphrase buffers are zeroed.
+//
+// The backups path.1 to path.N are re-encrypted too, so the old passphrase opens
+// none of the files afterwards. Backups which the old passphrase does not decrypt
+// are removed. The current file is replaced without making a backup of it.
+func (this *SaveStore) ChangePassphrase(oldPassphrase []byte, newPassphrase []byte) error {
+	defer WipeBytes(oldPassphrase)
+	defer WipeBytes(newPassphrase)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return toxerr("save store is closed")
+	}
+	if subtle.ConstantTimeCompare(oldPassphrase, this.pass) != 1 && (len(oldPassphrase) > 0 || this.pass != nil) {
+		return toxerr("wrong passphrase")
+	}
+	data, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return err
+	}
+	if IsDataEncrypted(data) {
+		if data, err = this.decrypt(data); err != nil {
+			return err
+		}
+	}
+	defer WipeBytes(data)
+
+	// decrypt the backups with the old passphrase, nil for the ones to remove
+	backups := make([][]byte, this.Backups+1)
+	for n := 1; n <= this.Backups; n++ {
+		backup, err := ioutil.ReadFile(this.backupPath(n))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(backup) > 0 && IsDataEncrypted(backup) {
+			if backup, err = this.decrypt(backup); err != nil {
+				backup = nil
+			}
+		}
+		backups[n] = backup
+		defer WipeBytes(backup)
+	}
+
+	this.passkey.Free()
+	this.passkey, this.salt = nil, nil
+	WipeBytes(this.pass)
+	this.pass = nil
+	if len(newPassphrase) > 0 {
+		this.pass = append([]byte{}, newPassphrase...)
+	}
+	this.last = nil
+
+	out, err := this.encrypt(data)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(this.path, out, 0600); err != nil {
+		return err
+	}
+	this.last = append([]byte{}, data...)
+	for n := 1; n <= this.Backups; n++ {
+		if backups[n] == nil {
+			if err := os.Remove(this.backupPath(n)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if out, err = this.encrypt(backups[n]); err == nil {
+			err = WriteFileAtomic(this.backupPath(n), out, 0600)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to fname, syncs it and renames it to fname,
+// so a crash leaves either the old or the new content.
+func WriteFileAtomic(fname string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(fname)
+	if dir == "" {
+		dir = "."
+	}
+	fp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := fp.Name()
+	if _, err = fp.Write(data); err == nil {
+		if err = fp.Sync(); err == nil {
+			err = fp.Chmod(perm)
+		}
+	}
+	if err1 := fp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmpname, fname)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	// make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -98,6 +98,8 @@ type Tox struct {
 	cb_conference_peer_names         map[unsafe.Pointer]interface{}
 	cb_conference_peer_list_changeds map[unsafe.Pointer]interface{}
 
+	cb_conference_audio_receive_frames map[unsafe.Pointer]interface{}
+
 	cb_file_recv_controls  map[unsafe.Pointer]interface{}
 	cb_file_recvs          map[unsafe.Pointer]interface{}
 	cb_file_recv_chunks    map[unsafe.Pointer]interface{}
@@ -494,23 +496,36 @@ func (this *Tox) callbackFileChunkRequestAdd(cbfn cb_file_chunk_request_ftype, u
 }
 
 // NewTox creates and initializes a new Tox instance with the options passed.
-// If the opt is nil, the default options are used.
+// If the opt is nil, the default options are used. Errors are logged, use
+// NewToxWithError to get them.
 func NewTox(opt *ToxOptions) *Tox {
+	tox, err := NewToxWithError(opt)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return tox
+}
+
+// NewToxWithError is NewTox returning why the options are invalid or toxcore failed.
+func NewToxWithError(opt *ToxOptions) (*Tox, error) {
 	var tox = new(Tox)
 	if opt != nil {
 		tox.opts = opt
 	} else {
 		tox.opts = NewToxOptions()
 	}
+	if err := tox.opts.Validate(); err != nil {
+		return nil, err
+	}
 	toxopts := tox.opts.toCToxOptions()
-	defer C.tox_options_free(toxopts)
+	defer freeCToxOptions(toxopts)
 
 	var cerr C.TOX_ERR_NEW
 	var toxcore = C.tox_new(toxopts, &cerr)
 	tox.toxcore = toxcore
 	if toxcore == nil {
-		log.Println(toxerr(cerr))
-		return nil
+		return nil, toxerr(cerr)
 	}
 	cbUserDatas.set(toxcore, tox)
 
@@ -533,12 +548,14 @@ func NewTox(opt *ToxOptions) *Tox {
 	tox.cb_conference_peer_names = make(map[unsafe.Pointer]interface{})
 	tox.cb_conference_peer_list_changeds = make(map[unsafe.Pointer]interface{})
 
+	tox.cb_conference_audio_receive_frames = make(map[unsafe.Pointer]interface{})
+
 	tox.cb_file_recv_controls = make(map[unsafe.Pointer]interface{})
 	tox.cb_file_recvs = make(map[unsafe.Pointer]interface{})
 	tox.cb_file_recv_chunks = make(map[unsafe.Pointer]interface{})
 	tox.cb_file_chunk_requests = make(map[unsafe.Pointer]interface{})
 
-	return tox
+	return tox, nil
 }
 
 // Kill releases all resources associated with the Tox instance and disconnects from the network.
@@ -655,7 +672,7 @@ func (this *Tox) SelfGetAddress() string {
 
 // SelfGetConnectionStatus returns whether we are connected to the DHT. The return value is equal to the last value received through the `self_connection_status` callback.
 //
-// @deprecated This getter is deprecated. Use the event and store the status in the client state.
+// @deprecated This getter is deprecated. Use the event and store the status in the client state, or a ConnMonitor.
 //
 // TODO: remove and handle the status inside go-toxcore-c, and provides the status as an attribute.
 // TODO: wrap TOX_CONNECTION as a Go type, and change the return value suite for it.
@@ -689,6 +706,10 @@ func (this *Tox) FriendAdd(friendId string, message string) (uint32, error) {
 	if cerr > 0 {
 		return uint32(r), toxerr(cerr)
 	}
+
+	if this.hooks.FriendAdd != nil {
+		this.hooks.FriendAdd(uint32(r))
+	}
 	return uint32(r), nil
 }
 
@@ -712,6 +733,10 @@ func (this *Tox) FriendAddNorequest(friendId string) (uint32, error) {
 	if cerr > 0 {
 		return uint32(r), toxerr(cerr)
 	}
+
+	if this.hooks.FriendAdd != nil {
+		this.hooks.FriendAdd(uint32(r))
+	}
 	return uint32(r), nil
 }
 
@@ -762,6 +787,10 @@ func (this *Tox) FriendDelete(friendNumber uint32) (bool, error) {
 	if cerr > 0 {
 		return bool(r), toxerr(cerr)
 	}
+
+	if this.hooks.FriendDelete != nil {
+		this.hooks.FriendDelete(friendNumber)
+	}
 	return bool(r), nil
 }
 
@@ -851,6 +880,10 @@ func (this *Tox) SelfSetName(name string) error {
 	if cerr > 0 {
 		return toxerr(cerr)
 	}
+
+	if this.hooks.SelfSetName != nil {
+		this.hooks.SelfSetName(name)
+	}
 	return nil
 }
 
@@ -1087,6 +1120,10 @@ func (this *Tox) SelfSetNospam(nospam uint32) {
 	var _nospam = C.uint32_t(nospam)
 
 	C.tox_self_set_nospam(this.toxcore, _nospam)
+
+	if this.hooks.SelfSetNospam != nil {
+		this.hooks.SelfSetNospam(nospam)
+	}
 }
 
 // SelfGetPublicKey returns the Tox Public Key (long term) from the Tox object.
@@ -1107,6 +1144,25 @@ func (this *Tox) SelfGetSecretKey() string {
 	return strings.ToUpper(hex.EncodeToString(_seckey[:]))
 }
 
+// SelfGetDhtId returns the temporary DHT public key of this instance, which other nodes use to bootstrap from it.
+func (this *Tox) SelfGetDhtId() string {
+	var _dhtid [PublicKeySize]byte
+
+	C.tox_self_get_dht_id(this.toxcore, (*C.uint8_t)(&_dhtid[0]))
+
+	return strings.ToUpper(hex.EncodeToString(_dhtid[:]))
+}
+
+// SelfGetUdpPort returns the UDP port this instance is bound to.
+func (this *Tox) SelfGetUdpPort() (uint16, error) {
+	var cerr C.TOX_ERR_GET_PORT
+	r := C.tox_self_get_udp_port(this.toxcore, &cerr)
+	if cerr > 0 {
+		return uint16(r), toxerr(cerr)
+	}
+	return uint16(r), nil
+}
+
 // tox_lossy_***
 
 // FriendSendLossyPacket sends a custom lossy packet to a friend.
@@ -1305,7 +1361,7 @@ func (this *Tox) AddTcpRelay(addr string, port uint16, pubkey string) (bool, err
 
 // IsConnected Return whether we are connected to the DHT. The return value is equal to the last value received through the `self_connection_status` callback.
 //
-// @deprecated This getter is deprecated. Use the event and store the status in the client state.
+// @deprecated This getter is deprecated. Use the event and store the status in the client state, or a ConnMonitor.
 //
 // TODO: remove this func
 func (this *Tox) IsConnected() int {
@@ -1,18 +1,29 @@
 package tox
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/TokTok/go-toxcore-c/savedata"
 )
 
 // `go test -v -run Covers` will show untested functions
@@ -46,7 +57,7 @@ func TestCreate(t *testing.T) {
 	})
 	t.Run("tcp options", func(t *testing.T) {
 		opts := NewToxOptions()
-		opts.Tcp_port = 44577
+		opts.TCPPort = 44577
 		_t := NewTox(opts)
 		if _t == nil {
 			t.Error("nil")
@@ -55,7 +66,7 @@ func TestCreate(t *testing.T) {
 	})
 	t.Run("tcp conflict", func(t *testing.T) {
 		opts := NewToxOptions()
-		opts.Tcp_port = 44587
+		opts.TCPPort = 44587
 		_t, _t2 := NewTox(opts), NewTox(opts)
 		if _t == nil || _t2 != nil {
 			t.Error("should non-nil/nil", _t, _t2)
@@ -78,8 +89,8 @@ func TestCreate(t *testing.T) {
 		_t.Kill()
 
 		opts := NewToxOptions()
-		opts.Savedata_data = dat
-		opts.Savedata_type = SAVEDATA_TYPE_TOX_SAVE
+		opts.SavedataData = dat
+		opts.SavedataType = SavedataTypeToxSave
 		_t2 := NewTox(opts)
 		dat2 := _t2.GetSavedata()
 		if len(dat2) != len(dat) || string(dat2) != string(dat) {
@@ -94,8 +105,8 @@ func TestCreate(t *testing.T) {
 		_t.Kill()
 
 		opts := NewToxOptions()
-		opts.Savedata_data = append([]byte("set-broken"), dat...)
-		opts.Savedata_type = SAVEDATA_TYPE_TOX_SAVE
+		opts.SavedataData = append([]byte("set-broken"), dat...)
+		opts.SavedataType = SavedataTypeToxSave
 		_t2 := NewTox(opts)
 		if _t2 == nil {
 			t.Error("must non-nil")
@@ -112,14 +123,14 @@ func TestCreate(t *testing.T) {
 		_t.Kill()
 
 		opts := NewToxOptions()
-		opts.Savedata_type = SAVEDATA_TYPE_SECRET_KEY
+		opts.SavedataType = SavedataTypeSecretKey
 		binsk, _ := hex.DecodeString(seckey)
-		opts.Savedata_data = binsk
+		opts.SavedataData = binsk
 		_t2 := NewTox(opts)
 		if _t2.SelfGetSecretKey() != seckey {
 			t.Error("must =")
 		}
-		if _t2.SelfGetAddress()[0:PUBLIC_KEY_SIZE*2] != addr[0:PUBLIC_KEY_SIZE*2] {
+		if _t2.SelfGetAddress()[0:PublicKeySize*2] != addr[0:PublicKeySize*2] {
 			t.Error("must =", _t2.SelfGetAddress(), addr)
 		}
 	})
@@ -150,11 +161,11 @@ func TestBase(t *testing.T) {
 		if size := _t.SelfGetNameSize(); size != len(tname) {
 			t.Error("must =", size, len(tname))
 		}
-		tname = strings.Repeat("n", MAX_NAME_LENGTH)
+		tname = strings.Repeat("n", MaxNameLength)
 		if err := _t.SelfSetName(tname); err != nil {
 			t.Error(err)
 		}
-		tname = strings.Repeat("n", MAX_NAME_LENGTH+1)
+		tname = strings.Repeat("n", MaxNameLength+1)
 		if err := _t.SelfSetName(tname); err == nil {
 			t.Error("must failed", err)
 		}
@@ -173,25 +184,25 @@ func TestBase(t *testing.T) {
 		if stm, err := _t.SelfGetStatusMessage(); err != nil || stm != tmsg {
 			t.Error("must =", stm, err)
 		}
-		tmsg = strings.Repeat("s", MAX_STATUS_MESSAGE_LENGTH)
+		tmsg = strings.Repeat("s", MaxStatusMessageLength)
 		if ok, err := _t.SelfSetStatusMessage(tmsg); !ok || err != nil {
 			t.Error("must ok", err)
 		}
-		tmsg = strings.Repeat("s", MAX_STATUS_MESSAGE_LENGTH+1)
+		tmsg = strings.Repeat("s", MaxStatusMessageLength+1)
 		if ok, err := _t.SelfSetStatusMessage(tmsg); ok || err == nil {
 			t.Error("must failed", err)
 		}
-		if _t.SelfGetConnectionStatus() != CONNECTION_NONE {
+		if _t.SelfGetConnectionStatus() != ConnectionNone {
 			t.Error("must none")
 		}
 	})
 	t.Run("address/pubkey", func(t *testing.T) {
 		addr := _t.SelfGetAddress()
-		if len(addr) != ADDRESS_SIZE*2 {
+		if len(addr) != AddressSize*2 {
 			t.Error("size")
 		}
 		pubkey := _t.SelfGetPublicKey()
-		if len(pubkey) != PUBLIC_KEY_SIZE*2 {
+		if len(pubkey) != PublicKeySize*2 {
 			t.Error("size")
 		}
 		if addr[0:len(pubkey)] != pubkey {
@@ -200,7 +211,7 @@ func TestBase(t *testing.T) {
 	})
 	t.Run("seckey", func(t *testing.T) {
 		seckey := _t.SelfGetSecretKey()
-		if len(seckey) != SECRET_KEY_SIZE*2 {
+		if len(seckey) != SecretKeySize*2 {
 			t.Error("size")
 		}
 	})
@@ -315,12 +326,12 @@ func TestLogin(t *testing.T) {
 				t.Error("why")
 			}
 			_t.t.Iterate()
-			if _t.t.SelfGetConnectionStatus() > CONNECTION_NONE {
+			if _t.t.SelfGetConnectionStatus() > ConnectionNone {
 				return true
 			}
 			return false
 		}, 60)
-		if _t.t.SelfGetConnectionStatus() == CONNECTION_NONE {
+		if _t.t.SelfGetConnectionStatus() == ConnectionNone {
 			t.Error("maybe iterate not use")
 		}
 	})
@@ -430,9 +441,9 @@ func TestFriend(t *testing.T) {
 				t.Error(err, status)
 				return false
 			}
-			return status > CONNECTION_NONE
+			return status > ConnectionNone
 		}, 100)
-		if status, err := t2.t.FriendGetConnectionStatus(friendNumber); err != nil || status == CONNECTION_NONE {
+		if status, err := t2.t.FriendGetConnectionStatus(friendNumber); err != nil || status == ConnectionNone {
 			t.Error(err, status)
 		}
 
@@ -476,7 +487,7 @@ func TestFriend(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		if t1st != USER_STATUS_NONE {
+		if t1st != UserStatusNone {
 			t.Error(t1st)
 		}
 	})
@@ -509,7 +520,7 @@ func TestFriend(t *testing.T) {
 		}, 100)
 		waitcond(func() bool {
 			status, _ := t2.t.FriendGetConnectionStatus(friendNumber)
-			return status > CONNECTION_NONE
+			return status > ConnectionNone
 		}, 100)
 		_, err := t2.t.FriendSendMessage(friendNumber, "hohoo")
 		if err != nil {
@@ -623,8 +634,8 @@ func TestGroup(t *testing.T) {
 			if err != nil {
 				t.Error(err)
 			}
-			if uint8(gtype) != CONFERENCE_TYPE_TEXT {
-				t.Error(gtype, CONFERENCE_TYPE_TEXT)
+			if uint8(gtype) != ConferenceTypeText {
+				t.Error(gtype, ConferenceTypeText)
 			}
 			if t1.t.GroupNumberPeers(gn) != 1 {
 				t.Error(1)
@@ -695,12 +706,12 @@ func TestGroup(t *testing.T) {
 
 		t1.t.CallbackConferenceInvite(func(_ *Tox, friendNumber uint32, itype uint8, data string, ud interface{}) {
 			switch itype {
-			case CONFERENCE_TYPE_TEXT:
+			case ConferenceTypeText:
 				_, err := t1.t.JoinGroupChat(friendNumber, data)
 				if err != nil {
 					t.Error(err)
 				}
-			case CONFERENCE_TYPE_AV:
+			case ConferenceTypeAV:
 				_, err := t1.t.JoinAVGroupChat(friendNumber, data)
 				if err != nil {
 					t.Error(err)
@@ -733,7 +744,7 @@ func TestGroup(t *testing.T) {
 		// must wait friend online and can call InviteFriend
 		waitcond(func() bool {
 			st, _ := t2.t.FriendGetConnectionStatus(fn)
-			return st > CONNECTION_NONE
+			return st > ConnectionNone
 		}, 100)
 
 		_, err = t2.t.InviteFriend(fn, gn)
@@ -780,9 +791,9 @@ func TestGroup(t *testing.T) {
 
 		t1.t.CallbackConferenceInvite(func(_ *Tox, friendNumber uint32, itype uint8, data string, ud interface{}) {
 			switch itype {
-			case CONFERENCE_TYPE_TEXT:
+			case ConferenceTypeText:
 				t1.t.JoinGroupChat(friendNumber, data)
-			case CONFERENCE_TYPE_AV:
+			case ConferenceTypeAV:
 				t1.t.JoinAVGroupChat(friendNumber, data)
 			}
 		}, nil)
@@ -816,7 +827,7 @@ func TestGroup(t *testing.T) {
 		// must wait friend online and can call InviteFriend
 		waitcond(func() bool {
 			st, _ := t2.t.FriendGetConnectionStatus(fn)
-			return st > CONNECTION_NONE
+			return st > ConnectionNone
 		}, 100)
 
 		_, err = t2.t.InviteFriend(fn, gn)
@@ -860,6 +871,1298 @@ func TestAV(t *testing.T) {
 			t.Error(err, tv1)
 		}
 	})
+	t.Run("av group", func(t *testing.T) {
+		t1 := NewMiniTox()
+		defer t1.t.Kill()
+		t1.t.CallbackConferenceAudioReceiveFrame(func(_ *Tox, groupNumber uint32, peerNumber uint32,
+			pcm []byte, sampleCount int, channels int, samplingRate int, d interface{}) {
+		}, nil)
+
+		gn := t1.t.AddAVGroupChat()
+		if gn < 0 {
+			t.Fatal("must >= 0", gn)
+		}
+		if typ, err := t1.t.ConferenceGetType(uint32(gn)); err != nil || uint8(typ) != ConferenceTypeAV {
+			t.Error("must av type", typ, err)
+		}
+		if !t1.t.IsAVGroupChatEnabled(uint32(gn)) {
+			t.Error("must enabled")
+		}
+		if err := t1.t.DisableAVGroupChat(uint32(gn)); err != nil {
+			t.Error(err)
+		}
+		if t1.t.IsAVGroupChatEnabled(uint32(gn)) {
+			t.Error("must disabled")
+		}
+		if err := t1.t.EnableAVGroupChat(uint32(gn)); err != nil {
+			t.Error(err)
+		}
+		if err := t1.t.GroupSendAudio(uint32(gn), make([]byte, 2), 960, 2, 48000); err == nil {
+			t.Error("must failed with short pcm")
+		}
+		if err := t1.t.GroupSendAudio(uint32(gn), make([]byte, 960*3*2), 960, 3, 48000); err == nil {
+			t.Error("must failed with 3 channels")
+		}
+		if err := t1.t.GroupSendAudio(uint32(gn), make([]byte, 882*2*2), 882, 2, 44100); err == nil {
+			t.Error("must failed with 44100 Hz")
+		}
+
+		tgn, _ := t1.t.ConferenceNew()
+		if err := t1.t.EnableAVGroupChat(tgn); err == nil {
+			t.Error("must failed on text conference")
+		}
+	})
+	t.Run("yuv", func(t *testing.T) {
+		// 4x2 frame, luma stride 8, chroma stride 4
+		y := []byte{1, 2, 3, 4, 0, 0, 0, 0, 5, 6, 7, 8}
+		u := []byte{10, 11, 0, 0}
+		v := []byte{20, 21, 0, 0}
+		frame := wrapI420(4, 2, unsafe.Pointer(&y[0]), unsafe.Pointer(&u[0]), unsafe.Pointer(&v[0]), 8, 4, 4)
+		if frame.YStride != 8 || &frame.Y[0] != &y[0] {
+			t.Error("must zero copy")
+		}
+		if c := frame.YCbCrAt(3, 1); c.Y != 8 || c.Cb != 11 || c.Cr != 21 {
+			t.Error("wrong pixel", c)
+		}
+
+		// bottom-up luma, starting at the last row
+		frame = wrapI420(4, 2, unsafe.Pointer(&y[8]), unsafe.Pointer(&u[0]), unsafe.Pointer(&v[0]), -8, 4, 4)
+		if frame.YStride != 4 || frame.YCbCrAt(0, 0).Y != 5 || frame.YCbCrAt(0, 1).Y != 1 {
+			t.Error("must copied top-down", frame.Y)
+		}
+
+		// strided planes one row too short must not be sent
+		short := image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420)
+		short.YStride = 8
+		short.Y = make([]byte, 8*3+3)
+		if _, err := (&ToxAV{}).VideoSendFrameYUV(0, short); err == nil {
+			t.Error("must failed with short luma plane")
+		}
+		short = image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420)
+		short.Cr = short.Cr[:3]
+		if _, err := (&ToxAV{}).VideoSendFrameYUV(0, short); err == nil {
+			t.Error("must failed with short chroma plane")
+		}
+	})
+	t.Run("image", func(t *testing.T) {
+		src := image.NewRGBA(image.Rect(0, 0, 3, 3))
+		draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{200, 30, 90, 255}), image.ZP, draw.Src)
+		want := color.YCbCrModel.Convert(src.At(0, 0)).(color.YCbCr)
+
+		dst := image.NewYCbCr(image.Rect(0, 0, 3, 3), image.YCbCrSubsampleRatio420)
+		imageToI420(src, dst)
+		if c := dst.YCbCrAt(2, 2); c != want {
+			t.Error("must =", c, want)
+		}
+		gray := image.NewGray(image.Rect(0, 0, 3, 3))
+		imageToI420(gray, dst)
+		if c := dst.YCbCrAt(1, 1); c.Y != 0 || c.Cb != 128 || c.Cr != 128 {
+			t.Error("must black", c)
+		}
+
+		cp := copyYCbCr(dst.SubImage(image.Rect(1, 1, 3, 3)).(*image.YCbCr))
+		if cp.Rect.Dx() != 2 || &cp.Y[0] == &dst.Y[0] || cp.YCbCrAt(0, 0) != dst.YCbCrAt(1, 1) {
+			t.Error("must copied", cp.Rect)
+		}
+	})
+	t.Run("call state", func(t *testing.T) {
+		av := &ToxAV{calls: make(map[uint32]*Call), cb_call_transitions: make(map[unsafe.Pointer]interface{})}
+		var trs []string
+		av.CallbackCallTransition(func(_ *ToxAV, call *Call, from CallState, to CallState, d interface{}) {
+			trs = append(trs, fmt.Sprintf("%d:%v>%v:%v", call.FriendNumber, from, to, d))
+		}, "ud")
+
+		av.callNew(1, CallStateRingingOut, true, false)
+		call := av.GetCall(1)
+		if call == nil || call.State() != CallStateRingingOut {
+			t.Fatal("must ringing out", call)
+		}
+		av.callUpdateState(1, uint32(FriendCallStateSendingAudio|FriendCallStateAcceptingAudio))
+		if !call.Flags().SendingAudio || call.Flags().SendingVideo {
+			t.Error("wrong flags", call.Flags())
+		}
+		av.callControlled(1, CallControlPause)
+		av.callUpdateState(1, 0) // friend paused too
+		av.callControlled(1, CallControlResume)
+		av.callUpdateState(1, uint32(FriendCallStateAcceptingAudio))
+		av.callUpdateState(1, uint32(FriendCallStateFinished))
+		if av.GetCall(1) != nil || call.State() != CallStateEnded {
+			t.Error("must ended and dropped")
+		}
+
+		av.callNew(2, CallStateRingingIn, true, true)
+		av.callAnswered(2)
+		av.callUpdateState(2, uint32(FriendCallStateError))
+
+		if len(trs) != 0 {
+			t.Error("must queued until iterate", trs)
+		}
+		for _, cbfn := range av.cbevts {
+			cbfn()
+		}
+		want := []string{
+			"1:new>ringing-out:ud", "1:ringing-out>active:ud", "1:active>held:ud", "1:held>active:ud", "1:active>ended:ud",
+			"2:new>ringing-in:ud", "2:ringing-in>active:ud", "2:active>error:ud",
+		}
+		if strings.Join(trs, " ") != strings.Join(want, " ") {
+			t.Error("wrong transitions", trs)
+		}
+	})
+	t.Run("bit rate", func(t *testing.T) {
+		if _, err := NewBitRateController(nil, 64, 32, 0, 0); err == nil {
+			t.Error("must failed with min > max")
+		}
+		bc, _ := NewBitRateController(nil, 16, 64, 100, 1000)
+		sets := make(map[bool]uint32)
+		bc.setfn = func(friendNumber uint32, video bool, bitRate uint32) error {
+			sets[video] = bitRate
+			return nil
+		}
+		bc.ReceiveGap = 0
+		bc.AddFriend(3, 48, 800)
+		now := time.Now()
+
+		for i := 0; i < 10; i++ {
+			bc.ReportSend(3, true, nil)
+		}
+		bc.ReportSend(3, true, toxerr("rtp"))
+		bc.update(now) // congested, but within hold time
+		if _, v := bc.BitRates(3); v != 800 {
+			t.Error("must hold", v)
+		}
+		bc.ReportSend(3, true, toxerr("rtp"))
+		bc.update(now.Add(3 * time.Second))
+		if a, v := bc.BitRates(3); v != 600 || a != 48 || sets[true] != 600 {
+			t.Error("must lowered video only", a, v)
+		}
+
+		bc.ReportSend(3, true, nil)
+		bc.update(now.Add(6 * time.Second))
+		if _, v := bc.BitRates(3); v != 600 {
+			t.Error("must stay before stable time", v)
+		}
+		bc.update(now.Add(14 * time.Second))
+		if a, v := bc.BitRates(3); v != 660 || a != 52 {
+			t.Error("must raised", a, v)
+		}
+
+		for i := 0; i < 10; i++ {
+			bc.update(now.Add(time.Duration(20+i*20) * time.Second))
+		}
+		if a, _ := bc.BitRates(3); a != 64 {
+			t.Error("must capped at max", a)
+		}
+
+		bc.setfn = func(friendNumber uint32, video bool, bitRate uint32) error { return toxerr("refused") }
+		bc.ReportSend(3, true, toxerr("rtp"))
+		bc.update(now.Add(300 * time.Second))
+		if _, v := bc.BitRates(3); v != 1000 {
+			t.Error("must keep the rate when the set fails", v)
+		}
+	})
+	t.Run("recorder", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("", "toxrec")
+		defer os.RemoveAll(dir)
+		base := filepath.Join(dir, "call")
+
+		rec := NewCallRecorder(nil, 0, base)
+		rec.SamplingRate = 8000
+		rec.MaxFileSize = 44 + 8000*4 // one second per file
+		now := time.Now()
+		rec.nowfn = func() time.Time { return now }
+
+		ones := func(n int, v int16) []int16 {
+			s := make([]int16, n)
+			for i := range s {
+				s[i] = v
+			}
+			return s
+		}
+		for i := 0; i < 75; i++ { // 1.5 s
+			rec.RecordReceivedAudio(ones(320, 100), 1, 16000)
+			rec.RecordSentAudio(ones(320, -100), 2, 16000) // resampled to 8000 mono
+			now = now.Add(20 * time.Millisecond)
+		}
+		now = now.Add(time.Second)
+		rec.RecordReceivedAudio(ones(160, 100), 1, 8000) // after 1 s silence from both sides
+
+		rec.RecordVideo(image.NewYCbCr(image.Rect(0, 0, 4, 2), image.YCbCrSubsampleRatio420))
+		rec.RecordVideo(image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420))
+		if err := rec.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		w1, _ := ioutil.ReadFile(base + "-001.wav")
+		w2, _ := ioutil.ReadFile(base + "-002.wav")
+		w3, _ := ioutil.ReadFile(base + "-003.wav")
+		if len(w1) != 44+8000*4 || string(w1[36:40]) != "data" || binary.LittleEndian.Uint32(w1[40:]) != 8000*4 {
+			t.Error("wrong first file", len(w1))
+		}
+		if l, r := int16(binary.LittleEndian.Uint16(w1[44:])), int16(binary.LittleEndian.Uint16(w1[46:])); l != 100 || r != -100 {
+			t.Error("wrong channels", l, r)
+		}
+		// 2.5 s in total, the silent sent direction is padded
+		if total := len(w2) + len(w3) - 88; total != 20000*4-8000*4 || len(w3) == 0 {
+			t.Error("wrong rotated files", len(w2), len(w3))
+		}
+
+		v1, _ := ioutil.ReadFile(base + "-001.y4m")
+		v2, _ := ioutil.ReadFile(base + "-002.y4m")
+		if !strings.HasPrefix(string(v1), "YUV4MPEG2 W4 H2 ") || !strings.Contains(string(v1), "FRAME Xts=2500\n") {
+			t.Error("wrong y4m", string(v1[:30]))
+		}
+		if !strings.HasPrefix(string(v2), "YUV4MPEG2 W4 H4 ") {
+			t.Error("must rotated on resolution change")
+		}
+
+		// a stream split into frames is resampled like the whole stream
+		ramp := make([]int16, 640)
+		for i := range ramp {
+			ramp[i] = int16(i * 7)
+		}
+		rec = NewCallRecorder(nil, 0, base+"-ramp")
+		rec.SamplingRate = 12000
+		rec.nowfn = func() time.Time { return now }
+		rec.RecordReceivedAudio(ramp[:320], 1, 16000)
+		rec.RecordReceivedAudio(ramp[320:], 1, 16000)
+		rec.Close()
+		want := newPCMResampler(1, 16000, 12000).process(ramp)
+		w, _ := ioutil.ReadFile(base + "-ramp-001.wav")
+		if len(w) != 44+len(want)*4 {
+			t.Fatal("wrong resampled length", len(w), len(want))
+		}
+		for i, v := range want {
+			if got := int16(binary.LittleEndian.Uint16(w[44+i*4:])); got != v {
+				t.Fatal("wrong resampled sample", i, got, v)
+			}
+		}
+
+		// without MaxFileSize the files rotate before the WAV sizes overflow
+		defer func(size int64) { wavMaxFileSize = size }(wavMaxFileSize)
+		wavMaxFileSize = 44 + 100*4
+		rec = NewCallRecorder(nil, 0, base+"-big")
+		rec.SamplingRate = 8000
+		rec.nowfn = func() time.Time { return now }
+		rec.RecordReceivedAudio(ones(160, 100), 1, 8000)
+		rec.Close()
+		if w, _ := ioutil.ReadFile(base + "-big-002.wav"); len(w) != 44+60*4 {
+			t.Error("must rotate at the WAV limit", len(w))
+		}
+	})
+	t.Run("player", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("", "toxplay")
+		defer os.RemoveAll(dir)
+
+		// 50 ms of 8 kHz mono and 3 frames of 4x2 video at 10 fps
+		wav := wavHeader(8000, 1, 800)
+		for i := 0; i < 400; i++ {
+			wav = append(wav, byte(i), 0)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "a.wav"), wav, 0644)
+		y4m := "YUV4MPEG2 W4 H2 F10:1 Ip C420jpeg\n"
+		for i := 0; i < 3; i++ {
+			y4m += "FRAME\n" + strings.Repeat(string(rune('a'+i)), 8+2+2)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "v.y4m"), []byte(y4m), 0644)
+
+		// every stream paces on its own clock
+		now := time.Now()
+		var audio [][]int16
+		var video []*image.YCbCr
+		p := NewMediaPlayer(nil, 0)
+		p.nowfn = func() time.Time { return now }
+		p.sleepfn = func(d time.Duration) { now = now.Add(d) }
+		p.sendAudio = func(pcm []int16, channels int, samplingRate int) error {
+			audio = append(audio, pcm)
+			return nil
+		}
+		if err := p.OpenWAV(filepath.Join(dir, "a.wav")); err != nil {
+			t.Fatal(err)
+		}
+		p.Start()
+		<-p.Done()
+		if err := p.Start(); err != nil {
+			t.Error("must start again after the end", err)
+		}
+		<-p.Done()
+		p.Stop()
+		if a, _ := p.Underruns(); a != 0 {
+			t.Error("unexpected underruns", a)
+		}
+
+		p = NewMediaPlayer(nil, 0)
+		p.nowfn = func() time.Time { return now }
+		p.sleepfn = func(d time.Duration) { now = now.Add(d) }
+		p.sendVideo = func(frame *image.YCbCr) error {
+			video = append(video, frame)
+			return nil
+		}
+		if err := p.OpenY4M(filepath.Join(dir, "v.y4m")); err != nil {
+			t.Fatal(err)
+		}
+		if p.video.interval != 100*time.Millisecond {
+			t.Error("wrong frame rate", p.video.interval)
+		}
+		p.Start()
+		<-p.Done()
+		p.Stop()
+		if _, v := p.Underruns(); v != 0 {
+			t.Error("unexpected underruns", v)
+		}
+
+		// 2.5 frames of 160 samples, the last one padded with silence
+		if len(audio) != 3 || len(audio[2]) != 160 || audio[2][79] != 399%256 || audio[2][80] != 0 {
+			t.Error("wrong audio frames", len(audio))
+		}
+		if len(video) != 3 || video[2].Y[0] != 'c' || video[2].Cr[0] != 'c' {
+			t.Error("wrong video frames", len(video))
+		}
+
+		// a late sender skips frames and reports them
+		p = NewMediaPlayer(nil, 0)
+		p.Loop = true
+		sent := 0
+		p.nowfn = func() time.Time { return now }
+		p.sleepfn = func(d time.Duration) { now = now.Add(d) }
+		p.sendAudio = func(pcm []int16, channels int, samplingRate int) error {
+			now = now.Add(50 * time.Millisecond)
+			if sent++; sent == 10 {
+				go p.Stop()
+			}
+			return nil
+		}
+		p.OpenWAV(filepath.Join(dir, "a.wav"))
+		p.Start()
+		<-p.Done()
+		if a, _ := p.Underruns(); a == 0 || sent < 10 {
+			t.Error("must report underruns", a, sent)
+		}
+
+		// a send error stops a looping player and is kept
+		p = NewMediaPlayer(nil, 0)
+		p.Loop = true
+		p.nowfn = func() time.Time { return now }
+		p.sleepfn = func(d time.Duration) { now = now.Add(d) }
+		p.sendAudio = func(pcm []int16, channels int, samplingRate int) error {
+			return toxerr("friend not in call")
+		}
+		p.OpenWAV(filepath.Join(dir, "a.wav"))
+		p.Start()
+		<-p.Done()
+		p.Stop()
+		if err := p.Err(); err == nil || !strings.Contains(err.Error(), "not in call") {
+			t.Error("must keep the send error", err)
+		}
+
+		// a huge fmt chunk is rejected before it is read
+		huge := append([]byte("RIFF\x00\x00\x00\x00WAVEfmt "), 0xff, 0xff, 0xff, 0x7f)
+		ioutil.WriteFile(filepath.Join(dir, "huge.wav"), huge, 0644)
+		if err := p.OpenWAV(filepath.Join(dir, "huge.wav")); err == nil || !strings.Contains(err.Error(), "fmt chunk size") {
+			t.Error("must reject a huge fmt chunk", err)
+		}
+	})
+	t.Run("audio frame", func(t *testing.T) {
+		for _, sc := range []int{120, 240, 480, 960, 1920, 2880} {
+			if err := validateAudioFrame(sc, 2, 48000); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := validateAudioFrame(20, 1, 8000); err != nil {
+			t.Error(err)
+		}
+		if err := validateAudioFrame(1000, 2, 48000); err == nil {
+			t.Error("must failed with 20.8 ms frame")
+		}
+		if err := validateAudioFrame(4800, 2, 48000); err == nil {
+			t.Error("must failed with 100 ms frame")
+		}
+		if err := validateAudioFrame(960, 2, 44100); err == nil {
+			t.Error("must failed with 44.1 kHz")
+		}
+		if err := validateAudioFrame(960, 3, 48000); err == nil {
+			t.Error("must failed with 3 channels")
+		}
+	})
+	t.Run("mixer", func(t *testing.T) {
+		if _, err := NewAudioMixer(nil, 48000, 2, 15*time.Millisecond); err == nil {
+			t.Error("must failed with invalid frame duration")
+		}
+		mx, err := NewAudioMixer(nil, 8000, 1, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mx.JitterDepth = 1
+
+		outs := make(map[uint32][]int16)
+		for _, fn := range []uint32{1, 2, 3} {
+			fn := fn
+			mx.addParticipant(mixerKey{mixerFriend, fn}, func(pcm []byte, sampleCount int, channels int, samplingRate int) error {
+				if sampleCount != 80 || channels != 1 || samplingRate != 8000 {
+					t.Error("wrong format", sampleCount, channels, samplingRate)
+				}
+				outs[fn] = pcmToInt16(pcm)
+				return nil
+			})
+		}
+		frame := func(v int16, n int, channels int) []byte {
+			s := make([]int16, n*channels)
+			for i := range s {
+				s[i] = v
+			}
+			return int16ToPCM(s)
+		}
+		mx.PushFriendFrame(1, frame(100, 80, 1), 80, 1, 8000)
+		mx.PushFriendFrame(2, frame(20000, 160, 2), 160, 2, 16000) // resampled to 8k mono
+		mx.PushFriendFrame(3, frame(30000, 80, 1), 80, 1, 8000)
+		mx.PushFriendFrame(4, frame(1, 80, 1), 80, 1, 8000) // unknown friend, dropped
+		mx.MixFrame()
+
+		if v := outs[1][40]; v != 32767 {
+			t.Error("must clamped", v)
+		}
+		if v := outs[2][40]; v != 30100 {
+			t.Error("must mix without own audio", v)
+		}
+		if v := outs[3][40]; v != 20100 {
+			t.Error("must mix without own audio", v)
+		}
+
+		mx.MixFrame()
+		if v := outs[1][0]; v != 0 {
+			t.Error("must silence on underrun", v)
+		}
+		if n := mx.Underruns(1); n != 1 {
+			t.Error("must one underrun", n)
+		}
+
+		mx.PushFriendFrame(3, frame(1000, 441, 1), 441, 1, 44100) // not an Opus rate, dropped
+		if n := len(mx.participants[mixerKey{mixerFriend, 3}].sources[0].jb.samples); n != 0 {
+			t.Error("must drop non Opus rates", n)
+		}
+
+		mx.AddConference(7)
+		mx.participants[mixerKey{mixerConference, 7}].send = func([]byte, int, int, int) error { return nil }
+		mx.PushConferenceFrame(7, 0, frame(100, 80, 1), 80, 1, 8000)
+		mx.PushConferenceFrame(7, 1, frame(100, 80, 1), 80, 1, 8000)
+		mx.MixFrame()
+		mx.MixFrame()
+		if n := mx.ConferenceUnderruns(7); n != 2 {
+			t.Error("must count conference underruns", n)
+		}
+		mx.ConferencePeersChanged(7)
+		if n := len(mx.participants[mixerKey{mixerConference, 7}].sources); n != 0 {
+			t.Error("must drop the peers on peer list changes", n)
+		}
+		if n := mx.ConferenceUnderruns(7); n != 2 {
+			t.Error("must keep the underruns of dropped peers", n)
+		}
+	})
+	t.Run("resampler", func(t *testing.T) {
+		ramp := make([]int16, 320)
+		for i := range ramp {
+			ramp[i] = int16(i * 10)
+		}
+		whole := newPCMResampler(1, 16000, 48000).process(ramp)
+		rs := newPCMResampler(1, 16000, 48000)
+		split := append(rs.process(ramp[:160]), rs.process(ramp[160:])...)
+		if len(split) != len(whole) {
+			t.Fatal("wrong length", len(split), len(whole))
+		}
+		for i := range whole {
+			if d := int(whole[i]) - int(split[i]); d > 1 || d < -1 {
+				t.Fatal("must be continuous across frames", i, whole[i], split[i])
+			}
+		}
+		rs = newPCMResampler(2, 48000, 16000)
+		n := 0
+		for i := 0; i < 10; i++ {
+			n += len(rs.process(make([]int16, 441*2)))
+		}
+		if n != 4410/3*2 && n != (4410/3+1)*2 {
+			t.Error("must keep the rate across frames", n)
+		}
+	})
+}
+
+func TestSaveStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "toxsave")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "profile.tox")
+
+	ss := NewSaveStore(path, nil)
+	ss.Backups = 2
+	if data, err := ss.Load(); data != nil || err != nil {
+		t.Error("must nil for new profile", data, err)
+	}
+	for _, v := range []string{"v1", "v2", "v2", "v3", "v4"} {
+		if err := ss.Save([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := map[string]string{"profile.tox": "v4", "profile.tox.1": "v3", "profile.tox.2": "v2"}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != len(expect) {
+		t.Error("wrong files", len(files))
+	}
+	for _, fi := range files {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if expect[fi.Name()] != string(data) {
+			t.Error("wrong content", fi.Name(), string(data))
+		}
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Error("must private", fi.Mode())
+	}
+
+	ss = NewSaveStore(path, nil)
+	if data, err := ss.Load(); string(data) != "v4" || err != nil {
+		t.Error("wrong load", string(data), err)
+	}
+	ss.Save([]byte("v4")) // unchanged, no rotation
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "v3" {
+		t.Error("must not save unchanged data", string(data))
+	}
+
+	// changing the passphrase rewrites the backups instead of rotating
+	if err := ss.ChangePassphrase(nil, nil); err != nil {
+		t.Error(err)
+	}
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "v3" {
+		t.Error("must keep the backups", string(data))
+	}
+
+	ss.Close()
+	if err := ss.Save([]byte("v5")); err == nil {
+		t.Error("must not save after close")
+	}
+	if _, err := ss.Load(); err == nil {
+		t.Error("must not load after close")
+	}
+	if err := ss.ChangePassphrase(nil, []byte("new")); err == nil {
+		t.Error("must not change the passphrase after close")
+	}
+}
+
+func TestBootstrapManager(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "toxnodes")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nodes.json")
+
+	keys := []string{strings.Repeat("a1", 32), strings.Repeat("b2", 32), strings.Repeat("c3", 32), strings.Repeat("d4", 32)}
+	data := `{"last_scan": 1, "nodes": [
+		{"ipv4": "10.0.0.1", "ipv6": "-", "port": 33445, "tcp_ports": [443], "public_key": "` + keys[0] + `"},
+		{"ipv4": "10.0.0.2", "ipv6": "::2", "port": 33445, "tcp_ports": [], "public_key": "` + keys[1] + `"},
+		{"ipv4": "10.0.0.3", "ipv6": "-", "port": 33445, "public_key": "` + keys[2] + `"},
+		{"ipv4": "-", "ipv6": "::4", "port": 33445, "public_key": "` + keys[3] + `"},
+		{"ipv4": "10.0.0.5", "ipv6": "-", "port": 0, "public_key": "` + keys[0] + `"},
+		{"ipv4": "10.0.0.6", "ipv6": "-", "port": 33445, "public_key": "short"}]}`
+	nodes, err := ParseBootNodes([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 4 || nodes[0].Pubkey != strings.ToUpper(keys[0]) || nodes[1].IPv6 != "::2" || nodes[3].Addr != "" {
+		t.Fatal("wrong nodes", nodes)
+	}
+
+	now := time.Unix(1000, 0)
+	bsm := NewBootstrapManager(nil, nodes, path)
+	bsm.Subset = 2
+	bsm.nowfn = func() time.Time { return now }
+	var tried []string
+	bsm.bootstrapfn = func(node *BootNode) error {
+		if node.Addr == "10.0.0.3" {
+			return toxerr("unreachable")
+		}
+		tried = append(tried, node.Pubkey)
+		return nil
+	}
+
+	t.Run("subset", func(t *testing.T) {
+		if err := bsm.Bootstrap(); err != nil {
+			t.Fatal(err)
+		}
+		if len(tried) != 2 || len(bsm.tried) != 2 {
+			t.Error("must bootstrap a subset", tried)
+		}
+	})
+
+	t.Run("online", func(t *testing.T) {
+		good := bsm.tried
+		bsm.setOnline(true)
+		for _, node := range good {
+			if node.Good != 1 || !node.LastGood.Equal(now) {
+				t.Error("must mark good", node)
+			}
+		}
+		now = now.Add(time.Hour)
+		tried = nil
+		bsm.Check()
+		if len(tried) != 0 {
+			t.Error("must not bootstrap while online", tried)
+		}
+	})
+
+	t.Run("offline backoff", func(t *testing.T) {
+		bsm.setOnline(false)
+		tried = nil
+		now = now.Add(bsm.OfflineTimeout - time.Second)
+		bsm.Check()
+		if len(tried) != 0 {
+			t.Error("must wait for the offline timeout", tried)
+		}
+		now = now.Add(time.Second)
+		bsm.Check()
+		if len(tried) != 2 {
+			t.Error("must bootstrap again", tried)
+		}
+		failed := bsm.tried
+		now = now.Add(2 * bsm.OfflineTimeout)
+		tried = nil
+		bsm.Check()
+		if len(tried) != 2 || bsm.backoff != 4*bsm.OfflineTimeout {
+			t.Error("must back off", tried, bsm.backoff)
+		}
+		for _, node := range failed {
+			if node.Fails == 0 {
+				t.Error("must mark failed", node)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			now = now.Add(bsm.MaxBackoff)
+			bsm.Check()
+		}
+		if bsm.backoff != bsm.MaxBackoff {
+			t.Error("must limit the backoff", bsm.backoff)
+		}
+	})
+
+	t.Run("persist", func(t *testing.T) {
+		bsm.setOnline(true)
+		if err := bsm.Close(); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := LoadBootNodes(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(saved) != 4 || saved[0].Fails != 0 || saved[0].Good == 0 || saved[0].LastGood.IsZero() {
+			t.Fatal("must save the good nodes first", saved)
+		}
+		for i, node := range saved {
+			if i > 0 && node.Fails < saved[i-1].Fails {
+				t.Error("must save the nodes by health", i, node)
+			}
+			if node.Addr == "10.0.0.3" && node.Fails == 0 {
+				t.Error("must save the failures", node)
+			}
+		}
+	})
+
+	if err := NewBootstrapManager(nil, nil, "").Bootstrap(); err == nil {
+		t.Error("must fail without nodes")
+	}
+
+	// a failed attempt backs off too
+	bsm = NewBootstrapManager(nil, nodes[:1], "")
+	bsm.nowfn = func() time.Time { return now }
+	attempts := 0
+	bsm.bootstrapfn = func(node *BootNode) error {
+		attempts++
+		return toxerr("unreachable")
+	}
+	if err := bsm.Bootstrap(); err == nil {
+		t.Error("must fail on all nodes")
+	}
+	bsm.Check()
+	if attempts != 1 {
+		t.Error("must wait after a failed attempt", attempts)
+	}
+	now = now.Add(bsm.OfflineTimeout)
+	bsm.Check()
+	if attempts != 2 || bsm.backoff != 2*bsm.OfflineTimeout {
+		t.Error("must retry after the backoff", attempts, bsm.backoff)
+	}
+}
+
+func TestConnMonitor(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := NewConnMonitor(nil)
+	m.nowfn = func() time.Time { return now }
+	m.Debounce = 5 * time.Second
+	var changes []ConnState
+	m.OnChange = func(m *ConnMonitor, state ConnState) { changes = append(changes, state) }
+	var fired []string
+	m.OnDisconnect(time.Minute, func() error { fired = append(fired, "tcp"); return toxerr("failed") })
+	m.OnDisconnect(10*time.Second, func() error { fired = append(fired, "bootstrap"); return nil })
+	var errs []error
+	m.OnError = func(err error) { errs = append(errs, err) }
+
+	t.Run("debounce", func(t *testing.T) {
+		m.setStatus(ConnectionUDP)
+		now = now.Add(time.Second)
+		m.setStatus(ConnectionNone)
+		now = now.Add(time.Second)
+		m.setStatus(ConnectionTCP)
+		now = now.Add(4 * time.Second)
+		m.Check()
+		if st := m.State(); st.Status != ConnectionNone || st.Raw != ConnectionTCP || st.Flaps != 1 {
+			t.Error("must not settle yet", st)
+		}
+		now = now.Add(time.Second)
+		m.Check()
+		st := m.State()
+		if st.Status != ConnectionTCP || !st.Connected() || !st.Since.Equal(now.Add(-5*time.Second)) {
+			t.Error("must settle", st)
+		}
+		if len(changes) != 1 || changes[0].Status != ConnectionTCP {
+			t.Error("must report the change", changes)
+		}
+		if m.TimeInState() != 5*time.Second {
+			t.Error("wrong time in state", m.TimeInState())
+		}
+		if len(fired) != 0 {
+			t.Error("must not run actions", fired)
+		}
+	})
+
+	t.Run("actions", func(t *testing.T) {
+		m.setStatus(ConnectionNone)
+		now = now.Add(7 * time.Second)
+		m.Check()
+		if len(fired) != 0 {
+			t.Error("must wait for the disconnection", fired)
+		}
+		now = now.Add(3 * time.Second)
+		m.Check()
+		m.Check()
+		if !reflect.DeepEqual(fired, []string{"bootstrap"}) {
+			t.Error("must run the action once", fired)
+		}
+		now = now.Add(time.Minute)
+		m.Check()
+		if !reflect.DeepEqual(fired, []string{"bootstrap", "tcp"}) || len(errs) != 1 {
+			t.Error("must run the actions in order", fired, errs)
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		fired = nil
+		m.setStatus(ConnectionUDP)
+		now = now.Add(m.Debounce)
+		m.Check()
+		m.setStatus(ConnectionNone)
+		m.Check()
+		now = now.Add(m.Debounce + 10*time.Second)
+		m.Check()
+		if !reflect.DeepEqual(fired, []string{"bootstrap"}) {
+			t.Error("must run the actions again after reconnecting", fired)
+		}
+	})
+
+	if err := m.Rebootstrap(); err == nil {
+		t.Error("must fail without a bootstrap manager")
+	}
+
+	// without a recreated instance the callers get nil instead of the killed one
+	m.Bootstrap = NewBootstrapManager(nil, nil, "")
+	var recreated []*Tox
+	m.OnRecreate = func(old *Tox, t *Tox) { recreated = append(recreated, t) }
+	m.replace(nil, nil)
+	if m.Tox() != nil || len(recreated) != 1 || recreated[0] != nil {
+		t.Error("must report the missing instance", recreated)
+	}
+	if err := m.Rebootstrap(); err == nil {
+		t.Error("must not bootstrap without an instance")
+	}
+	if err := m.SwitchTCPOnly(); err == nil {
+		t.Error("must not switch without an instance")
+	}
+}
+
+func TestOptionsBuilder(t *testing.T) {
+	sk := make([]byte, SecretKeySize)
+	opts, err := NewToxOptionsWith(WithUDP(true), WithProxy(ProxyTypeSOCKS5, "127.0.0.1", 9050),
+		WithPortRange(33445, 33455), WithTCPRelay(3389), WithSavedata(SavedataTypeSecretKey, sk), WithThreadSafe(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.UDPEnabled || int(opts.ProxyType) != ProxyTypeSOCKS5 || opts.ProxyHost != "127.0.0.1" || opts.ProxyPort != 9050 ||
+		opts.StartPort != 33445 || opts.EndPort != 33455 || opts.TCPPort != 3389 || opts.SavedataType != SavedataTypeSecretKey || !opts.ThreadSafe {
+		t.Error("wrong options", opts)
+	}
+
+	invalid := map[string]ToxOption{
+		"proxy type":    WithProxy(42, "127.0.0.1", 9050),
+		"proxy host":    WithProxy(ProxyTypeHTTP, "", 8080),
+		"proxy port":    WithProxy(ProxyTypeHTTP, "127.0.0.1", 0),
+		"port range":    WithPortRange(33455, 33445),
+		"savedata":      WithSavedata(SavedataTypeToxSave, nil),
+		"secret key":    WithSavedata(SavedataTypeSecretKey, []byte("short")),
+		"savedata type": WithSavedata(42, sk),
+	}
+	for name, option := range invalid {
+		if _, err := NewToxOptionsWith(option); err == nil {
+			t.Error("must reject invalid", name)
+		}
+	}
+
+	opts = NewToxOptions()
+	opts.ProxyType = int32(ProxyTypeHTTP)
+	if err := opts.Validate(); err == nil {
+		t.Error("must reject a proxy without host")
+	}
+	opts.ProxyHost = "proxy\x00"
+	opts.ProxyPort = 8080
+	if err := opts.Validate(); err == nil {
+		t.Error("must reject a NUL in the proxy host")
+	}
+	if _, err := NewToxWithError(opts); err == nil || NewTox(opts) != nil {
+		t.Error("must not create an instance with invalid options")
+	}
+
+	// toxcore uses a single port and swaps a reversed range, only WithPortRange is strict
+	for _, ports := range [][2]uint16{{33445, 0}, {0, 33445}, {33455, 33445}} {
+		opts = NewToxOptions()
+		opts.StartPort, opts.EndPort = ports[0], ports[1]
+		if err := opts.Validate(); err != nil {
+			t.Error("must accept the port range", ports, err)
+		}
+	}
+	opts = NewToxOptions()
+	opts.SavedataType = SavedataTypeToxSave
+	if err := opts.Validate(); err != nil {
+		t.Error("must accept empty savedata", err)
+	}
+}
+
+func TestToxConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "toxconfig")
+	defer os.RemoveAll(dir)
+	key := strings.Repeat("AB", 32)
+	ioutil.WriteFile(filepath.Join(dir, "nodes.json"), []byte(`{"nodes": [
+		{"ipv4": "10.0.0.1", "ipv6": "-", "port": 33445, "public_key": "`+key+`"}]}`), 0644)
+
+	toml := `# deployment
+udp_enabled = false # behind a proxy
+proxy_type = "socks5"
+proxy_host = "127.0.0.1"
+proxy_port = 9_050
+nodes_file = 'nodes.json'
+
+[[nodes]]
+ipv4 = "tox.example.org"
+port = 33445
+tcp_ports = [
+	443,
+	3389, # rdp
+]
+public_key = "` + key + `"
+`
+	json := `{"udp_enabled": false, "proxy_type": "socks5", "proxy_host": "127.0.0.1", "proxy_port": 9050,
+		"nodes_file": "nodes.json",
+		"nodes": [{"ipv4": "tox.example.org", "port": 33445, "tcp_ports": [443, 3389], "public_key": "` + key + `"}]}`
+	for name, data := range map[string]string{"tox.toml": toml, "tox.json": json} {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join(dir, name)
+			ioutil.WriteFile(fname, []byte(data), 0644)
+			cfg, err := LoadToxConfig(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := cfg.ToxOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.UDPEnabled || int(opts.ProxyType) != ProxyTypeSOCKS5 || opts.ProxyHost != "127.0.0.1" || opts.ProxyPort != 9050 {
+				t.Error("wrong options", opts)
+			}
+			nodes, err := cfg.BootNodes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nodes) != 2 || nodes[0].Addr != "10.0.0.1" || nodes[1].Addr != "tox.example.org" ||
+				!reflect.DeepEqual(nodes[1].TCPPorts, []int{443, 3389}) {
+				t.Error("wrong nodes", nodes)
+			}
+		})
+	}
+
+	t.Run("env", func(t *testing.T) {
+		os.Setenv("TOXTEST_UDP_ENABLED", "true")
+		os.Setenv("TOXTEST_TCP_PORT", "3389")
+		os.Setenv("TOXTEST_NODES", "10.0.0.2:33445:"+key+", [::1]:33446:"+key)
+		defer os.Unsetenv("TOXTEST_UDP_ENABLED")
+		defer os.Unsetenv("TOXTEST_TCP_PORT")
+		defer os.Unsetenv("TOXTEST_NODES")
+		cfg := NewToxConfig()
+		if err := cfg.LoadEnv("TOXTEST_"); err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.UDPEnabled || cfg.TCPPort != 3389 {
+			t.Error("wrong config", cfg)
+		}
+		nodes, err := cfg.BootNodes()
+		if err != nil || len(nodes) != 2 || nodes[0].Addr != "10.0.0.2" || nodes[1].IPv6 != "::1" || nodes[1].Port != 33446 {
+			t.Error("wrong nodes", nodes, err)
+		}
+
+		os.Setenv("TOXTEST_TCP_PORT", "x")
+		if err := cfg.LoadEnv("TOXTEST_"); err == nil {
+			t.Error("must reject a bad port")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, data := range []string{"udp = true", "udp_enabled = yes", "proxy_port = \"x", "tcp_ports = [1, 2", "= 1",
+			"udp_enabled = true\nudp_enabled = false"} {
+			if err := NewToxConfig().ParseTOML([]byte(data)); err == nil {
+				t.Error("must reject", data)
+			}
+		}
+		for _, data := range []string{`{"udp": true}`, `{"udp_enabled": "yes"}`, `{"proxy_port": "x"}`,
+			`{"nodes": [{"port": [1, 2]}]}`, `{`} {
+			if err := NewToxConfig().ParseJSON([]byte(data)); err == nil {
+				t.Error("must reject", data)
+			}
+		}
+		cfg := NewToxConfig()
+		cfg.ProxyType = "tor"
+		if _, err := cfg.ToxOptions(); err == nil {
+			t.Error("must reject an unknown proxy type")
+		}
+		cfg = NewToxConfig()
+		cfg.TCPPort = 70000
+		if _, err := cfg.ToxOptions(); err == nil {
+			t.Error("must reject an invalid port")
+		}
+	})
+}
+
+type mapKV map[string][]byte
+
+func (this mapKV) Get(key []byte) ([]byte, error)     { return this[string(key)], nil }
+func (this mapKV) Put(key []byte, value []byte) error { this[string(key)] = value; return nil }
+func (this mapKV) Delete(key []byte) error            { delete(this, string(key)); return nil }
+func (this mapKV) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	for k := range this {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, []byte(k))
+		}
+	}
+	return keys, nil
+}
+
+func TestSavedataBackend(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "toxbackend")
+	defer os.RemoveAll(dir)
+	dirb, err := NewDirBackend(filepath.Join(dir, "profiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := mapKV{"other/x": []byte("x")}
+	backends := map[string]SavedataBackend{
+		"dir":    dirb,
+		"memory": NewMemoryBackend(),
+		"kv":     NewKVBackend(kv, "tox/"),
+	}
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			if data, err := b.Load("bot1"); data != nil || err != nil {
+				t.Error("must nil for new profile", data, err)
+			}
+			b.Save("bot2", []byte("two"))
+			b.Save("bot1", []byte("one"))
+			b.Save("bot1", []byte("uno"))
+			if data, err := b.Load("bot1"); string(data) != "uno" || err != nil {
+				t.Error("wrong load", string(data), err)
+			}
+			if names, _ := b.List(); !reflect.DeepEqual(names, []string{"bot1", "bot2"}) {
+				t.Error("wrong list", names)
+			}
+			if err := b.Delete("bot2"); err != nil {
+				t.Error(err)
+			}
+			if names, _ := b.List(); !reflect.DeepEqual(names, []string{"bot1"}) {
+				t.Error("wrong list after delete", names)
+			}
+			if err := b.Save("", []byte("x")); err == nil {
+				t.Error("must reject empty name")
+			}
+		})
+	}
+	if err := dirb.Save("../escape", []byte("x")); err == nil {
+		t.Error("must reject path in name")
+	}
+
+	fb := NewFileBackend(filepath.Join(dir, "echo.tox"))
+	if names, _ := fb.List(); len(names) != 0 {
+		t.Error("must empty", names)
+	}
+	if err := fb.Save("echo", []byte("e")); err != nil {
+		t.Error(err)
+	}
+	if names, _ := fb.List(); !reflect.DeepEqual(names, []string{"echo"}) {
+		t.Error("wrong list", names)
+	}
+	if _, err := fb.Load("other"); err == nil {
+		t.Error("must reject other profile")
+	}
+}
+
+func TestSavedataParser(t *testing.T) {
+	_t := NewTox(nil)
+	defer _t.Kill()
+	_t.SelfSetName("parser")
+	_t.SelfSetStatusMessage("offline edit")
+	_t.SelfSetNospam(0x11223344)
+	friend := NewTox(nil)
+	defer friend.Kill()
+	fn, _ := _t.FriendAddNorequest(friend.SelfGetPublicKey())
+
+	data := _t.GetSavedata()
+	sd, err := savedata.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sd.Bytes()) != string(data) {
+		t.Fatal("round trip differs")
+	}
+	keys, _ := sd.Keys()
+	if keys.Address() != _t.SelfGetAddress() || keys.Nospam != _t.SelfGetNospam() {
+		t.Error("wrong keys", keys.Address(), _t.SelfGetAddress())
+	}
+	if sd.Name() != "parser" || sd.StatusMessage() != "offline edit" {
+		t.Error("wrong self info", sd.Name(), sd.StatusMessage())
+	}
+	friends, err := sd.Friends()
+	if err != nil || len(friends) < 1 {
+		t.Fatal("wrong friends", len(friends), err)
+	}
+	pubkey, _ := _t.FriendGetPublicKey(fn)
+	if strings.ToUpper(hex.EncodeToString(friends[fn].PublicKey[:])) != pubkey {
+		t.Error("wrong friend key")
+	}
+
+	// every section encodes back to the bytes toxcore wrote
+	sd.SetKeys(keys)
+	sd.SetFriends(friends)
+	if nodes, err := sd.DHTNodes(); err == nil {
+		sd.SetDHTNodes(nodes)
+	}
+	if string(sd.Bytes()) != string(data) {
+		t.Error("re-encoded sections differ")
+	}
+
+	// an offline edit loads into toxcore
+	sd.SetName("edited")
+	opts := NewToxOptions()
+	opts.SavedataData = sd.Bytes()
+	opts.SavedataType = SavedataTypeToxSave
+	_t2 := NewTox(opts)
+	defer _t2.Kill()
+	if _t2.SelfGetName() != "edited" || _t2.SelfGetAddress() != _t.SelfGetAddress() {
+		t.Error("edit not loaded", _t2.SelfGetName())
+	}
+}
+
+func TestEncryptSave(t *testing.T) {
+	_t := NewTox(nil)
+	plain := _t.GetSavedata()
+	_t.Kill()
+
+	t.Run("change passphrase", func(t *testing.T) {
+		enc, err := PassEncrypt(plain, []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldpass, newpass := []byte("old"), []byte("new")
+		enc2, err := ChangePassphrase(enc, oldpass, newpass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(oldpass) != "\x00\x00\x00" || string(newpass) != "\x00\x00\x00" {
+			t.Error("passphrases must be zeroed")
+		}
+		if dec, err := PassDecrypt(enc2, []byte("new")); err != nil || string(dec) != string(plain) {
+			t.Error("must decrypt with new passphrase", err)
+		}
+		if _, err := PassDecrypt(enc2, []byte("old")); err == nil {
+			t.Error("must not decrypt with old passphrase")
+		}
+		if _, err := ChangePassphrase(enc, []byte("wrong"), []byte("new")); err == nil {
+			t.Error("must fail with wrong passphrase")
+		}
+	})
+	t.Run("profile", func(t *testing.T) {
+		p, err := CreateEncryptedProfile(plain, []byte("pass"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Locked() {
+			t.Error("new profile must be unlocked")
+		}
+		if _, err := p.Save(plain); err != nil {
+			t.Error(err)
+		}
+		p.Lock()
+		if _, err := p.Save(plain); err == nil || !p.Locked() {
+			t.Error("locked profile must not save")
+		}
+		if _, err := p.Unlock([]byte("wrong")); err == nil {
+			t.Error("must fail with wrong passphrase")
+		}
+		if dec, err := p.Unlock([]byte("pass")); err != nil || string(dec) != string(plain) {
+			t.Error("must unlock", err)
+		}
+		if err := p.ChangePassphrase([]byte("pass"), []byte("word")); err != nil {
+			t.Fatal(err)
+		}
+		p2, _ := NewEncryptedProfile(p.Data())
+		if dec, err := p2.Unlock([]byte("word")); err != nil || string(dec) != string(plain) {
+			t.Error("must unlock with new passphrase", err)
+		}
+		p.Lock()
+		p2.Lock()
+	})
+	t.Run("free", func(t *testing.T) {
+		key, err := Derive([]byte("pass"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.Free()
+		key.Free()
+		var nokey *ToxPassKey
+		nokey.Free()
+		if _, err := Derive(nil); err == nil {
+			t.Error("must reject empty passphrase")
+		}
+	})
+	t.Run("short data", func(t *testing.T) {
+		for _, n := range []int{0, 8, PASS_ENCRYPTION_EXTRA_LENGTH - 1} {
+			if _, err := NewEncryptedProfile(make([]byte, n)); err == nil {
+				t.Error("must reject short data", n)
+			}
+			if _, err := ChangePassphrase(make([]byte, n), []byte("old"), []byte("new")); err == nil {
+				t.Error("must reject short data", n)
+			}
+		}
+		key, err := Derive([]byte("pass"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer key.Free()
+		if _, err, _ := key.Decrypt(make([]byte, PASS_ENCRYPTION_EXTRA_LENGTH)); err == nil {
+			t.Error("must reject ciphertext without plaintext")
+		}
+	})
+}
+
+func TestEncryptStream(t *testing.T) {
+	// a reversible stand-in for the pass key with the same overhead, to check the chunk framing
+	prefix := "sealed" + strings.Repeat(".", PASS_ENCRYPTION_EXTRA_LENGTH-6)
+	seal := func(p []byte) ([]byte, error) {
+		c := append([]byte(prefix), p...)
+		for i := len(prefix); i < len(c); i++ {
+			c[i] ^= 0x5a
+		}
+		return c, nil
+	}
+	open := func(c []byte) ([]byte, error) {
+		if !strings.HasPrefix(string(c), prefix) {
+			return nil, fmt.Errorf("bad seal")
+		}
+		p := append([]byte{}, c[len(prefix):]...)
+		for i := range p {
+			p[i] ^= 0x5a
+		}
+		return p, nil
+	}
+	encrypt := func(payload []byte, chunkSize int) []byte {
+		var out bytes.Buffer
+		w, err := NewEncryptWriterSize(&out, nil, chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.sealfn = seal
+		for len(payload) > 0 { // odd write sizes
+			n := 7
+			if n > len(payload) {
+				n = len(payload)
+			}
+			w.Write(payload[:n])
+			payload = payload[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+	decrypt := func(data []byte) ([]byte, error) {
+		r := &DecryptReader{r: bytes.NewReader(data), openfn: open}
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	payload := []byte(strings.Repeat("chat history line\n", 100))
+	data := encrypt(payload, 100)
+	if dec, err := decrypt(data); err != nil || string(dec) != string(payload) {
+		t.Fatal("wrong round trip", err)
+	}
+	if dec, err := decrypt(encrypt(nil, 100)); err != nil || len(dec) != 0 {
+		t.Error("wrong empty stream", err)
+	}
+
+	hdr := len(streamMagic) + 1 + streamIDSize
+	chunk := 4 + PASS_ENCRYPTION_EXTRA_LENGTH + streamChunkHeader + 100
+	if _, err := decrypt(data[:hdr+3*chunk]); err == nil {
+		t.Error("must detect truncation")
+	}
+	swapped := append([]byte{}, data[:hdr]...)
+	swapped = append(swapped, data[hdr+chunk:hdr+2*chunk]...)
+	swapped = append(swapped, data[hdr:hdr+chunk]...)
+	swapped = append(swapped, data[hdr+2*chunk:]...)
+	if _, err := decrypt(swapped); err == nil {
+		t.Error("must detect reordered chunks")
+	}
+	other := encrypt(payload, 100)
+	spliced := append(append([]byte{}, data[:hdr+chunk]...), other[hdr+chunk:]...)
+	if _, err := decrypt(spliced); err == nil {
+		t.Error("must detect chunks of another stream")
+	}
+	if _, err := decrypt(append(append([]byte{}, data...), 0)); err == nil {
+		t.Error("must detect trailing data")
+	}
+	for _, size := range []int{0, PASS_ENCRYPTION_EXTRA_LENGTH, PASS_ENCRYPTION_EXTRA_LENGTH + streamChunkHeader - 1} {
+		short := append([]byte{}, data[:hdr]...)
+		short = append(short, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+		short = append(short, make([]byte, size)...)
+		if _, err := decrypt(short); err == nil || !strings.Contains(err.Error(), "too short") {
+			t.Error("must reject a short chunk", size, err)
+		}
+	}
+
+	t.Run("pass key", func(t *testing.T) {
+		key, err := Derive([]byte("pass"))
+		if err != nil {
+			t.Skip(err)
+		}
+		defer key.Free()
+		var out bytes.Buffer
+		w, _ := NewEncryptWriter(&out, key)
+		w.Write(payload)
+		w.Close()
+		r, err := NewDecryptReader(&out, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec, err := ioutil.ReadAll(r); err != nil || string(dec) != string(payload) {
+			t.Error("wrong round trip", err)
+		}
+	})
 }
 
 // go test -v -run File
@@ -878,7 +2181,7 @@ func TestFile(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		_, err = t1.t.FileControl(friendNumber, fileNumber, FILE_CONTROL_RESUME)
+		_, err = t1.t.FileControl(friendNumber, fileNumber, FileControlResume)
 		if err != nil {
 			t.Error(err)
 		}
@@ -911,7 +2214,7 @@ func TestFile(t *testing.T) {
 	t2.t.CallbackFileRecvControl(func(_ *Tox, friendNumber uint32, fileNumber uint32,
 		control int, ud interface{}) {
 		// log.Println(fileNumber, control)
-		if control == FILE_CONTROL_CANCEL {
+		if control == FileControlCancel {
 			sendRecvDone = true
 		}
 	}, nil)
@@ -934,16 +2237,16 @@ func TestFile(t *testing.T) {
 	// must wait friend online and can call InviteFriend
 	waitcond(func() bool {
 		st, _ := t2.t.FriendGetConnectionStatus(fn)
-		return st > CONNECTION_NONE
+		return st > ConnectionNone
 	}, 100)
 
-	fh, err := t2.t.FileSend(fn, FILE_KIND_DATA, 12345, "123456", "testfile.txt")
+	fh, err := t2.t.FileSend(fn, FileKindData, 12345, "123456", "testfile.txt")
 	if err != nil {
 		t.Error(err, fh)
 	}
 	fid, err := t2.t.FileGetFileId(fn, fh)
-	if len(fid) != FILE_ID_LENGTH*2 {
-		t.Error("file id length not match:", len(fid), FILE_ID_LENGTH*2)
+	if len(fid) != FileIDLength*2 {
+		t.Error("file id length not match:", len(fid), FileIDLength*2)
 	}
 
 	waitcond(func() bool {
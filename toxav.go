@@ -43,6 +43,18 @@ typedef void (*cb_video_receive_frame_ftype)(ToxAV *toxAV, uint32_t friendNumber
 static void cb_video_receive_frame_wrapper_for_go(ToxAV *m, cb_video_receive_frame_ftype fn, void *userdata)
 { toxav_callback_video_receive_frame(m, fn, userdata); }
 
+void callbackConferenceAudioReceiveFrameWrapperForC(void *tox, uint32_t groupNumber, uint32_t peerNumber,
+        int16_t *pcm, unsigned int samples, uint8_t channels, uint32_t sample_rate, void *user_data);
+typedef void (*cb_conference_audio_receive_frame_ftype)(void *tox, uint32_t groupNumber, uint32_t peerNumber,
+        const int16_t *pcm, unsigned int samples, uint8_t channels, uint32_t sample_rate, void *user_data);
+static int cb_add_av_groupchat_wrapper_for_go(Tox *m, cb_conference_audio_receive_frame_ftype fn, void *userdata)
+{ return toxav_add_av_groupchat(m, fn, userdata); }
+static int cb_join_av_groupchat_wrapper_for_go(Tox *m, uint32_t friendNumber, const uint8_t *data, uint16_t length,
+        cb_conference_audio_receive_frame_ftype fn, void *userdata)
+{ return toxav_join_av_groupchat(m, friendNumber, data, length, fn, userdata); }
+static int cb_groupchat_enable_av_wrapper_for_go(Tox *m, uint32_t groupNumber, cb_conference_audio_receive_frame_ftype fn, void *userdata)
+{ return toxav_groupchat_enable_av(m, groupNumber, fn, userdata); }
+
 extern void i420_to_rgb(int width, int height, const uint8_t *y, const uint8_t *u, const uint8_t *v,
             int ystride, int ustride, int vstride, unsigned char *out);
 extern void rgb_to_i420(unsigned char* rgb, vpx_image_t *img);
@@ -56,6 +68,9 @@ static inline __attribute__((__unused__)) void fixnousetoxav() {
     cb_video_bit_rate_wrapper_for_go(NULL, NULL, NULL);
     cb_audio_receive_frame_wrapper_for_go(NULL, NULL, NULL);
     cb_video_receive_frame_wrapper_for_go(NULL, NULL, NULL);
+    cb_add_av_groupchat_wrapper_for_go(NULL, NULL, NULL);
+    cb_join_av_groupchat_wrapper_for_go(NULL, 0, NULL, 0, NULL, NULL);
+    cb_groupchat_enable_av_wrapper_for_go(NULL, 0, NULL, NULL);
 }
 
 */
@@ -63,6 +78,9 @@ import "C"
 import (
 	"encoding/hex"
 	"errors"
+	"image"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -71,33 +89,42 @@ type cb_call_state_ftype func(this *ToxAV, friendNumber uint32, state uint32, us
 type cb_audio_bit_rate_ftype func(this *ToxAV, friendNumber uint32, audioBitRate uint32, userData interface{})
 type cb_video_bit_rate_ftype func(this *ToxAV, friendNumber uint32, videoBitRate uint32, userData interface{})
 type cb_audio_receive_frame_ftype func(this *ToxAV, friendNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int, userData interface{})
+type cb_audio_receive_frame_int16_ftype func(this *ToxAV, friendNumber uint32, pcm []int16, channels int, samplingRate int, userData interface{})
 type cb_video_receive_frame_ftype func(this *ToxAV, friendNumber uint32, width uint16, height uint16, data []byte, userData interface{})
+type cb_video_receive_frame_yuv_ftype func(this *ToxAV, friendNumber uint32, frame *image.YCbCr, userData interface{})
+type cb_video_receive_image_ftype func(this *ToxAV, friendNumber uint32, frame image.Image, userData interface{})
 
 type ToxAV struct {
 	tox   *Tox
 	toxav *C.ToxAV
 
 	// session datas
-	out_image  []byte
-	out_width  C.uint16_t
-	out_hegith C.uint16_t
-	in_image   *C.vpx_image_t
-	in_width   C.uint16_t
-	in_height  C.uint16_t
+	in_image  *C.vpx_image_t
+	in_width  C.uint16_t
+	in_height C.uint16_t
+	in_yuv    []byte
+
+	// call sessions
+	calls_mu     sync.Mutex
+	calls        map[uint32]*Call
+	call_timeout time.Duration
 
 	// callbacks
-	cb_call                          cb_call_ftype
-	cb_call_user_data                interface{}
-	cb_call_state                    cb_call_state_ftype
-	cb_call_state_user_data          interface{}
-	cb_audio_bit_rate                cb_audio_bit_rate_ftype
-	cb_audio_bit_rate_user_data      interface{}
-	cb_video_bit_rate                cb_video_bit_rate_ftype
-	cb_video_bit_rate_user_data      interface{}
-	cb_audio_receive_frame           cb_audio_receive_frame_ftype
-	cb_audio_receive_frame_user_data interface{}
-	cb_video_receive_frame           cb_video_receive_frame_ftype
-	cb_video_receive_frame_user_data interface{}
+	cb_calls                      map[unsafe.Pointer]interface{}
+	cb_call_states                map[unsafe.Pointer]interface{}
+	cb_audio_bit_rates            map[unsafe.Pointer]interface{}
+	cb_video_bit_rates            map[unsafe.Pointer]interface{}
+	cb_audio_receive_frames       map[unsafe.Pointer]interface{}
+	cb_audio_receive_frame_int16s map[unsafe.Pointer]interface{}
+	cb_video_receive_frames       map[unsafe.Pointer]interface{}
+	cb_video_receive_frame_yuvs   map[unsafe.Pointer]interface{}
+	cb_video_receive_images       map[unsafe.Pointer]interface{}
+	cb_call_transitions           map[unsafe.Pointer]interface{}
+
+	// events come from both tox_iterate and toxav_iterate, run by Iterate
+	cbevts_mu sync.Mutex
+	cbevts    []func()
+	yuv_pool  sync.Pool
 }
 
 func NewToxAV(tox *Tox) (*ToxAV, error) {
@@ -107,6 +134,17 @@ func NewToxAV(tox *Tox) (*ToxAV, error) {
 
 	tav := new(ToxAV)
 	tav.tox = tox
+	tav.calls = make(map[uint32]*Call)
+	tav.cb_calls = make(map[unsafe.Pointer]interface{})
+	tav.cb_call_states = make(map[unsafe.Pointer]interface{})
+	tav.cb_audio_bit_rates = make(map[unsafe.Pointer]interface{})
+	tav.cb_video_bit_rates = make(map[unsafe.Pointer]interface{})
+	tav.cb_audio_receive_frames = make(map[unsafe.Pointer]interface{})
+	tav.cb_audio_receive_frame_int16s = make(map[unsafe.Pointer]interface{})
+	tav.cb_video_receive_frames = make(map[unsafe.Pointer]interface{})
+	tav.cb_video_receive_frame_yuvs = make(map[unsafe.Pointer]interface{})
+	tav.cb_video_receive_images = make(map[unsafe.Pointer]interface{})
+	tav.cb_call_transitions = make(map[unsafe.Pointer]interface{})
 
 	var cerr C.TOXAV_ERR_NEW
 	tav.toxav = C.toxav_new(tox.toxcore, &cerr)
@@ -130,8 +168,28 @@ func (this *ToxAV) IterationInterval() int {
 	return int(C.toxav_iteration_interval(this.toxav))
 }
 
+// Iterate runs toxav_iterate, then the handlers of the events collected since the last Iterate.
+//
+// Like with Tox, handlers never run inside toxcore callbacks. Call events are raised by Tox.Iterate
+// and delivered by the next ToxAV.Iterate.
 func (this *ToxAV) Iterate() {
 	C.toxav_iterate(this.toxav)
+	this.callCheckTimeouts()
+
+	this.cbevts_mu.Lock()
+	cbevts := this.cbevts
+	this.cbevts = nil
+	this.cbevts_mu.Unlock()
+
+	for _, cbfn := range cbevts {
+		cbfn()
+	}
+}
+
+func (this *ToxAV) putcbevts(f func()) {
+	this.cbevts_mu.Lock()
+	this.cbevts = append(this.cbevts, f)
+	this.cbevts_mu.Unlock()
 }
 
 func (this *ToxAV) Call(friendNumber uint32, audioBitRate uint32, videoBitRate uint32) (bool, error) {
@@ -140,6 +198,7 @@ func (this *ToxAV) Call(friendNumber uint32, audioBitRate uint32, videoBitRate u
 	if cerr != 0 {
 		return bool(r), toxerr(cerr)
 	}
+	this.callNew(friendNumber, CallStateRingingOut, audioBitRate > 0, videoBitRate > 0)
 	return bool(r), nil
 }
 
@@ -148,14 +207,23 @@ var cbAVUserDatas = newUserDataAV()
 //export callbackCallWrapperForC
 func callbackCallWrapperForC(m *C.ToxAV, friendNumber C.uint32_t, audioEnabled C.bool, videoEnabled C.bool, a3 unsafe.Pointer) {
 	var this = cbAVUserDatas.get(m)
-	if this.cb_call != nil {
-		this.cb_call(this, uint32(friendNumber), bool(audioEnabled), bool(videoEnabled), this.cb_call_user_data)
+	this.callNew(uint32(friendNumber), CallStateRingingIn, bool(audioEnabled), bool(videoEnabled))
+	for cbfni, ud := range this.cb_calls {
+		cbfn := *(*cb_call_ftype)(cbfni)
+		this.putcbevts(func() { cbfn(this, uint32(friendNumber), bool(audioEnabled), bool(videoEnabled), ud) })
 	}
 }
 
 func (this *ToxAV) CallbackCall(cbfn cb_call_ftype, userData interface{}) {
-	this.cb_call = cbfn
-	this.cb_call_user_data = userData
+	this.callbackCallAdd(cbfn, userData)
+}
+
+func (this *ToxAV) callbackCallAdd(cbfn cb_call_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_calls[cbfnp]; ok {
+		return
+	}
+	this.cb_calls[cbfnp] = userData
 
 	var _cbfn = (C.cb_call_ftype)(C.callbackCallWrapperForC)
 	var _userData = unsafe.Pointer(this)
@@ -170,6 +238,7 @@ func (this *ToxAV) Answer(friendNumber uint32, audioBitRate uint32, videoBitRate
 	if cerr != C.TOXAV_ERR_ANSWER_OK {
 		return false, toxerr(cerr)
 	}
+	this.callAnswered(friendNumber)
 
 	return bool(r), nil
 }
@@ -177,14 +246,23 @@ func (this *ToxAV) Answer(friendNumber uint32, audioBitRate uint32, videoBitRate
 //export callbackCallStateWrapperForC
 func callbackCallStateWrapperForC(m *C.ToxAV, friendNumber C.uint32_t, state C.uint32_t, a3 unsafe.Pointer) {
 	var this = cbAVUserDatas.get(m)
-	if this.cb_call_state != nil {
-		this.cb_call_state(this, uint32(friendNumber), uint32(state), this.cb_call_state_user_data)
+	this.callUpdateState(uint32(friendNumber), uint32(state))
+	for cbfni, ud := range this.cb_call_states {
+		cbfn := *(*cb_call_state_ftype)(cbfni)
+		this.putcbevts(func() { cbfn(this, uint32(friendNumber), uint32(state), ud) })
 	}
 }
 
 func (this *ToxAV) CallbackCallState(cbfn cb_call_state_ftype, userData interface{}) {
-	this.cb_call_state = cbfn
-	this.cb_call_state_user_data = userData
+	this.callbackCallStateAdd(cbfn, userData)
+}
+
+func (this *ToxAV) callbackCallStateAdd(cbfn cb_call_state_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_call_states[cbfnp]; ok {
+		return
+	}
+	this.cb_call_states[cbfnp] = userData
 
 	var _cbfn = (C.cb_call_state_ftype)(C.callbackCallStateWrapperForC)
 	var _userData = unsafe.Pointer(this)
@@ -199,6 +277,7 @@ func (this *ToxAV) CallControl(friendNumber uint32, control int) (bool, error) {
 	if cerr != C.TOXAV_ERR_CALL_CONTROL_OK {
 		return bool(r), toxerr(cerr)
 	}
+	this.callControlled(friendNumber, control)
 	return bool(r), nil
 }
 
@@ -223,14 +302,22 @@ func (this *ToxAV) VideoSetBitRate(friendNumber uint32, videoBitRate uint32) (bo
 //export callbackAudioBitRateWrapperForC
 func callbackAudioBitRateWrapperForC(m *C.ToxAV, friendNumber C.uint32_t, audioBitRate C.uint32_t, a3 unsafe.Pointer) {
 	var this = cbAVUserDatas.get(m)
-	if this.cb_audio_bit_rate != nil {
-		this.cb_audio_bit_rate(this, uint32(friendNumber), uint32(audioBitRate), this.cb_call_state_user_data)
+	for cbfni, ud := range this.cb_audio_bit_rates {
+		cbfn := *(*cb_audio_bit_rate_ftype)(cbfni)
+		this.putcbevts(func() { cbfn(this, uint32(friendNumber), uint32(audioBitRate), ud) })
 	}
 }
 
 func (this *ToxAV) CallbackAudioBitRate(cbfn cb_audio_bit_rate_ftype, userData interface{}) {
-	this.cb_audio_bit_rate = cbfn
-	this.cb_audio_bit_rate_user_data = userData
+	this.callbackAudioBitRateAdd(cbfn, userData)
+}
+
+func (this *ToxAV) callbackAudioBitRateAdd(cbfn cb_audio_bit_rate_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_audio_bit_rates[cbfnp]; ok {
+		return
+	}
+	this.cb_audio_bit_rates[cbfnp] = userData
 
 	var _cbfn = (C.cb_audio_bit_rate_ftype)(C.callbackAudioBitRateWrapperForC)
 	var _userData = unsafe.Pointer(this)
@@ -242,14 +329,22 @@ func (this *ToxAV) CallbackAudioBitRate(cbfn cb_audio_bit_rate_ftype, userData i
 //export callbackVideoBitRateWrapperForC
 func callbackVideoBitRateWrapperForC(m *C.ToxAV, friendNumber C.uint32_t, videoBitRate C.uint32_t, a3 unsafe.Pointer) {
 	var this = cbAVUserDatas.get(m)
-	if this.cb_video_bit_rate != nil {
-		this.cb_video_bit_rate(this, uint32(friendNumber), uint32(videoBitRate), this.cb_call_state_user_data)
+	for cbfni, ud := range this.cb_video_bit_rates {
+		cbfn := *(*cb_video_bit_rate_ftype)(cbfni)
+		this.putcbevts(func() { cbfn(this, uint32(friendNumber), uint32(videoBitRate), ud) })
 	}
 }
 
 func (this *ToxAV) CallbackVideoBitRate(cbfn cb_video_bit_rate_ftype, userData interface{}) {
-	this.cb_video_bit_rate = cbfn
-	this.cb_video_bit_rate_user_data = userData
+	this.callbackVideoBitRateAdd(cbfn, userData)
+}
+
+func (this *ToxAV) callbackVideoBitRateAdd(cbfn cb_video_bit_rate_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_video_bit_rates[cbfnp]; ok {
+		return
+	}
+	this.cb_video_bit_rates[cbfnp] = userData
 
 	var _cbfn = (C.cb_video_bit_rate_ftype)(C.callbackVideoBitRateWrapperForC)
 	var _userData = unsafe.Pointer(this)
@@ -259,15 +354,90 @@ func (this *ToxAV) CallbackVideoBitRate(cbfn cb_video_bit_rate_ftype, userData i
 }
 
 func (this *ToxAV) AudioSendFrame(friendNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int) (bool, error) {
+	if err := validateAudioFrame(sampleCount, channels, samplingRate); err != nil {
+		return false, err
+	}
+	if len(pcm) < sampleCount*channels*2 {
+		return false, toxerrf("Invalid pcm length: %d bytes, want %d for %d samples of %d channels",
+			len(pcm), sampleCount*channels*2, sampleCount, channels)
+	}
+
 	pcm_ := (*C.int16_t)(unsafe.Pointer(&pcm[0]))
 	var cerr C.TOXAV_ERR_SEND_FRAME
 	r := C.toxav_audio_send_frame(this.toxav, C.uint32_t(friendNumber), pcm_, C.size_t(sampleCount), C.uint8_t(channels), C.uint32_t(samplingRate), &cerr)
 	if cerr != C.TOXAV_ERR_SEND_FRAME_OK {
-		return false, toxerr(cerr)
+		return false, sendFrameError(friendNumber, cerr)
+	}
+	return bool(r), nil
+}
+
+// AudioSendFrameInt16 sends an audio frame of interleaved samples, len(pcm)/channels samples per channel.
+//
+// The frame must be 2.5, 5, 10, 20, 40 or 60 ms long at samplingRate, as required by Opus.
+func (this *ToxAV) AudioSendFrameInt16(friendNumber uint32, pcm []int16, channels int, samplingRate int) (bool, error) {
+	if channels != 1 && channels != 2 {
+		return false, toxerrf("Invalid channels: %d, want 1 or 2", channels)
+	}
+	if len(pcm)%channels != 0 {
+		return false, toxerrf("Invalid pcm length: %d samples is not a multiple of %d channels", len(pcm), channels)
+	}
+	sampleCount := len(pcm) / channels
+	if err := validateAudioFrame(sampleCount, channels, samplingRate); err != nil {
+		return false, err
+	}
+
+	pcm_ := (*C.int16_t)(unsafe.Pointer(&pcm[0]))
+	var cerr C.TOXAV_ERR_SEND_FRAME
+	r := C.toxav_audio_send_frame(this.toxav, C.uint32_t(friendNumber), pcm_, C.size_t(sampleCount), C.uint8_t(channels), C.uint32_t(samplingRate), &cerr)
+	if cerr != C.TOXAV_ERR_SEND_FRAME_OK {
+		return false, sendFrameError(friendNumber, cerr)
 	}
 	return bool(r), nil
 }
 
+// validateAudioFrame checks the frame format against what the Opus encoder of toxav accepts.
+func validateAudioFrame(sampleCount int, channels int, samplingRate int) error {
+	if channels != 1 && channels != 2 {
+		return toxerrf("Invalid channels: %d, want 1 or 2", channels)
+	}
+	switch samplingRate {
+	case 8000, 12000, 16000, 24000, 48000:
+	default:
+		return toxerrf("Invalid sampling rate: %d, want 8000, 12000, 16000, 24000 or 48000", samplingRate)
+	}
+	// frame duration in units of 0.1 ms
+	if sampleCount <= 0 || sampleCount*10000%samplingRate != 0 {
+		return toxerrf("Invalid sample count: %d is not a valid Opus frame at %d Hz", sampleCount, samplingRate)
+	}
+	switch sampleCount * 10000 / samplingRate {
+	case 25, 50, 100, 200, 400, 600:
+	default:
+		return toxerrf("Invalid sample count: %d is %.1f ms at %d Hz, want 2.5, 5, 10, 20, 40 or 60 ms",
+			sampleCount, float64(sampleCount)*1000/float64(samplingRate), samplingRate)
+	}
+	return nil
+}
+
+func sendFrameError(friendNumber uint32, cerr C.TOXAV_ERR_SEND_FRAME) error {
+	switch cerr {
+	case C.TOXAV_ERR_SEND_FRAME_NULL:
+		return toxerr("send frame: no frame data")
+	case C.TOXAV_ERR_SEND_FRAME_FRIEND_NOT_FOUND:
+		return toxerrf("send frame: friend %d not found", friendNumber)
+	case C.TOXAV_ERR_SEND_FRAME_FRIEND_NOT_IN_CALL:
+		return toxerrf("send frame: friend %d is not in a call", friendNumber)
+	case C.TOXAV_ERR_SEND_FRAME_SYNC:
+		return toxerr("send frame: failed to acquire toxav lock")
+	case C.TOXAV_ERR_SEND_FRAME_INVALID:
+		return toxerr("send frame: invalid frame format")
+	case C.TOXAV_ERR_SEND_FRAME_PAYLOAD_TYPE_DISABLED:
+		return toxerrf("send frame: bit rate for this payload type is 0 or disabled by friend %d", friendNumber)
+	case C.TOXAV_ERR_SEND_FRAME_RTP_FAILED:
+		return toxerr("send frame: failed to push frame through rtp")
+	}
+	return toxerr(cerr)
+}
+
 func (this *ToxAV) VideoSendFrame(friendNumber uint32, width uint16, height uint16, data []byte) (bool, error) {
 	if this.in_image != nil && (uint16(this.in_width) != width || uint16(this.in_height) != height) {
 		C.vpx_img_free(this.in_image)
@@ -289,7 +459,57 @@ func (this *ToxAV) VideoSendFrame(friendNumber uint32, width uint16, height uint
 		(*C.uint8_t)(this.in_image.planes[2]),
 		&cerr)
 	if cerr != C.TOXAV_ERR_SEND_FRAME_OK {
-		return false, toxerr(cerr)
+		return false, sendFrameError(friendNumber, cerr)
+	}
+	return bool(r), nil
+}
+
+// VideoSendFrameYUV sends an I420 frame without converting it from RGB.
+//
+// frame must use 4:2:0 chroma subsampling. When its planes are tightly packed they are passed to toxav as is,
+// otherwise they are packed into a buffer which is reused between calls.
+func (this *ToxAV) VideoSendFrameYUV(friendNumber uint32, frame *image.YCbCr) (bool, error) {
+	if frame == nil || frame.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return false, toxerr("Invalid frame, need 4:2:0 subsampling")
+	}
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+	if width <= 0 || height <= 0 || width > 0xffff || height > 0xffff {
+		return false, toxerrf("Invalid frame size: %dx%d", width, height)
+	}
+	cw, ch := (width+1)/2, (height+1)/2
+
+	var y, u, v []byte
+	yoff, coff := frame.YOffset(frame.Rect.Min.X, frame.Rect.Min.Y), frame.COffset(frame.Rect.Min.X, frame.Rect.Min.Y)
+	if frame.YStride < width || frame.CStride < cw || yoff < 0 || coff < 0 ||
+		len(frame.Y) < yoff+(height-1)*frame.YStride+width ||
+		len(frame.Cb) < coff+(ch-1)*frame.CStride+cw || len(frame.Cr) < coff+(ch-1)*frame.CStride+cw {
+		return false, toxerr("Invalid frame, planes too short")
+	}
+	if frame.YStride == width && frame.CStride == cw {
+		y, u, v = frame.Y[yoff:], frame.Cb[coff:], frame.Cr[coff:]
+	} else {
+		ysize, csize := width*height, cw*ch
+		if len(this.in_yuv) != ysize+2*csize {
+			this.in_yuv = make([]byte, ysize+2*csize)
+		}
+		y, u, v = this.in_yuv[:ysize], this.in_yuv[ysize:ysize+csize], this.in_yuv[ysize+csize:]
+		for row := 0; row < height; row++ {
+			copy(y[row*width:(row+1)*width], frame.Y[yoff+row*frame.YStride:])
+		}
+		for row := 0; row < ch; row++ {
+			copy(u[row*cw:(row+1)*cw], frame.Cb[coff+row*frame.CStride:])
+			copy(v[row*cw:(row+1)*cw], frame.Cr[coff+row*frame.CStride:])
+		}
+	}
+
+	var cerr C.TOXAV_ERR_SEND_FRAME
+	r := C.toxav_video_send_frame(this.toxav, C.uint32_t(friendNumber), C.uint16_t(width), C.uint16_t(height),
+		(*C.uint8_t)(unsafe.Pointer(&y[0])),
+		(*C.uint8_t)(unsafe.Pointer(&u[0])),
+		(*C.uint8_t)(unsafe.Pointer(&v[0])),
+		&cerr)
+	if cerr != C.TOXAV_ERR_SEND_FRAME_OK {
+		return false, sendFrameError(friendNumber, cerr)
 	}
 	return bool(r), nil
 }
@@ -297,17 +517,52 @@ func (this *ToxAV) VideoSendFrame(friendNumber uint32, width uint16, height uint
 //export callbackAudioReceiveFrameWrapperForC
 func callbackAudioReceiveFrameWrapperForC(m *C.ToxAV, friendNumber C.uint32_t, pcm *C.int16_t, sampleCount C.size_t, channels C.uint8_t, samplingRate C.uint32_t, a3 unsafe.Pointer) {
 	var this = cbAVUserDatas.get(m)
-	if this.cb_audio_receive_frame != nil {
+	for cbfni, ud := range this.cb_audio_receive_frames {
 		length := sampleCount * C.size_t(channels) * 2
-		pcm_p := unsafe.Pointer(pcm)
-		pcm_b := C.GoBytes(pcm_p, C.int(length))
-		this.cb_audio_receive_frame(this, uint32(friendNumber), pcm_b, int(sampleCount), int(channels), int(samplingRate), this.cb_audio_receive_frame_user_data)
+		pcm_b := C.GoBytes(unsafe.Pointer(pcm), C.int(length))
+		cbfn := *(*cb_audio_receive_frame_ftype)(cbfni)
+		this.putcbevts(func() {
+			cbfn(this, uint32(friendNumber), pcm_b, int(sampleCount), int(channels), int(samplingRate), ud)
+		})
+	}
+	for cbfni, ud := range this.cb_audio_receive_frame_int16s {
+		length := int(sampleCount) * int(channels)
+		pcm_s := make([]int16, length)
+		if length > 0 {
+			copy(pcm_s, (*[1 << 28]int16)(unsafe.Pointer(pcm))[:length:length])
+		}
+		cbfn := *(*cb_audio_receive_frame_int16_ftype)(cbfni)
+		this.putcbevts(func() { cbfn(this, uint32(friendNumber), pcm_s, int(channels), int(samplingRate), ud) })
 	}
 }
 
 func (this *ToxAV) CallbackAudioReceiveFrame(cbfn cb_audio_receive_frame_ftype, userData interface{}) {
-	this.cb_audio_receive_frame = cbfn
-	this.cb_audio_receive_frame_user_data = userData
+	this.callbackAudioReceiveFrameAdd(cbfn, userData)
+}
+
+func (this *ToxAV) callbackAudioReceiveFrameAdd(cbfn cb_audio_receive_frame_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_audio_receive_frames[cbfnp]; ok {
+		return
+	}
+	this.cb_audio_receive_frames[cbfnp] = userData
+
+	var _cbfn = (C.cb_audio_receive_frame_ftype)(C.callbackAudioReceiveFrameWrapperForC)
+	var _userData = unsafe.Pointer(this)
+	_userData = nil
+
+	C.cb_audio_receive_frame_wrapper_for_go(this.toxav, _cbfn, _userData)
+}
+
+// CallbackAudioReceiveFrameInt16 sets event handler which gets received audio frames as interleaved samples.
+//
+// It can be used together with CallbackAudioReceiveFrame.
+func (this *ToxAV) CallbackAudioReceiveFrameInt16(cbfn cb_audio_receive_frame_int16_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_audio_receive_frame_int16s[cbfnp]; ok {
+		return
+	}
+	this.cb_audio_receive_frame_int16s[cbfnp] = userData
 
 	var _cbfn = (C.cb_audio_receive_frame_ftype)(C.callbackAudioReceiveFrameWrapperForC)
 	var _userData = unsafe.Pointer(this)
@@ -319,31 +574,87 @@ func (this *ToxAV) CallbackAudioReceiveFrame(cbfn cb_audio_receive_frame_ftype,
 //export callbackVideoReceiveFrameWrapperForC
 func callbackVideoReceiveFrameWrapperForC(m *C.ToxAV, friendNumber C.uint32_t, width C.uint16_t, height C.uint16_t, y *C.uint8_t, u *C.uint8_t, v *C.uint8_t, ystride C.int32_t, ustride C.int32_t, vstride C.int32_t, a3 unsafe.Pointer) {
 	var this = cbAVUserDatas.get(m)
-	if this.cb_video_receive_frame != nil {
-
-		if this.out_image != nil && (this.out_width != width || this.out_hegith != height) {
-			this.out_image = nil
+	if len(this.cb_video_receive_frame_yuvs) > 0 || len(this.cb_video_receive_images) > 0 {
+		// the planes are only valid in this callback, handlers get a pooled copy
+		frame := this.getYUVFrame(int(width), int(height))
+		copyYCbCrInto(frame, wrapI420(int(width), int(height), unsafe.Pointer(y), unsafe.Pointer(u), unsafe.Pointer(v),
+			int(ystride), int(ustride), int(vstride)))
+		for cbfni, ud := range this.cb_video_receive_frame_yuvs {
+			cbfn := *(*cb_video_receive_frame_yuv_ftype)(cbfni)
+			this.putcbevts(func() { cbfn(this, uint32(friendNumber), frame, ud) })
 		}
+		for cbfni, ud := range this.cb_video_receive_images {
+			cbfn := *(*cb_video_receive_image_ftype)(cbfni)
+			this.putcbevts(func() { cbfn(this, uint32(friendNumber), frame, ud) })
+		}
+		this.putcbevts(func() { this.yuv_pool.Put(frame) })
+	}
+	for cbfni, ud := range this.cb_video_receive_frames {
+		buf_size := int(width) * int(height) * 3
+		out_image := make([]byte, buf_size, buf_size)
+		out := unsafe.Pointer(&(out_image[0]))
+		C.i420_to_rgb(C.int(width), C.int(height), y, u, v, C.int(ystride), C.int(ustride), C.int(vstride), (*C.uchar)(out))
 
-		var buf_size int = int(width) * int(height) * 3
+		cbfn := *(*cb_video_receive_frame_ftype)(cbfni)
+		this.putcbevts(func() { cbfn(this, uint32(friendNumber), uint16(width), uint16(height), out_image, ud) })
+	}
+}
 
-		if this.out_image == nil {
-			this.out_width = width
-			this.out_hegith = height
-			this.out_image = make([]byte, buf_size, buf_size)
-		}
+// CallbackVideoReceiveFrame sets event handler which gets the received video frame converted to RGB.
+//
+// Every handler gets its own frame buffer, which is safe to keep.
+func (this *ToxAV) CallbackVideoReceiveFrame(cbfn cb_video_receive_frame_ftype, userData interface{}) {
+	this.callbackVideoReceiveFrameAdd(cbfn, userData)
+}
 
-		out := unsafe.Pointer(&(this.out_image[0]))
-		C.i420_to_rgb(C.int(width), C.int(height), y, u, v, C.int(ystride), C.int(ustride), C.int(vstride), (*C.uchar)(out))
+func (this *ToxAV) callbackVideoReceiveFrameAdd(cbfn cb_video_receive_frame_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_video_receive_frames[cbfnp]; ok {
+		return
+	}
+	this.cb_video_receive_frames[cbfnp] = userData
 
-		this.cb_video_receive_frame(this, uint32(friendNumber), uint16(width), uint16(height), this.out_image, this.cb_video_receive_frame_user_data)
+	var _cbfn = (C.cb_video_receive_frame_ftype)(C.callbackVideoReceiveFrameWrapperForC)
+	var _userData = unsafe.Pointer(this)
+	_userData = nil
+
+	C.cb_video_receive_frame_wrapper_for_go(this.toxav, _cbfn, _userData)
+}
 
+// CallbackVideoReceiveFrameYUV sets event handler which gets the received video frame as I420 planes, without converting it to RGB.
+//
+// The frame is taken from a pool and reused once all handlers of the frame ran, copy it to keep it.
+// It can be used together with CallbackVideoReceiveFrame, the RGB conversion only happens when that handler is set.
+func (this *ToxAV) CallbackVideoReceiveFrameYUV(cbfn cb_video_receive_frame_yuv_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_video_receive_frame_yuvs[cbfnp]; ok {
+		return
 	}
+	this.cb_video_receive_frame_yuvs[cbfnp] = userData
+
+	var _cbfn = (C.cb_video_receive_frame_ftype)(C.callbackVideoReceiveFrameWrapperForC)
+	var _userData = unsafe.Pointer(this)
+	_userData = nil
+
+	C.cb_video_receive_frame_wrapper_for_go(this.toxav, _cbfn, _userData)
 }
 
-func (this *ToxAV) CallbackVideoReceiveFrame(cbfn cb_video_receive_frame_ftype, userData interface{}) {
-	this.cb_video_receive_frame = cbfn
-	this.cb_video_receive_frame_user_data = userData
+// CallbackVideoReceiveImage sets event handler which gets the received video frame as an image.Image.
+//
+// The frame is an *image.YCbCr. Without retain it is reused once all handlers of the frame ran,
+// with retain the handler gets its own copy which is safe to keep.
+func (this *ToxAV) CallbackVideoReceiveImage(cbfn cb_video_receive_image_ftype, retain bool, userData interface{}) {
+	if retain {
+		cbfn_ := cbfn
+		cbfn = func(this *ToxAV, friendNumber uint32, frame image.Image, userData interface{}) {
+			cbfn_(this, friendNumber, copyYCbCr(frame.(*image.YCbCr)), userData)
+		}
+	}
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_video_receive_images[cbfnp]; ok {
+		return
+	}
+	this.cb_video_receive_images[cbfnp] = userData
 
 	var _cbfn = (C.cb_video_receive_frame_ftype)(C.callbackVideoReceiveFrameWrapperForC)
 	var _userData = unsafe.Pointer(this)
@@ -352,19 +663,100 @@ func (this *ToxAV) CallbackVideoReceiveFrame(cbfn cb_video_receive_frame_ftype,
 	C.cb_video_receive_frame_wrapper_for_go(this.toxav, _cbfn, _userData)
 }
 
-// TODO
-// toxav_add_av_groupchat
-// toxav_join_av_groupchat
-// toxav_group_send_audio
+func (this *ToxAV) getYUVFrame(width int, height int) *image.YCbCr {
+	if frame, ok := this.yuv_pool.Get().(*image.YCbCr); ok && frame.Rect.Dx() == width && frame.Rect.Dy() == height {
+		return frame
+	}
+	return image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+}
+
+// wrapI420 builds an image.YCbCr on top of the planes toxav passed to the video receive handler.
+// toxav may use negative strides for bottom-up frames, image.YCbCr can not, so these are copied.
+func wrapI420(width int, height int, y, u, v unsafe.Pointer, ystride, ustride, vstride int) *image.YCbCr {
+	cw, ch := (width+1)/2, (height+1)/2
+	if ystride < 0 || ustride < 0 || vstride < 0 || ustride != vstride {
+		frame := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+		copyPlane(frame.Y, frame.YStride, y, ystride, width, height)
+		copyPlane(frame.Cb, frame.CStride, u, ustride, cw, ch)
+		copyPlane(frame.Cr, frame.CStride, v, vstride, cw, ch)
+		return frame
+	}
+
+	ylen := ystride*(height-1) + width
+	clen := ustride*(ch-1) + cw
+	return &image.YCbCr{
+		Y:              (*[1 << 30]byte)(y)[:ylen:ylen],
+		Cb:             (*[1 << 30]byte)(u)[:clen:clen],
+		Cr:             (*[1 << 30]byte)(v)[:clen:clen],
+		YStride:        ystride,
+		CStride:        ustride,
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, width, height),
+	}
+}
+
+func copyPlane(dst []byte, dstStride int, src unsafe.Pointer, srcStride int, width int, height int) {
+	for row := 0; row < height; row++ {
+		p := unsafe.Pointer(uintptr(src) + uintptr(row*srcStride))
+		copy(dst[row*dstStride:row*dstStride+width], (*[1 << 30]byte)(p)[:width:width])
+	}
+}
+
+// conference audio callback type
+type cb_conference_audio_receive_frame_ftype func(this *Tox, groupNumber uint32, peerNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int, userData interface{})
+
+//export callbackConferenceAudioReceiveFrameWrapperForC
+func callbackConferenceAudioReceiveFrameWrapperForC(m unsafe.Pointer, groupNumber C.uint32_t, peerNumber C.uint32_t,
+	pcm *C.int16_t, sampleCount C.uint, channels C.uint8_t, samplingRate C.uint32_t, a3 unsafe.Pointer) {
+	var this = cbUserDatas.get((*C.Tox)(m))
+	if this == nil {
+		return
+	}
+	for cbfni, ud := range this.cb_conference_audio_receive_frames {
+		cbfn := *(*cb_conference_audio_receive_frame_ftype)(cbfni)
+		length := C.size_t(sampleCount) * C.size_t(channels) * 2
+		pcm_b := C.GoBytes(unsafe.Pointer(pcm), C.int(length))
+		this.putcbevts(func() {
+			cbfn(this, uint32(groupNumber), uint32(peerNumber), pcm_b, int(sampleCount), int(channels), int(samplingRate), ud)
+		})
+	}
+}
+
+// CallbackConferenceAudioReceiveFrame sets event handler which is triggered when an audio frame is received from a peer in an AV conference.
+//
+// The handler applies to every AV conference created by AddAVGroupChat, joined by JoinAVGroupChat or re-enabled by EnableAVGroupChat.
+func (this *Tox) CallbackConferenceAudioReceiveFrame(cbfn cb_conference_audio_receive_frame_ftype, userData interface{}) {
+	this.CallbackConferenceAudioReceiveFrameAdd(cbfn, userData)
+}
+func (this *Tox) CallbackConferenceAudioReceiveFrameAdd(cbfn cb_conference_audio_receive_frame_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_conference_audio_receive_frames[cbfnp]; ok {
+		return
+	}
+	this.cb_conference_audio_receive_frames[cbfnp] = userData
+}
 
+// AddAVGroupChat creates a new AV conference and returns its conference number, or -1 on failure.
 func (this *Tox) AddAVGroupChat() int {
-	r := C.toxav_add_av_groupchat(this.toxcore, nil, nil)
+	this.lock()
+	defer this.unlock()
+
+	var _cbfn = (C.cb_conference_audio_receive_frame_ftype)(C.callbackConferenceAudioReceiveFrameWrapperForC)
+	r := C.cb_add_av_groupchat_wrapper_for_go(this.toxcore, _cbfn, nil)
+	if int(r) == -1 {
+		return int(r)
+	}
+
+	if this.hooks.ConferenceNew != nil {
+		this.hooks.ConferenceNew(uint32(r))
+	}
 	return int(r)
 }
 
+// JoinAVGroupChat joins an AV conference that the friend invited us to, using the cookie received through the conference invite handler.
 func (this *Tox) JoinAVGroupChat(friendNumber uint32, cookie string) (int, error) {
 	data, err := hex.DecodeString(cookie)
-	if err != nil {
+	if err != nil || len(data) == 0 {
 		return 0, errors.New("Invalid cookie:" + cookie)
 	}
 	var _fn = C.uint32_t(friendNumber)
@@ -372,8 +764,10 @@ func (this *Tox) JoinAVGroupChat(friendNumber uint32, cookie string) (int, error
 	var length = len(data)
 	var _length = C.uint16_t(length)
 
-	// TODO nil => real
-	r := C.toxav_join_av_groupchat(this.toxcore, _fn, _data, _length, nil, nil)
+	this.lock()
+	var _cbfn = (C.cb_conference_audio_receive_frame_ftype)(C.callbackConferenceAudioReceiveFrameWrapperForC)
+	r := C.cb_join_av_groupchat_wrapper_for_go(this.toxcore, _fn, _data, _length, _cbfn, nil)
+	this.unlock()
 	if int(r) == -1 {
 		return int(r), errors.New("Join av group chat failed")
 	}
@@ -383,3 +777,64 @@ func (this *Tox) JoinAVGroupChat(friendNumber uint32, cookie string) (int, error
 	}
 	return int(r), nil
 }
+
+// GroupSendAudio sends an audio frame to all peers of an AV conference.
+//
+// The pcm data is an array of interleaved signed 16 bit samples, sampleCount samples per channel.
+func (this *Tox) GroupSendAudio(groupNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int) error {
+	if err := validateAudioFrame(sampleCount, channels, samplingRate); err != nil {
+		return err
+	}
+	if len(pcm) < sampleCount*channels*2 {
+		return toxerrf("Invalid pcm length: %d, want %d", len(pcm), sampleCount*channels*2)
+	}
+
+	this.lock()
+	defer this.unlock()
+
+	pcm_ := (*C.int16_t)(unsafe.Pointer(&pcm[0]))
+	r := C.toxav_group_send_audio(this.toxcore, C.uint32_t(groupNumber), pcm_, C.uint(sampleCount), C.uint8_t(channels), C.uint32_t(samplingRate))
+	if int(r) != 0 {
+		return toxerrf("group send audio failed: %d", r)
+	}
+	return nil
+}
+
+// EnableAVGroupChat enables audio on an AV conference which was disabled with DisableAVGroupChat.
+//
+// toxcore does not support audio on text conferences: the type of a conference is fixed when it is
+// created, and toxav_groupchat_enable_av fails on conferences not created by AddAVGroupChat or
+// JoinAVGroupChat. Enabling audio on a text conference returns an error, create an AV conference instead.
+func (this *Tox) EnableAVGroupChat(groupNumber uint32) error {
+	this.lock()
+	defer this.unlock()
+
+	if typ := C.tox_conference_get_type(this.toxcore, C.uint32_t(groupNumber), nil); int(typ) != int(ConferenceTypeAV) {
+		return toxerrf("enable av group chat failed: %d is not an AV conference", groupNumber)
+	}
+
+	var _cbfn = (C.cb_conference_audio_receive_frame_ftype)(C.callbackConferenceAudioReceiveFrameWrapperForC)
+	r := C.cb_groupchat_enable_av_wrapper_for_go(this.toxcore, C.uint32_t(groupNumber), _cbfn, nil)
+	if int(r) != 0 {
+		return toxerrf("enable av group chat failed: %d", groupNumber)
+	}
+	return nil
+}
+
+// DisableAVGroupChat disables audio on an AV conference. The conference itself stays joined.
+func (this *Tox) DisableAVGroupChat(groupNumber uint32) error {
+	this.lock()
+	defer this.unlock()
+
+	r := C.toxav_groupchat_disable_av(this.toxcore, C.uint32_t(groupNumber))
+	if int(r) != 0 {
+		return toxerrf("disable av group chat failed: %d", groupNumber)
+	}
+	return nil
+}
+
+// IsAVGroupChatEnabled returns whether audio is currently enabled on the conference.
+func (this *Tox) IsAVGroupChatEnabled(groupNumber uint32) bool {
+	r := C.toxav_groupchat_av_enabled(this.toxcore, C.uint32_t(groupNumber))
+	return bool(r)
+}
@@ -0,0 +1,349 @@
+package tox
+
+import (
+	"image"
+	"log"
+	"sync"
+	"time"
+)
+
+// BitRateController adapts the audio and video bit rates of calls to network conditions.
+//
+// It is fed with send results, the bit rates suggested by toxav and the arrival of
+// received frames, and on every Update lowers the bit rate of a congested call or
+// raises it again after it was stable for a while, always within the configured bounds.
+// Rates only move when the failure ratio leaves the band between UpRatio and DownRatio,
+// and not more often than every HoldTime, so they do not flap.
+type BitRateController struct {
+	av *ToxAV
+
+	AudioMin, AudioMax uint32 // kbit/s
+	VideoMin, VideoMax uint32 // kbit/s
+
+	// StepDown and StepUp are the factors applied to the bit rate when lowering and raising it.
+	StepDown float64
+	StepUp   float64
+	// DownRatio is the send failure ratio above which the bit rate is lowered.
+	DownRatio float64
+	// UpRatio is the send failure ratio below which the bit rate may be raised.
+	UpRatio float64
+	// HoldTime is the minimum time between two changes of the same bit rate.
+	HoldTime time.Duration
+	// StableTime is how long a call must be free of congestion before its bit rate is raised.
+	StableTime time.Duration
+	// ReceiveGap is the time without received frames after which the call counts as congested,
+	// once a frame was reported with ReportReceive.
+	ReceiveGap time.Duration
+
+	mu      sync.Mutex
+	friends map[uint32]*bitRateFriend
+	setfn   func(friendNumber uint32, video bool, bitRate uint32) error
+	stopch  chan struct{}
+}
+
+type bitRateStream struct {
+	rate       uint32
+	sends      int
+	failures   int
+	lastRecv   time.Time
+	lastChange time.Time
+	lastBad    time.Time
+}
+
+type bitRateFriend struct {
+	audio bitRateStream
+	video bitRateStream
+}
+
+// NewBitRateController creates a controller with bounds in kbit/s. A zero max disables adaption of that stream.
+func NewBitRateController(av *ToxAV, audioMin, audioMax, videoMin, videoMax uint32) (*BitRateController, error) {
+	if audioMin > audioMax || videoMin > videoMax {
+		return nil, toxerrf("Invalid bounds: audio %d-%d, video %d-%d", audioMin, audioMax, videoMin, videoMax)
+	}
+
+	this := &BitRateController{}
+	this.av = av
+	this.AudioMin, this.AudioMax = audioMin, audioMax
+	this.VideoMin, this.VideoMax = videoMin, videoMax
+	this.StepDown = 0.75
+	this.StepUp = 1.1
+	this.DownRatio = 0.1
+	this.UpRatio = 0.01
+	this.HoldTime = 2 * time.Second
+	this.StableTime = 10 * time.Second
+	this.ReceiveGap = time.Second
+	this.friends = make(map[uint32]*bitRateFriend)
+	this.setfn = func(friendNumber uint32, video bool, bitRate uint32) error {
+		var err error
+		if video {
+			_, err = this.av.VideoSetBitRate(friendNumber, bitRate)
+		} else {
+			_, err = this.av.AudioSetBitRate(friendNumber, bitRate)
+		}
+		return err
+	}
+	return this, nil
+}
+
+// AddFriend starts controlling the call with the friend, which currently uses the given bit rates.
+func (this *BitRateController) AddFriend(friendNumber uint32, audioBitRate uint32, videoBitRate uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	f := &bitRateFriend{}
+	f.audio = bitRateStream{rate: audioBitRate, lastChange: now, lastBad: now}
+	f.video = bitRateStream{rate: videoBitRate, lastChange: now, lastBad: now}
+	this.friends[friendNumber] = f
+}
+
+// RemoveFriend stops controlling the call with the friend.
+func (this *BitRateController) RemoveFriend(friendNumber uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.friends, friendNumber)
+}
+
+// BitRates returns the current bit rates of the call with the friend.
+func (this *BitRateController) BitRates(friendNumber uint32) (audio uint32, video uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if f, ok := this.friends[friendNumber]; ok {
+		return f.audio.rate, f.video.rate
+	}
+	return 0, 0
+}
+
+func (this *BitRateController) stream(friendNumber uint32, video bool) *bitRateStream {
+	f, ok := this.friends[friendNumber]
+	if !ok {
+		return nil
+	}
+	if video {
+		return &f.video
+	}
+	return &f.audio
+}
+
+// ReportSend records the result of an AudioSendFrame or VideoSendFrame call.
+func (this *BitRateController) ReportSend(friendNumber uint32, video bool, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if s := this.stream(friendNumber, video); s != nil {
+		s.sends++
+		if err != nil {
+			s.failures++
+		}
+	}
+}
+
+// ReportReceive records that a frame was received from the friend.
+func (this *BitRateController) ReportReceive(friendNumber uint32, video bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if s := this.stream(friendNumber, video); s != nil {
+		s.lastRecv = time.Now()
+	}
+}
+
+// Suggest applies a bit rate suggested by toxav, within the bounds and the hold time.
+func (this *BitRateController) Suggest(friendNumber uint32, video bool, bitRate uint32) {
+	this.mu.Lock()
+	s := this.stream(friendNumber, video)
+	if s == nil || time.Since(s.lastChange) < this.HoldTime {
+		this.mu.Unlock()
+		return
+	}
+	min, max := this.bounds(video)
+	rate := clampBitRate(bitRate, min, max)
+	changed := rate != s.rate
+	c := bitRateChange{friendNumber, video, s.rate, rate}
+	if changed {
+		if rate < s.rate {
+			s.lastBad = time.Now()
+		}
+		s.rate = rate
+		s.lastChange = time.Now()
+	}
+	this.mu.Unlock()
+
+	if changed {
+		this.apply(c)
+	}
+}
+
+// AudioSendFrame sends the frame with ToxAV.AudioSendFrame and reports the result.
+func (this *BitRateController) AudioSendFrame(friendNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int) (bool, error) {
+	r, err := this.av.AudioSendFrame(friendNumber, pcm, sampleCount, channels, samplingRate)
+	this.ReportSend(friendNumber, false, err)
+	return r, err
+}
+
+// VideoSendFrame sends the frame with ToxAV.VideoSendFrame and reports the result.
+func (this *BitRateController) VideoSendFrame(friendNumber uint32, width uint16, height uint16, data []byte) (bool, error) {
+	r, err := this.av.VideoSendFrame(friendNumber, width, height, data)
+	this.ReportSend(friendNumber, true, err)
+	return r, err
+}
+
+// Attach adds the controller as bit rate handler of the ToxAV instance, to receive the suggested bit rates,
+// and as audio and video receive handler, to follow the arrival of received frames.
+func (this *BitRateController) Attach() {
+	this.av.CallbackAudioReceiveFrame(func(_ *ToxAV, friendNumber uint32, _ []byte, _ int, _ int, _ int, _ interface{}) {
+		this.ReportReceive(friendNumber, false)
+	}, nil)
+	// the YUV handler gets a pooled frame, the RGB one would convert every frame just to count it
+	this.av.CallbackVideoReceiveFrameYUV(func(_ *ToxAV, friendNumber uint32, _ *image.YCbCr, _ interface{}) {
+		this.ReportReceive(friendNumber, true)
+	}, nil)
+	this.av.CallbackAudioBitRate(func(_ *ToxAV, friendNumber uint32, audioBitRate uint32, _ interface{}) {
+		this.Suggest(friendNumber, false, audioBitRate)
+	}, nil)
+	this.av.CallbackVideoBitRate(func(_ *ToxAV, friendNumber uint32, videoBitRate uint32, _ interface{}) {
+		this.Suggest(friendNumber, true, videoBitRate)
+	}, nil)
+}
+
+// Update evaluates the reports collected since the last Update and adjusts the bit rates.
+func (this *BitRateController) Update() {
+	this.update(time.Now())
+}
+
+type bitRateChange struct {
+	friendNumber uint32
+	video        bool
+	prev         uint32
+	rate         uint32
+}
+
+// apply sets the changed bit rate, and goes back to the previous one if toxav refuses it.
+func (this *BitRateController) apply(c bitRateChange) {
+	err := this.setfn(c.friendNumber, c.video, c.rate)
+	if err == nil {
+		return
+	}
+	if toxdebug {
+		log.Println("set bit rate failed:", c.friendNumber, c.video, c.rate, err)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if s := this.stream(c.friendNumber, c.video); s != nil && s.rate == c.rate {
+		s.rate = c.prev
+	}
+}
+
+func (this *BitRateController) update(now time.Time) {
+	this.mu.Lock()
+	var changes []bitRateChange
+	for fn, f := range this.friends {
+		if prev, rate, ok := this.evaluate(&f.audio, false, now); ok {
+			changes = append(changes, bitRateChange{fn, false, prev, rate})
+		}
+		if prev, rate, ok := this.evaluate(&f.video, true, now); ok {
+			changes = append(changes, bitRateChange{fn, true, prev, rate})
+		}
+	}
+	this.mu.Unlock()
+
+	for _, c := range changes {
+		this.apply(c)
+	}
+}
+
+// evaluate returns the previous and the new bit rate if the stream needs a change.
+func (this *BitRateController) evaluate(s *bitRateStream, video bool, now time.Time) (uint32, uint32, bool) {
+	min, max := this.bounds(video)
+	sends, failures := s.sends, s.failures
+	s.sends, s.failures = 0, 0
+	if max == 0 || s.rate == 0 {
+		return 0, 0, false // stream disabled
+	}
+
+	var ratio float64
+	if sends > 0 {
+		ratio = float64(failures) / float64(sends)
+	}
+	congested := ratio > this.DownRatio ||
+		(this.ReceiveGap > 0 && !s.lastRecv.IsZero() && now.Sub(s.lastRecv) > this.ReceiveGap)
+	if congested || ratio >= this.UpRatio {
+		s.lastBad = now
+	}
+	if now.Sub(s.lastChange) < this.HoldTime {
+		return 0, 0, false
+	}
+
+	rate := s.rate
+	if congested {
+		rate = clampBitRate(uint32(float64(s.rate)*this.StepDown), min, max)
+	} else if now.Sub(s.lastBad) >= this.StableTime {
+		up := uint32(float64(s.rate) * this.StepUp)
+		if up == s.rate {
+			up++
+		}
+		rate = clampBitRate(up, min, max)
+	}
+	if rate == s.rate {
+		return 0, 0, false
+	}
+	prev := s.rate
+	s.rate = rate
+	s.lastChange = now
+	return prev, rate, true
+}
+
+func (this *BitRateController) bounds(video bool) (uint32, uint32) {
+	if video {
+		return this.VideoMin, this.VideoMax
+	}
+	return this.AudioMin, this.AudioMax
+}
+
+// Run calls Update every interval until Stop is called.
+func (this *BitRateController) Run(interval time.Duration) {
+	this.mu.Lock()
+	if this.stopch != nil {
+		this.mu.Unlock()
+		return
+	}
+	stopch := make(chan struct{})
+	this.stopch = stopch
+	this.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				this.Update()
+			case <-stopch:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the loop started by Run.
+func (this *BitRateController) Stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.stopch != nil {
+		close(this.stopch)
+		this.stopch = nil
+	}
+}
+
+func clampBitRate(rate uint32, min uint32, max uint32) uint32 {
+	if rate < min {
+		return min
+	}
+	if rate > max {
+		return max
+	}
+	return rate
+}
@@ -0,0 +1,336 @@
+package tox
+
+import (
+	"time"
+	"unsafe"
+)
+
+// CallState is the state of a call session with a friend.
+type CallState int
+
+const (
+	// The session was just created and did not ring yet. It is the from state of the first transition.
+	CallStateNew CallState = iota
+	// We called the friend, who did not answer yet.
+	CallStateRingingOut
+	// The friend called us, we did not answer yet.
+	CallStateRingingIn
+	// The call is answered and not paused.
+	CallStateActive
+	// The call was paused by us or by the friend.
+	CallStateHeld
+	// The call was hung up, rejected or timed out. This is a final state.
+	CallStateEnded
+	// The call failed on the remote end or the friend timed out. This is a final state.
+	CallStateError
+)
+
+func (this CallState) String() string {
+	switch this {
+	case CallStateNew:
+		return "new"
+	case CallStateRingingOut:
+		return "ringing-out"
+	case CallStateRingingIn:
+		return "ringing-in"
+	case CallStateActive:
+		return "active"
+	case CallStateHeld:
+		return "held"
+	case CallStateEnded:
+		return "ended"
+	case CallStateError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// CallFlags are the decoded capabilities of the friend, from the FriendCallState* bit mask.
+type CallFlags struct {
+	SendingAudio   bool
+	SendingVideo   bool
+	AcceptingAudio bool
+	AcceptingVideo bool
+}
+
+func decodeCallFlags(state uint32) CallFlags {
+	return CallFlags{
+		SendingAudio:   state&uint32(FriendCallStateSendingAudio) != 0,
+		SendingVideo:   state&uint32(FriendCallStateSendingVideo) != 0,
+		AcceptingAudio: state&uint32(FriendCallStateAcceptingAudio) != 0,
+		AcceptingVideo: state&uint32(FriendCallStateAcceptingVideo) != 0,
+	}
+}
+
+func (this CallFlags) any() bool {
+	return this.SendingAudio || this.SendingVideo || this.AcceptingAudio || this.AcceptingVideo
+}
+
+type cb_call_transition_ftype func(this *ToxAV, call *Call, from CallState, to CallState, userData interface{})
+
+// Call is the call session with one friend. It is created by StartCall or by
+// an incoming call, and dropped from the ToxAV once it reaches a final state.
+type Call struct {
+	av           *ToxAV
+	FriendNumber uint32
+
+	state        CallState
+	flags        CallFlags
+	audioEnabled bool // offered by the caller on incoming calls
+	videoEnabled bool
+	pausedByUs   bool
+	pausedByPeer bool
+	created      time.Time
+}
+
+// State returns the current state of the call.
+func (this *Call) State() CallState {
+	this.av.calls_mu.Lock()
+	defer this.av.calls_mu.Unlock()
+	return this.state
+}
+
+// Flags returns the last capabilities reported by the friend.
+func (this *Call) Flags() CallFlags {
+	this.av.calls_mu.Lock()
+	defer this.av.calls_mu.Unlock()
+	return this.flags
+}
+
+// Offered returns whether the friend offered audio and video when calling us.
+func (this *Call) Offered() (audio bool, video bool) {
+	return this.audioEnabled, this.videoEnabled
+}
+
+// Answer accepts an incoming call.
+func (this *Call) Answer(audioBitRate uint32, videoBitRate uint32) error {
+	_, err := this.av.Answer(this.FriendNumber, audioBitRate, videoBitRate)
+	return err
+}
+
+// Hangup rejects a ringing call or ends an answered one.
+func (this *Call) Hangup() error {
+	_, err := this.av.CallControl(this.FriendNumber, CallControlCancel)
+	return err
+}
+
+// Hold pauses an answered call.
+func (this *Call) Hold() error {
+	_, err := this.av.CallControl(this.FriendNumber, CallControlPause)
+	return err
+}
+
+// Resume resumes a call paused with Hold.
+func (this *Call) Resume() error {
+	_, err := this.av.CallControl(this.FriendNumber, CallControlResume)
+	return err
+}
+
+// MuteAudio asks the friend to stop sending audio, or to start again.
+func (this *Call) MuteAudio(mute bool) error {
+	control := CallControlUnmuteAudio
+	if mute {
+		control = CallControlMuteAudio
+	}
+	_, err := this.av.CallControl(this.FriendNumber, control)
+	return err
+}
+
+// HideVideo asks the friend to stop sending video, or to start again.
+func (this *Call) HideVideo(hide bool) error {
+	control := CallControlShowVideo
+	if hide {
+		control = CallControlHideVideo
+	}
+	_, err := this.av.CallControl(this.FriendNumber, control)
+	return err
+}
+
+type callTransition struct {
+	call     *Call
+	from, to CallState
+}
+
+// StartCall calls the friend and returns the ringing call session.
+func (this *ToxAV) StartCall(friendNumber uint32, audioBitRate uint32, videoBitRate uint32) (*Call, error) {
+	if _, err := this.Call(friendNumber, audioBitRate, videoBitRate); err != nil {
+		return nil, err
+	}
+	return this.GetCall(friendNumber), nil
+}
+
+// GetCall returns the call session with the friend, or nil if there is none.
+func (this *ToxAV) GetCall(friendNumber uint32) *Call {
+	this.calls_mu.Lock()
+	defer this.calls_mu.Unlock()
+	return this.calls[friendNumber]
+}
+
+// GetCalls returns all call sessions which did not reach a final state.
+func (this *ToxAV) GetCalls() []*Call {
+	this.calls_mu.Lock()
+	defer this.calls_mu.Unlock()
+
+	calls := make([]*Call, 0, len(this.calls))
+	for _, call := range this.calls {
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// SetCallTimeout sets after how long unanswered calls are cancelled and end. Zero disables the timeout.
+//
+// Timeouts are checked by Iterate.
+func (this *ToxAV) SetCallTimeout(timeout time.Duration) {
+	this.calls_mu.Lock()
+	defer this.calls_mu.Unlock()
+	this.call_timeout = timeout
+}
+
+// CallbackCallTransition sets event handler which is triggered on every state change of a call session.
+func (this *ToxAV) CallbackCallTransition(cbfn cb_call_transition_ftype, userData interface{}) {
+	cbfnp := (unsafe.Pointer)(&cbfn)
+	if _, ok := this.cb_call_transitions[cbfnp]; ok {
+		return
+	}
+	this.cb_call_transitions[cbfnp] = userData
+}
+
+// callTransit moves the call to a new state, and drops it at final states. Call with calls_mu held.
+func (this *ToxAV) callTransit(call *Call, to CallState, trs []callTransition) []callTransition {
+	if call.state == to {
+		return trs
+	}
+	trs = append(trs, callTransition{call, call.state, to})
+	call.state = to
+	if to == CallStateEnded || to == CallStateError {
+		if this.calls[call.FriendNumber] == call {
+			delete(this.calls, call.FriendNumber)
+		}
+	}
+	return trs
+}
+
+func (this *ToxAV) callFireTransitions(trs []callTransition) {
+	for _, tr := range trs {
+		for cbfni, ud := range this.cb_call_transitions {
+			cbfn := *(*cb_call_transition_ftype)(cbfni)
+			tr := tr
+			this.putcbevts(func() { cbfn(this, tr.call, tr.from, tr.to, ud) })
+		}
+	}
+}
+
+// callNew starts tracking a ringing call, replacing a stale session with the friend.
+func (this *ToxAV) callNew(friendNumber uint32, state CallState, audioEnabled bool, videoEnabled bool) {
+	this.calls_mu.Lock()
+	var trs []callTransition
+	if old, ok := this.calls[friendNumber]; ok {
+		trs = this.callTransit(old, CallStateEnded, trs)
+	}
+	call := &Call{av: this, FriendNumber: friendNumber, state: CallStateNew, audioEnabled: audioEnabled, videoEnabled: videoEnabled}
+	call.created = time.Now()
+	this.calls[friendNumber] = call
+	trs = this.callTransit(call, state, trs)
+	this.calls_mu.Unlock()
+
+	this.callFireTransitions(trs)
+}
+
+// callUpdateState applies the FriendCallState* bit mask reported by toxav.
+func (this *ToxAV) callUpdateState(friendNumber uint32, state uint32) {
+	this.calls_mu.Lock()
+	call, ok := this.calls[friendNumber]
+	if !ok {
+		this.calls_mu.Unlock()
+		return
+	}
+
+	var trs []callTransition
+	call.flags = decodeCallFlags(state)
+	switch {
+	case state&uint32(FriendCallStateError) != 0:
+		trs = this.callTransit(call, CallStateError, trs)
+	case state&uint32(FriendCallStateFinished) != 0:
+		trs = this.callTransit(call, CallStateEnded, trs)
+	default:
+		// the friend answered our call, or paused and resumed it
+		call.pausedByPeer = !call.flags.any()
+		trs = this.callTransit(call, call.activeState(), trs)
+	}
+	this.calls_mu.Unlock()
+
+	this.callFireTransitions(trs)
+}
+
+// callAnswered applies a successful Answer made by us.
+func (this *ToxAV) callAnswered(friendNumber uint32) {
+	this.calls_mu.Lock()
+	var trs []callTransition
+	if call, ok := this.calls[friendNumber]; ok {
+		trs = this.callTransit(call, call.activeState(), trs)
+	}
+	this.calls_mu.Unlock()
+
+	this.callFireTransitions(trs)
+}
+
+// callControlled applies a successful CallControl made by us.
+func (this *ToxAV) callControlled(friendNumber uint32, control int) {
+	this.calls_mu.Lock()
+	call, ok := this.calls[friendNumber]
+	if !ok {
+		this.calls_mu.Unlock()
+		return
+	}
+
+	var trs []callTransition
+	switch {
+	case control == CallControlCancel:
+		trs = this.callTransit(call, CallStateEnded, trs)
+	case control == CallControlPause:
+		call.pausedByUs = true
+		trs = this.callTransit(call, CallStateHeld, trs)
+	case control == CallControlResume:
+		call.pausedByUs = false
+		trs = this.callTransit(call, call.activeState(), trs)
+	}
+	this.calls_mu.Unlock()
+
+	this.callFireTransitions(trs)
+}
+
+// callCheckTimeouts cancels calls which were not answered within the call timeout.
+func (this *ToxAV) callCheckTimeouts() {
+	this.calls_mu.Lock()
+	var expired []uint32
+	if this.call_timeout > 0 {
+		for fn, call := range this.calls {
+			if (call.state == CallStateRingingOut || call.state == CallStateRingingIn) &&
+				time.Since(call.created) > this.call_timeout {
+				expired = append(expired, fn)
+			}
+		}
+	}
+	this.calls_mu.Unlock()
+
+	for _, fn := range expired {
+		if _, err := this.CallControl(fn, CallControlCancel); err != nil {
+			// toxav already forgot the call, end it anyway
+			this.calls_mu.Lock()
+			var trs []callTransition
+			if call, ok := this.calls[fn]; ok {
+				trs = this.callTransit(call, CallStateEnded, trs)
+			}
+			this.calls_mu.Unlock()
+			this.callFireTransitions(trs)
+		}
+	}
+}
+
+func (this *Call) activeState() CallState {
+	if this.pausedByUs || this.pausedByPeer {
+		return CallStateHeld
+	}
+	return CallStateActive
+}
@@ -0,0 +1,88 @@
+package tox
+
+import (
+	"image"
+	"image/color"
+)
+
+// VideoSendImage sends any image as a video frame to the friend.
+//
+// *image.YCbCr frames with 4:2:0 subsampling are sent as is, *image.RGBA and
+// other images are converted to I420 first.
+func (this *ToxAV) VideoSendImage(friendNumber uint32, img image.Image) (bool, error) {
+	if img == nil {
+		return false, toxerr("Invalid image: nil")
+	}
+	if frame, ok := img.(*image.YCbCr); ok && frame.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+		return this.VideoSendFrameYUV(friendNumber, frame)
+	}
+
+	rect := img.Bounds()
+	if rect.Empty() {
+		return false, toxerrf("Invalid image size: %dx%d", rect.Dx(), rect.Dy())
+	}
+	// a pooled frame per call, as sends to several friends may run concurrently
+	frame := this.getYUVFrame(rect.Dx(), rect.Dy())
+	defer this.yuv_pool.Put(frame)
+	imageToI420(img, frame)
+	return this.VideoSendFrameYUV(friendNumber, frame)
+}
+
+// imageToI420 converts img into dst, which must be a 4:2:0 frame of the same size.
+// Chroma is the average of each 2x2 block.
+func imageToI420(img image.Image, dst *image.YCbCr) {
+	rect := img.Bounds()
+	width, height := rect.Dx(), rect.Dy()
+
+	rgbAt := func(x, y int) (uint8, uint8, uint8) {
+		r, g, b, _ := img.At(rect.Min.X+x, rect.Min.Y+y).RGBA()
+		return uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)
+	}
+	if src, ok := img.(*image.RGBA); ok {
+		rgbAt = func(x, y int) (uint8, uint8, uint8) {
+			i := src.PixOffset(rect.Min.X+x, rect.Min.Y+y)
+			return src.Pix[i], src.Pix[i+1], src.Pix[i+2]
+		}
+	}
+
+	for y := 0; y < height; y += 2 {
+		for x := 0; x < width; x += 2 {
+			var cb, cr, n int
+			for dy := 0; dy < 2 && y+dy < height; dy++ {
+				for dx := 0; dx < 2 && x+dx < width; dx++ {
+					r, g, b := rgbAt(x+dx, y+dy)
+					yy, u, v := color.RGBToYCbCr(r, g, b)
+					dst.Y[(y+dy)*dst.YStride+x+dx] = yy
+					cb += int(u)
+					cr += int(v)
+					n++
+				}
+			}
+			ci := (y/2)*dst.CStride + x/2
+			dst.Cb[ci] = uint8(cb / n)
+			dst.Cr[ci] = uint8(cr / n)
+		}
+	}
+}
+
+// copyYCbCr returns a copy of frame which does not share memory with it.
+func copyYCbCr(frame *image.YCbCr) *image.YCbCr {
+	dst := image.NewYCbCr(image.Rect(0, 0, frame.Rect.Dx(), frame.Rect.Dy()), frame.SubsampleRatio)
+	copyYCbCrInto(dst, frame)
+	return dst
+}
+
+// copyYCbCrInto copies frame into dst, which must have the same size and subsampling.
+func copyYCbCrInto(dst *image.YCbCr, frame *image.YCbCr) {
+	rect := frame.Rect
+	for y := 0; y < rect.Dy(); y++ {
+		yi := frame.YOffset(rect.Min.X, rect.Min.Y+y)
+		copy(dst.Y[y*dst.YStride:y*dst.YStride+rect.Dx()], frame.Y[yi:])
+	}
+	ch := len(dst.Cb) / dst.CStride
+	for y := 0; y < ch; y++ {
+		ci := frame.COffset(rect.Min.X, rect.Min.Y) + y*frame.CStride
+		copy(dst.Cb[y*dst.CStride:(y+1)*dst.CStride], frame.Cb[ci:])
+		copy(dst.Cr[y*dst.CStride:(y+1)*dst.CStride], frame.Cr[ci:])
+	}
+}
@@ -0,0 +1,448 @@
+package tox
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	mixerFriend = iota
+	mixerConference
+)
+
+type mixerKey struct {
+	kind   int
+	number uint32
+}
+
+type mixerParticipant struct {
+	key     mixerKey
+	sources map[uint32]*mixerSource // friend calls use source 0, conferences one per peer
+	send    func(pcm []byte, sampleCount int, channels int, samplingRate int) error
+	// underruns of the sources dropped on conference peer list changes
+	underruns int
+}
+
+// mixerSource is the audio of one friend call or conference peer, with the
+// resampler state carried from frame to frame.
+type mixerSource struct {
+	jb *jitterBuffer
+	rs *pcmResampler
+}
+
+// AudioMixer mixes the audio of ToxAV calls and AV conferences.
+//
+// Every participant, a friend call or a whole conference, hears the mix of all
+// other participants (N-1 mixing), so adding a friend and a conference bridges
+// the 1:1 call into the conference. Incoming frames go through a per-source
+// jitter buffer and are converted to the sampling rate and channel count of
+// the mixer before mixing.
+type AudioMixer struct {
+	av           *ToxAV
+	samplingRate int
+	channels     int
+	frameSize    int // samples per channel in one frame
+	interval     time.Duration
+
+	// JitterDepth is the number of frames buffered for a source before its audio is mixed.
+	JitterDepth int
+	// MaxJitterDepth is the number of frames after which the oldest buffered audio is dropped.
+	MaxJitterDepth int
+
+	mu           sync.Mutex
+	participants map[mixerKey]*mixerParticipant
+	stopch       chan struct{}
+}
+
+// NewAudioMixer creates a mixer producing frameDuration long frames with the given format.
+//
+// frameDuration must be one of the Opus frame durations 2.5, 5, 10, 20, 40 or 60 ms.
+func NewAudioMixer(av *ToxAV, samplingRate int, channels int, frameDuration time.Duration) (*AudioMixer, error) {
+	if err := validateAudioFormat(channels, samplingRate); err != nil {
+		return nil, err
+	}
+	switch frameDuration {
+	case 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+		20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond:
+	default:
+		return nil, toxerrf("Invalid frame duration: %v", frameDuration)
+	}
+
+	this := &AudioMixer{}
+	this.av = av
+	this.samplingRate = samplingRate
+	this.channels = channels
+	this.frameSize = int(int64(samplingRate) * int64(frameDuration) / int64(time.Second))
+	this.interval = frameDuration
+	this.JitterDepth = 3
+	this.MaxJitterDepth = 10
+	this.participants = make(map[mixerKey]*mixerParticipant)
+	return this, nil
+}
+
+// AddFriend adds the call with the friend to the mix. The mix is sent to the friend with AudioSendFrame.
+func (this *AudioMixer) AddFriend(friendNumber uint32) {
+	this.addParticipant(mixerKey{mixerFriend, friendNumber},
+		func(pcm []byte, sampleCount int, channels int, samplingRate int) error {
+			_, err := this.av.AudioSendFrame(friendNumber, pcm, sampleCount, channels, samplingRate)
+			return err
+		})
+}
+
+// RemoveFriend removes the call with the friend from the mix.
+func (this *AudioMixer) RemoveFriend(friendNumber uint32) {
+	this.removeParticipant(mixerKey{mixerFriend, friendNumber})
+}
+
+// AddConference adds the AV conference to the mix. The mix is sent to the conference with GroupSendAudio.
+func (this *AudioMixer) AddConference(groupNumber uint32) {
+	this.addParticipant(mixerKey{mixerConference, groupNumber},
+		func(pcm []byte, sampleCount int, channels int, samplingRate int) error {
+			return this.av.tox.GroupSendAudio(groupNumber, pcm, sampleCount, channels, samplingRate)
+		})
+}
+
+// RemoveConference removes the AV conference from the mix.
+func (this *AudioMixer) RemoveConference(groupNumber uint32) {
+	this.removeParticipant(mixerKey{mixerConference, groupNumber})
+}
+
+func (this *AudioMixer) addParticipant(key mixerKey, send func([]byte, int, int, int) error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.participants[key]; ok {
+		return
+	}
+	this.participants[key] = &mixerParticipant{key: key, sources: make(map[uint32]*mixerSource), send: send}
+}
+
+func (this *AudioMixer) removeParticipant(key mixerKey) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.participants, key)
+}
+
+// PushFriendFrame queues an audio frame received from a friend call. Frames of unknown friends are dropped.
+func (this *AudioMixer) PushFriendFrame(friendNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int) {
+	this.push(mixerKey{mixerFriend, friendNumber}, 0, pcm, sampleCount, channels, samplingRate)
+}
+
+// PushConferenceFrame queues an audio frame received from a conference peer. Frames of unknown conferences are dropped.
+func (this *AudioMixer) PushConferenceFrame(groupNumber uint32, peerNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int) {
+	this.push(mixerKey{mixerConference, groupNumber}, peerNumber, pcm, sampleCount, channels, samplingRate)
+}
+
+// ConferencePeersChanged drops the buffered audio of the peers of the conference, as peers
+// may have left or been renumbered. Attach calls it on conference peer list changes.
+func (this *AudioMixer) ConferencePeersChanged(groupNumber uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if p, ok := this.participants[mixerKey{mixerConference, groupNumber}]; ok {
+		for _, src := range p.sources {
+			p.underruns += src.jb.underruns
+		}
+		p.sources = make(map[uint32]*mixerSource)
+	}
+}
+
+func (this *AudioMixer) push(key mixerKey, source uint32, pcm []byte, sampleCount int, channels int, samplingRate int) {
+	if validateAudioFormat(channels, samplingRate) != nil || sampleCount <= 0 || len(pcm) < sampleCount*channels*2 {
+		return
+	}
+	samples := convertChannels(pcmToInt16(pcm[:sampleCount*channels*2]), channels, this.channels)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	p, ok := this.participants[key]
+	if !ok {
+		return
+	}
+	src, ok := p.sources[source]
+	if !ok {
+		frameLen := this.frameSize * this.channels
+		src = &mixerSource{jb: newJitterBuffer(this.JitterDepth*frameLen, this.MaxJitterDepth*frameLen)}
+		p.sources[source] = src
+	}
+	if src.rs == nil || src.rs.inRate != samplingRate {
+		src.rs = newPCMResampler(this.channels, samplingRate, this.samplingRate)
+	}
+	src.jb.push(src.rs.process(samples))
+}
+
+// Attach adds the mixer as audio receive handler of the ToxAV instance and of its AV conferences.
+func (this *AudioMixer) Attach() {
+	this.av.CallbackAudioReceiveFrame(func(_ *ToxAV, friendNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int, _ interface{}) {
+		this.PushFriendFrame(friendNumber, pcm, sampleCount, channels, samplingRate)
+	}, nil)
+	this.av.tox.CallbackConferenceAudioReceiveFrame(func(_ *Tox, groupNumber uint32, peerNumber uint32, pcm []byte, sampleCount int, channels int, samplingRate int, _ interface{}) {
+		this.PushConferenceFrame(groupNumber, peerNumber, pcm, sampleCount, channels, samplingRate)
+	}, nil)
+	this.av.tox.CallbackConferencePeerListChanged(func(_ *Tox, groupNumber uint32, _ interface{}) {
+		this.ConferencePeersChanged(groupNumber)
+	}, nil)
+}
+
+// MixFrame takes one frame from every source and sends each participant the mix of all other participants.
+func (this *AudioMixer) MixFrame() {
+	frameLen := this.frameSize * this.channels
+
+	this.mu.Lock()
+	// per participant sum of its own sources, nil when nothing was buffered
+	inputs := make(map[mixerKey][]int32, len(this.participants))
+	total := make([]int32, frameLen)
+	for key, p := range this.participants {
+		var sum []int32
+		for _, src := range p.sources {
+			frame := src.jb.pop(frameLen)
+			if frame == nil {
+				continue
+			}
+			if sum == nil {
+				sum = make([]int32, frameLen)
+			}
+			for i, s := range frame {
+				sum[i] += int32(s)
+			}
+		}
+		if sum != nil {
+			inputs[key] = sum
+			for i, s := range sum {
+				total[i] += s
+			}
+		}
+	}
+	outputs := make([]*mixerParticipant, 0, len(this.participants))
+	for _, p := range this.participants {
+		outputs = append(outputs, p)
+	}
+	this.mu.Unlock()
+
+	for _, p := range outputs {
+		own := inputs[p.key]
+		out := make([]int16, frameLen)
+		for i := range out {
+			s := total[i]
+			if own != nil {
+				s -= own[i]
+			}
+			out[i] = clampInt16(s)
+		}
+		err := p.send(int16ToPCM(out), this.frameSize, this.channels, this.samplingRate)
+		if err != nil && toxdebug {
+			log.Println("mixer send failed:", p.key.kind, p.key.number, err)
+		}
+	}
+}
+
+// Run mixes and sends a frame every frame duration until Stop is called.
+func (this *AudioMixer) Run() {
+	this.mu.Lock()
+	if this.stopch != nil {
+		this.mu.Unlock()
+		return
+	}
+	stopch := make(chan struct{})
+	this.stopch = stopch
+	this.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(this.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				this.MixFrame()
+			case <-stopch:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the loop started by Run.
+func (this *AudioMixer) Stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.stopch != nil {
+		close(this.stopch)
+		this.stopch = nil
+	}
+}
+
+// Underruns returns how often the audio of the friend call ran dry while playing.
+func (this *AudioMixer) Underruns(friendNumber uint32) int {
+	return this.underruns(mixerKey{mixerFriend, friendNumber})
+}
+
+// ConferenceUnderruns returns how often the audio of the peers of the conference ran dry while playing.
+func (this *AudioMixer) ConferenceUnderruns(groupNumber uint32) int {
+	return this.underruns(mixerKey{mixerConference, groupNumber})
+}
+
+func (this *AudioMixer) underruns(key mixerKey) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	p, ok := this.participants[key]
+	if !ok {
+		return 0
+	}
+	n := p.underruns
+	for _, src := range p.sources {
+		n += src.jb.underruns
+	}
+	return n
+}
+
+// jitterBuffer queues interleaved samples of one source. It starts playing
+// once depth samples are buffered and goes back to buffering on underrun.
+type jitterBuffer struct {
+	samples   []int16
+	depth     int
+	maxDepth  int
+	buffering bool
+	underruns int
+}
+
+func newJitterBuffer(depth int, maxDepth int) *jitterBuffer {
+	if maxDepth < depth {
+		maxDepth = depth
+	}
+	return &jitterBuffer{depth: depth, maxDepth: maxDepth, buffering: true}
+}
+
+func (this *jitterBuffer) push(samples []int16) {
+	this.samples = append(this.samples, samples...)
+	if over := len(this.samples) - this.maxDepth; over > 0 {
+		this.samples = this.samples[over:]
+	}
+}
+
+// pop returns n samples, or nil while buffering.
+func (this *jitterBuffer) pop(n int) []int16 {
+	if this.buffering {
+		if len(this.samples) < this.depth || len(this.samples) < n {
+			return nil
+		}
+		this.buffering = false
+	}
+	if len(this.samples) < n {
+		this.underruns++
+		this.buffering = true
+		frame := make([]int16, n)
+		copy(frame, this.samples)
+		this.samples = this.samples[:0]
+		return frame
+	}
+	frame := make([]int16, n)
+	copy(frame, this.samples)
+	this.samples = this.samples[n:]
+	return frame
+}
+
+// validateAudioFormat checks the channels and sampling rate against what the Opus codec of toxav supports.
+func validateAudioFormat(channels int, samplingRate int) error {
+	if channels != 1 && channels != 2 {
+		return toxerrf("Invalid channels: %d, want 1 or 2", channels)
+	}
+	switch samplingRate {
+	case 8000, 12000, 16000, 24000, 48000:
+		return nil
+	}
+	return toxerrf("Invalid sampling rate: %d, want 8000, 12000, 16000, 24000 or 48000", samplingRate)
+}
+
+// convertChannels downmixes by averaging or upmixes by repeating channels.
+func convertChannels(in []int16, inChannels int, outChannels int) []int16 {
+	if inChannels == outChannels {
+		return in
+	}
+	frames := len(in) / inChannels
+	conv := make([]int16, frames*outChannels)
+	for f := 0; f < frames; f++ {
+		if outChannels < inChannels {
+			var sum int32
+			for c := 0; c < inChannels; c++ {
+				sum += int32(in[f*inChannels+c])
+			}
+			v := int16(sum / int32(inChannels))
+			for c := 0; c < outChannels; c++ {
+				conv[f*outChannels+c] = v
+			}
+		} else {
+			for c := 0; c < outChannels; c++ {
+				conv[f*outChannels+c] = in[f*inChannels+c%inChannels]
+			}
+		}
+	}
+	return conv
+}
+
+// pcmResampler converts a stream of interleaved frames between sampling rates
+// using linear interpolation. It carries the last input frame and the position
+// of the next output frame across calls, so there are no jumps between frames.
+type pcmResampler struct {
+	channels int
+	inRate   int
+	outRate  int
+	last     []int16 // last input frame of the previous call, nil before the first
+	// position of the next output frame in input frames times outRate,
+	// relative to the input of the next call, so it stays exact
+	pos int64
+}
+
+func newPCMResampler(channels int, inRate int, outRate int) *pcmResampler {
+	return &pcmResampler{channels: channels, inRate: inRate, outRate: outRate}
+}
+
+func (this *pcmResampler) process(in []int16) []int16 {
+	frames := len(in) / this.channels
+	if this.inRate == this.outRate || frames == 0 {
+		return in
+	}
+	if this.last == nil {
+		this.last = append([]int16{}, in[:this.channels]...)
+	}
+	// input frame i, where -1 is the last frame of the previous call
+	sample := func(i int, c int) float64 {
+		if i < 0 {
+			return float64(this.last[c])
+		}
+		return float64(in[i*this.channels+c])
+	}
+
+	outRate := int64(this.outRate)
+	out := make([]int16, 0, (frames*this.outRate/this.inRate+1)*this.channels)
+	for ; this.pos <= int64(frames-1)*outRate; this.pos += int64(this.inRate) {
+		// pos is at least -outRate, so i0 is at least -1
+		i0 := int((this.pos+outRate)/outRate) - 1
+		frac := float64(this.pos-int64(i0)*outRate) / float64(outRate)
+		for c := 0; c < this.channels; c++ {
+			s0 := sample(i0, c)
+			s1 := s0
+			if i0+1 < frames {
+				s1 = sample(i0+1, c)
+			}
+			out = append(out, int16(s0+(s1-s0)*frac))
+		}
+	}
+	this.pos -= int64(frames) * outRate
+	copy(this.last, in[(frames-1)*this.channels:])
+	return out
+}
+
+func clampInt16(s int32) int16 {
+	if s > 32767 {
+		return 32767
+	}
+	if s < -32768 {
+		return -32768
+	}
+	return int16(s)
+}
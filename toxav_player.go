@@ -0,0 +1,428 @@
+package tox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MediaPlayer plays a WAV file and a Y4M or raw I420 video file into a friend call.
+//
+// Audio is sent in FrameDuration chunks and video at the frame rate of the file,
+// both paced by the wall clock. A frame which is sent later than one frame duration
+// after its due time counts as underrun, the player then skips ahead instead of
+// trying to catch up with a burst of frames.
+type MediaPlayer struct {
+	av           *ToxAV
+	friendNumber uint32
+
+	// FrameDuration of the audio frames, 20 ms by default. Must be a valid Opus frame duration.
+	FrameDuration time.Duration
+	// Loop restarts the files at their end instead of stopping.
+	Loop bool
+
+	audio *wavReader
+	video *videoReader
+
+	mu        sync.Mutex
+	underruns [2]int // audio, video
+	err       error  // first error that stopped a stream
+	stopch    chan struct{}
+	wg        sync.WaitGroup
+	done      chan struct{}
+
+	sendAudio func(pcm []int16, channels int, samplingRate int) error
+	sendVideo func(frame *image.YCbCr) error
+	nowfn     func() time.Time
+	sleepfn   func(d time.Duration)
+}
+
+// NewMediaPlayer creates a player for the call with the friend.
+func NewMediaPlayer(av *ToxAV, friendNumber uint32) *MediaPlayer {
+	this := &MediaPlayer{}
+	this.av = av
+	this.friendNumber = friendNumber
+	this.FrameDuration = 20 * time.Millisecond
+	this.sendAudio = func(pcm []int16, channels int, samplingRate int) error {
+		_, err := this.av.AudioSendFrameInt16(this.friendNumber, pcm, channels, samplingRate)
+		return err
+	}
+	this.sendVideo = func(frame *image.YCbCr) error {
+		_, err := this.av.VideoSendFrameYUV(this.friendNumber, frame)
+		return err
+	}
+	this.nowfn = time.Now
+	this.sleepfn = time.Sleep
+	return this
+}
+
+// OpenWAV opens a 16 bit PCM WAV file as audio source.
+func (this *MediaPlayer) OpenWAV(path string) error {
+	r, err := openWAV(path)
+	if err != nil {
+		return err
+	}
+	if err := validateAudioFrame(r.frameSamples(this.FrameDuration), r.channels, r.samplingRate); err != nil {
+		r.fp.Close()
+		return err
+	}
+	this.audio = r
+	return nil
+}
+
+// OpenY4M opens a 4:2:0 Y4M file as video source.
+func (this *MediaPlayer) OpenY4M(path string) error {
+	r, err := openY4M(path)
+	if err != nil {
+		return err
+	}
+	this.video = r
+	return nil
+}
+
+// OpenRawVideo opens a file of raw I420 frames as video source.
+func (this *MediaPlayer) OpenRawVideo(path string, width int, height int, fps float64) error {
+	if width <= 0 || height <= 0 || fps <= 0 {
+		return toxerrf("Invalid raw video format: %dx%d at %v fps", width, height, fps)
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	this.video = &videoReader{fp: fp, rd: bufio.NewReader(fp), width: width, height: height,
+		interval: time.Duration(float64(time.Second) / fps)}
+	return nil
+}
+
+// Underruns returns how many audio and video frames were sent late.
+func (this *MediaPlayer) Underruns() (audio int, video int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.underruns[0], this.underruns[1]
+}
+
+// Err returns the read or send error which stopped playing, or nil if the files ended or Stop was called.
+func (this *MediaPlayer) Err() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.err
+}
+
+// Start starts playing the opened files.
+func (this *MediaPlayer) Start() error {
+	if this.audio == nil && this.video == nil {
+		return toxerr("nothing to play")
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.stopch != nil {
+		return toxerr("already playing")
+	}
+	this.stopch = make(chan struct{})
+	this.done = make(chan struct{})
+	this.err = nil
+
+	start := this.nowfn()
+	if this.audio != nil {
+		this.wg.Add(1)
+		go this.play(this.stopch, 0, start, this.FrameDuration, this.playAudio)
+	}
+	if this.video != nil {
+		this.wg.Add(1)
+		go this.play(this.stopch, 1, start, this.video.interval, this.playVideo)
+	}
+	go func(stopch chan struct{}, done chan struct{}) {
+		this.wg.Wait()
+		// playing ended by itself, so it can be started again
+		this.mu.Lock()
+		if this.stopch == stopch {
+			this.stopch = nil
+		}
+		this.mu.Unlock()
+		close(done)
+	}(this.stopch, this.done)
+	return nil
+}
+
+// Done returns a channel which is closed when playing stopped, at the end of the files or by Stop.
+func (this *MediaPlayer) Done() <-chan struct{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.done
+}
+
+// Stop stops playing and closes the files.
+func (this *MediaPlayer) Stop() {
+	this.mu.Lock()
+	stopch := this.stopch
+	this.stopch = nil
+	this.mu.Unlock()
+
+	if stopch != nil {
+		close(stopch)
+		this.wg.Wait()
+	}
+	if this.audio != nil {
+		this.audio.fp.Close()
+	}
+	if this.video != nil {
+		this.video.fp.Close()
+	}
+}
+
+// play calls next every interval, measured from start, until it returns false or an error, or the player stops.
+// An error stops the other stream too and is kept for Err.
+func (this *MediaPlayer) play(stopch chan struct{}, kind int, start time.Time, interval time.Duration, next func() (bool, error)) {
+	defer this.wg.Done()
+
+	for n := int64(0); ; n++ {
+		due := start.Add(time.Duration(n) * interval)
+		if wait := due.Sub(this.nowfn()); wait > 0 {
+			this.sleepfn(wait)
+		} else if -wait > interval {
+			this.mu.Lock()
+			this.underruns[kind]++
+			this.mu.Unlock()
+			n += int64(-wait / interval) // skip ahead
+		}
+
+		select {
+		case <-stopch:
+			return
+		default:
+		}
+		more, err := next()
+		if err != nil && err != io.EOF {
+			this.mu.Lock()
+			if this.err == nil {
+				this.err = err
+			}
+			if this.stopch == stopch {
+				this.stopch = nil
+				close(stopch)
+			}
+			this.mu.Unlock()
+			return
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+func (this *MediaPlayer) playAudio() (bool, error) {
+	r := this.audio
+	pcm, err := r.readFrame(r.frameSamples(this.FrameDuration))
+	if err == io.EOF && this.Loop {
+		if err = r.rewind(); err == nil {
+			pcm, err = r.readFrame(r.frameSamples(this.FrameDuration))
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, this.sendAudio(pcm, r.channels, r.samplingRate)
+}
+
+func (this *MediaPlayer) playVideo() (bool, error) {
+	r := this.video
+	frame, err := r.readFrame()
+	if err == io.EOF && this.Loop {
+		if err = r.rewind(); err == nil {
+			frame, err = r.readFrame()
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, this.sendVideo(frame)
+}
+
+// wavMaxFmtSize bounds the fmt chunk, the extensible format needs 40 bytes.
+const wavMaxFmtSize = 256
+
+type wavReader struct {
+	fp           *os.File
+	rd           *bufio.Reader
+	channels     int
+	samplingRate int
+	dataStart    int64
+	dataLen      int64
+	pos          int64
+}
+
+func openWAV(path string) (*wavReader, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &wavReader{fp: fp}
+	if err := r.parseHeader(); err != nil {
+		fp.Close()
+		return nil, toxerrf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+func (this *wavReader) parseHeader() error {
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(this.fp, hdr); err != nil || string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		return toxerr("not a WAV file")
+	}
+	offset := int64(12)
+	for {
+		ch := make([]byte, 8)
+		if _, err := io.ReadFull(this.fp, ch); err != nil {
+			return toxerr("no data chunk")
+		}
+		size := int64(binary.LittleEndian.Uint32(ch[4:]))
+		offset += 8
+		switch string(ch[0:4]) {
+		case "fmt ":
+			if size < 16 || size > wavMaxFmtSize {
+				return toxerrf("invalid fmt chunk size %d", size)
+			}
+			fmtb := make([]byte, size)
+			if _, err := io.ReadFull(this.fp, fmtb); err != nil {
+				return toxerr("short fmt chunk")
+			}
+			if format, bits := binary.LittleEndian.Uint16(fmtb[0:]), binary.LittleEndian.Uint16(fmtb[14:]); format != 1 || bits != 16 {
+				return toxerrf("unsupported format %d with %d bits, want 16 bit PCM", format, bits)
+			}
+			this.channels = int(binary.LittleEndian.Uint16(fmtb[2:]))
+			this.samplingRate = int(binary.LittleEndian.Uint32(fmtb[4:]))
+		case "data":
+			if this.channels == 0 {
+				return toxerr("data chunk before fmt chunk")
+			}
+			this.dataStart, this.dataLen = offset, size
+			this.rd = bufio.NewReader(this.fp)
+			return nil
+		default:
+			if _, err := this.fp.Seek(size+size%2, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		offset += size + size%2
+	}
+}
+
+func (this *wavReader) frameSamples(d time.Duration) int {
+	return int(int64(this.samplingRate) * int64(d) / int64(time.Second))
+}
+
+// readFrame reads sampleCount samples per channel, padding the last frame of the file with silence.
+func (this *wavReader) readFrame(sampleCount int) ([]int16, error) {
+	left := this.dataLen - this.pos
+	if left < int64(this.channels*2) {
+		return nil, io.EOF
+	}
+	buf := make([]byte, sampleCount*this.channels*2)
+	if int64(len(buf)) > left {
+		buf = buf[:left/2*2]
+	}
+	n, err := io.ReadFull(this.rd, buf)
+	this.pos += int64(n)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	pcm := make([]int16, sampleCount*this.channels)
+	for i := 0; i < n/2; i++ {
+		pcm[i] = int16(binary.LittleEndian.Uint16(buf[i*2:]))
+	}
+	return pcm, nil
+}
+
+func (this *wavReader) rewind() error {
+	if _, err := this.fp.Seek(this.dataStart, io.SeekStart); err != nil {
+		return err
+	}
+	this.rd.Reset(this.fp)
+	this.pos = 0
+	return nil
+}
+
+type videoReader struct {
+	fp        *os.File
+	rd        *bufio.Reader
+	width     int
+	height    int
+	interval  time.Duration
+	y4m       bool
+	dataStart int64
+}
+
+func openY4M(path string) (*videoReader, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &videoReader{fp: fp, rd: bufio.NewReader(fp), y4m: true, interval: time.Second / 25}
+	line, err := r.rd.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "YUV4MPEG2 ") {
+		fp.Close()
+		return nil, toxerrf("%s: not a Y4M file", path)
+	}
+	r.dataStart = int64(len(line))
+	for _, param := range strings.Fields(line)[1:] {
+		val := param[1:]
+		switch param[0] {
+		case 'W':
+			r.width, _ = strconv.Atoi(val)
+		case 'H':
+			r.height, _ = strconv.Atoi(val)
+		case 'F':
+			var num, den int
+			if _, err := fmt.Sscanf(val, "%d:%d", &num, &den); err == nil && num > 0 && den > 0 {
+				r.interval = time.Duration(int64(time.Second) * int64(den) / int64(num))
+			}
+		case 'C':
+			if !strings.HasPrefix(val, "420") {
+				fp.Close()
+				return nil, toxerrf("%s: unsupported colour space %s, want 4:2:0", path, val)
+			}
+		}
+	}
+	if r.width <= 0 || r.height <= 0 {
+		fp.Close()
+		return nil, toxerrf("%s: invalid frame size %dx%d", path, r.width, r.height)
+	}
+	return r, nil
+}
+
+func (this *videoReader) readFrame() (*image.YCbCr, error) {
+	if this.y4m {
+		line, err := this.rd.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		}
+		if err != nil || !strings.HasPrefix(line, "FRAME") {
+			return nil, toxerr("invalid Y4M frame header")
+		}
+	}
+	frame := image.NewYCbCr(image.Rect(0, 0, this.width, this.height), image.YCbCrSubsampleRatio420)
+	for _, plane := range [][]byte{frame.Y, frame.Cb, frame.Cr} {
+		if _, err := io.ReadFull(this.rd, plane); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF // a truncated last frame is dropped
+			}
+			return nil, err
+		}
+	}
+	return frame, nil
+}
+
+func (this *videoReader) rewind() error {
+	if _, err := this.fp.Seek(this.dataStart, io.SeekStart); err != nil {
+		return err
+	}
+	this.rd.Reset(this.fp)
+	return nil
+}
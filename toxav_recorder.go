@@ -0,0 +1,334 @@
+package tox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// CallRecorder records a friend call. Received audio goes to the left and sent
+// audio to the right channel of a stereo WAV file, received video to a Y4M file.
+//
+// Both audio directions are resampled to SamplingRate and placed by their arrival
+// time, so gaps and sampling rate changes in the middle of the call keep both
+// channels in sync. Every Y4M frame header carries its time since the start of
+// the recording in milliseconds as Xts parameter. Files are rotated to the next
+// index when they grow beyond MaxFileSize, and when the video resolution changes.
+type CallRecorder struct {
+	av           *ToxAV
+	friendNumber uint32
+	basePath     string
+
+	// SamplingRate of the WAV file, 48000 by default.
+	SamplingRate int
+	// MaxFileSize is the size in bytes after which a new file is started, 0 to never rotate.
+	// WAV files are always rotated before 4 GiB, as their header can not hold larger sizes.
+	MaxFileSize int64
+	// MaxLag is how far a silent direction may fall behind before it is filled with silence.
+	MaxLag time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	nowfn   func() time.Time
+	closed  bool
+	pending [2][]int16 // received, sent
+	written int64      // stereo frames written since start
+
+	// one resampler per direction, recreated when the incoming format changes
+	resamplers [2]*pcmResampler
+	formats    [2][2]int // channels and sampling rate
+
+	wav      *os.File
+	wavw     *bufio.Writer
+	wavSize  int64
+	wavIndex int
+
+	y4m      *os.File
+	y4mw     *bufio.Writer
+	y4mSize  int64
+	y4mIndex int
+	y4mRect  image.Rectangle
+}
+
+// NewCallRecorder creates a recorder writing to basePath-NNN.wav and basePath-NNN.y4m.
+func NewCallRecorder(av *ToxAV, friendNumber uint32, basePath string) *CallRecorder {
+	this := &CallRecorder{}
+	this.av = av
+	this.friendNumber = friendNumber
+	this.basePath = basePath
+	this.SamplingRate = 48000
+	this.MaxLag = 200 * time.Millisecond
+	this.nowfn = time.Now
+	return this
+}
+
+// Attach adds the recorder as audio and video receive handler of the ToxAV instance and starts the recording.
+func (this *CallRecorder) Attach() {
+	this.av.CallbackAudioReceiveFrameInt16(func(_ *ToxAV, friendNumber uint32, pcm []int16, channels int, samplingRate int, _ interface{}) {
+		if friendNumber == this.friendNumber {
+			this.RecordReceivedAudio(pcm, channels, samplingRate)
+		}
+	}, nil)
+	this.av.CallbackVideoReceiveFrameYUV(func(_ *ToxAV, friendNumber uint32, frame *image.YCbCr, _ interface{}) {
+		if friendNumber == this.friendNumber {
+			this.RecordVideo(frame)
+		}
+	}, nil)
+}
+
+// AudioSendFrameInt16 sends the frame to the friend and records it as sent audio.
+func (this *CallRecorder) AudioSendFrameInt16(pcm []int16, channels int, samplingRate int) (bool, error) {
+	r, err := this.av.AudioSendFrameInt16(this.friendNumber, pcm, channels, samplingRate)
+	if err == nil {
+		this.RecordSentAudio(pcm, channels, samplingRate)
+	}
+	return r, err
+}
+
+// RecordReceivedAudio records interleaved samples received from the friend.
+func (this *CallRecorder) RecordReceivedAudio(pcm []int16, channels int, samplingRate int) error {
+	return this.recordAudio(0, pcm, channels, samplingRate)
+}
+
+// RecordSentAudio records interleaved samples sent to the friend.
+func (this *CallRecorder) RecordSentAudio(pcm []int16, channels int, samplingRate int) error {
+	return this.recordAudio(1, pcm, channels, samplingRate)
+}
+
+func (this *CallRecorder) recordAudio(side int, pcm []int16, channels int, samplingRate int) error {
+	if channels <= 0 || samplingRate <= 0 {
+		return toxerrf("Invalid audio format: %d channels at %d Hz", channels, samplingRate)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return toxerr("recorder closed")
+	}
+	if format := [2]int{channels, samplingRate}; this.resamplers[side] == nil || this.formats[side] != format {
+		this.resamplers[side] = newPCMResampler(1, samplingRate, this.SamplingRate)
+		this.formats[side] = format
+	}
+	samples := this.resamplers[side].process(convertChannels(pcm, channels, 1))
+	now := this.elapsedFrames()
+
+	// a chunk arriving after a gap starts at its arrival time
+	end := this.written + int64(len(this.pending[side]))
+	if gap := now - int64(len(samples)) - end; gap > 0 {
+		this.pending[side] = append(this.pending[side], make([]int16, gap)...)
+	}
+	this.pending[side] = append(this.pending[side], samples...)
+
+	// a direction without audio is silence once it lags too far behind
+	lag := int64(this.MaxLag.Seconds() * float64(this.SamplingRate))
+	other := 1 - side
+	if oend := this.written + int64(len(this.pending[other])); now-oend > lag {
+		this.pending[other] = append(this.pending[other], make([]int16, now-oend-lag)...)
+	}
+	return this.flushAudio()
+}
+
+func (this *CallRecorder) elapsedFrames() int64 {
+	if this.start.IsZero() {
+		this.start = this.nowfn()
+	}
+	return int64(this.nowfn().Sub(this.start).Seconds() * float64(this.SamplingRate))
+}
+
+// flushAudio writes the frames both directions have samples for.
+func (this *CallRecorder) flushAudio() error {
+	n := len(this.pending[0])
+	if len(this.pending[1]) < n {
+		n = len(this.pending[1])
+	}
+	if n == 0 {
+		return nil
+	}
+
+	buf := make([]byte, n*4)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint16(buf[i*4:], uint16(this.pending[0][i]))
+		binary.LittleEndian.PutUint16(buf[i*4+2:], uint16(this.pending[1][i]))
+	}
+	this.pending[0] = this.pending[0][n:]
+	this.pending[1] = this.pending[1][n:]
+	this.written += int64(n)
+
+	limit := this.MaxFileSize
+	if limit <= 0 || limit > wavMaxFileSize {
+		limit = wavMaxFileSize
+	}
+	for len(buf) > 0 {
+		if this.wav == nil || this.wavSize >= limit {
+			if err := this.rotateWAV(); err != nil {
+				return err
+			}
+		}
+		chunk := buf
+		if room := (limit - this.wavSize) / 4 * 4; room < int64(len(chunk)) {
+			if room <= 0 {
+				room = 4
+			}
+			chunk = chunk[:room]
+		}
+		if _, err := this.wavw.Write(chunk); err != nil {
+			return err
+		}
+		this.wavSize += int64(len(chunk))
+		buf = buf[len(chunk):]
+	}
+	return nil
+}
+
+func (this *CallRecorder) rotateWAV() error {
+	if err := this.closeWAV(); err != nil {
+		return err
+	}
+	this.wavIndex++
+	fp, err := os.Create(fmt.Sprintf("%s-%03d.wav", this.basePath, this.wavIndex))
+	if err != nil {
+		return err
+	}
+	this.wav = fp
+	this.wavw = bufio.NewWriter(fp)
+	this.wavSize = 44
+	_, err = this.wavw.Write(wavHeader(this.SamplingRate, 2, 0))
+	return err
+}
+
+func (this *CallRecorder) closeWAV() error {
+	if this.wav == nil {
+		return nil
+	}
+	fp := this.wav
+	this.wav = nil
+	if err := this.wavw.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	// fix up the sizes now that they are known
+	if _, err := fp.WriteAt(wavHeader(this.SamplingRate, 2, this.wavSize-44), 0); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// wavMaxFileSize is the largest WAV file with sizes that fit the uint32 fields of the header.
+var wavMaxFileSize int64 = 44 + (math.MaxUint32-36)/4*4
+
+// wavHeader returns the 44 byte header of a 16 bit PCM WAV file with dataSize bytes of samples.
+func wavHeader(samplingRate int, channels int, dataSize int64) []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+dataSize))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(samplingRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(samplingRate*channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(dataSize))
+	return h
+}
+
+// RecordVideo records a 4:2:0 video frame received from the friend.
+func (this *CallRecorder) RecordVideo(frame *image.YCbCr) error {
+	if frame.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return toxerr("Invalid frame, need 4:2:0 subsampling")
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return toxerr("recorder closed")
+	}
+	this.elapsedFrames()
+	ts := this.nowfn().Sub(this.start) / time.Millisecond
+
+	rect := image.Rect(0, 0, frame.Rect.Dx(), frame.Rect.Dy())
+	if this.y4m == nil || rect != this.y4mRect || (this.MaxFileSize > 0 && this.y4mSize >= this.MaxFileSize) {
+		if err := this.rotateY4M(rect); err != nil {
+			return err
+		}
+	}
+
+	n, _ := fmt.Fprintf(this.y4mw, "FRAME Xts=%d\n", ts)
+	this.y4mSize += int64(n)
+	cw, ch := (rect.Dx()+1)/2, (rect.Dy()+1)/2
+	for y := 0; y < rect.Dy(); y++ {
+		i := frame.YOffset(frame.Rect.Min.X, frame.Rect.Min.Y+y)
+		this.y4mw.Write(frame.Y[i : i+rect.Dx()])
+	}
+	for _, plane := range [][]byte{frame.Cb, frame.Cr} {
+		for y := 0; y < ch; y++ {
+			i := frame.COffset(frame.Rect.Min.X, frame.Rect.Min.Y) + y*frame.CStride
+			this.y4mw.Write(plane[i : i+cw])
+		}
+	}
+	this.y4mSize += int64(rect.Dx()*rect.Dy() + 2*cw*ch)
+	return nil
+}
+
+func (this *CallRecorder) rotateY4M(rect image.Rectangle) error {
+	if err := this.closeY4M(); err != nil {
+		return err
+	}
+	this.y4mIndex++
+	fp, err := os.Create(fmt.Sprintf("%s-%03d.y4m", this.basePath, this.y4mIndex))
+	if err != nil {
+		return err
+	}
+	this.y4m = fp
+	this.y4mw = bufio.NewWriter(fp)
+	this.y4mRect = rect
+	// toxav has no fixed frame rate, the Xts frame parameters carry the real timing
+	n, err := fmt.Fprintf(this.y4mw, "YUV4MPEG2 W%d H%d F30:1 Ip A1:1 C420jpeg\n", rect.Dx(), rect.Dy())
+	this.y4mSize = int64(n)
+	return err
+}
+
+func (this *CallRecorder) closeY4M() error {
+	if this.y4m == nil {
+		return nil
+	}
+	fp := this.y4m
+	this.y4m = nil
+	if err := this.y4mw.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// Close writes the remaining audio, padding the shorter direction with silence, and closes the files.
+func (this *CallRecorder) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+
+	for side := range this.pending {
+		if pad := len(this.pending[1-side]) - len(this.pending[side]); pad > 0 {
+			this.pending[side] = append(this.pending[side], make([]int16, pad)...)
+		}
+	}
+	err := this.flushAudio()
+	if err1 := this.closeWAV(); err == nil {
+		err = err1
+	}
+	if err1 := this.closeY4M(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,375 @@
+package tox
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// toneGenerator produces interleaved PCM frames of one or more summed sine waves.
+type toneGenerator struct {
+	samplingRate int
+	channels     int
+	freqs        []float64
+	amplitude    float64
+	pos          int
+}
+
+func newSineGenerator(samplingRate int, channels int, freq float64) *toneGenerator {
+	return &toneGenerator{samplingRate: samplingRate, channels: channels, freqs: []float64{freq}, amplitude: 8000}
+}
+
+var dtmfKeys = []string{"123A", "456B", "789C", "*0#D"}
+var dtmfRows = []float64{697, 770, 852, 941}
+var dtmfCols = []float64{1209, 1336, 1477, 1633}
+
+func newDTMFGenerator(samplingRate int, channels int, key byte) *toneGenerator {
+	for r, row := range dtmfKeys {
+		if c := strings.IndexByte(row, key); c >= 0 {
+			return &toneGenerator{samplingRate: samplingRate, channels: channels,
+				freqs: []float64{dtmfRows[r], dtmfCols[c]}, amplitude: 6000}
+		}
+	}
+	return nil
+}
+
+// Next returns the next sampleCount samples per channel.
+func (this *toneGenerator) Next(sampleCount int) []int16 {
+	pcm := make([]int16, sampleCount*this.channels)
+	for i := 0; i < sampleCount; i++ {
+		t := float64(this.pos+i) / float64(this.samplingRate)
+		var v float64
+		for _, f := range this.freqs {
+			v += math.Sin(2 * math.Pi * f * t)
+		}
+		for ch := 0; ch < this.channels; ch++ {
+			pcm[i*this.channels+ch] = int16(v * this.amplitude)
+		}
+	}
+	this.pos += sampleCount
+	return pcm
+}
+
+// tonePower returns the relative power of freq in the first channel of pcm, using the Goertzel algorithm.
+func tonePower(pcm []int16, channels int, samplingRate int, freq float64) float64 {
+	n := len(pcm) / channels
+	coeff := 2 * math.Cos(2*math.Pi*freq/float64(samplingRate))
+	var s1, s2 float64
+	for i := 0; i < n; i++ {
+		s := float64(pcm[i*channels]) + coeff*s1 - s2
+		s2, s1 = s1, s
+	}
+	return (s1*s1 + s2*s2 - coeff*s1*s2) / float64(n*n)
+}
+
+// detectDTMF returns the key whose row and column tones dominate pcm, or 0.
+func detectDTMF(pcm []int16, channels int, samplingRate int) byte {
+	best := func(freqs []float64) (int, bool) {
+		idx, max, total := 0, 0.0, 0.0
+		for i, f := range freqs {
+			p := tonePower(pcm, channels, samplingRate, f)
+			total += p
+			if p > max {
+				idx, max = i, p
+			}
+		}
+		return idx, max > total/2 && max > 1000
+	}
+	r, rok := best(dtmfRows)
+	c, cok := best(dtmfCols)
+	if !rok || !cok {
+		return 0
+	}
+	return dtmfKeys[r][c]
+}
+
+var colorBarColors = []color.RGBA{
+	{255, 255, 255, 255}, {255, 255, 0, 255}, {0, 255, 255, 255}, {0, 255, 0, 255},
+	{255, 0, 255, 255}, {255, 0, 0, 255}, {0, 0, 255, 255}, {0, 0, 0, 255},
+}
+
+const colorBarCounterBits = 16
+
+// colorBars returns a frame of 8 vertical colour bars above a strip with the
+// frame counter as black and white blocks, most significant bit first.
+func colorBars(width int, height int, counter int) *image.YCbCr {
+	frame := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	stripTop := height * 3 / 4
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c color.YCbCr
+			if y < stripTop {
+				rgb := colorBarColors[x*len(colorBarColors)/width]
+				c.Y, c.Cb, c.Cr = color.RGBToYCbCr(rgb.R, rgb.G, rgb.B)
+			} else {
+				bit := x * colorBarCounterBits / width
+				c.Cb, c.Cr = 128, 128
+				if counter&(1<<uint(colorBarCounterBits-1-bit)) != 0 {
+					c.Y = 255
+				}
+			}
+			frame.Y[frame.YOffset(x, y)] = c.Y
+			frame.Cb[frame.COffset(x, y)] = c.Cb
+			frame.Cr[frame.COffset(x, y)] = c.Cr
+		}
+	}
+	return frame
+}
+
+// averageYCbCr averages the samples of the frame within r.
+func averageYCbCr(frame *image.YCbCr, r image.Rectangle) (int, int, int) {
+	var y, cb, cr, n int
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			c := frame.YCbCrAt(frame.Rect.Min.X+px, frame.Rect.Min.Y+py)
+			y, cb, cr, n = y+int(c.Y), cb+int(c.Cb), cr+int(c.Cr), n+1
+		}
+	}
+	return y / n, cb / n, cr / n
+}
+
+// checkColorBars compares the centre of every bar with its colour, within tolerance,
+// and returns the frame counter.
+func checkColorBars(frame *image.YCbCr, tolerance int) (int, error) {
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+	stripTop := height * 3 / 4
+	bw := width / len(colorBarColors)
+	for i, rgb := range colorBarColors {
+		r := image.Rect(i*bw+bw/4, stripTop/4, i*bw+bw*3/4, stripTop*3/4)
+		y, cb, cr := averageYCbCr(frame, r)
+		ey, ecb, ecr := color.RGBToYCbCr(rgb.R, rgb.G, rgb.B)
+		if abs(y-int(ey)) > tolerance || abs(cb-int(ecb)) > tolerance || abs(cr-int(ecr)) > tolerance {
+			return 0, fmt.Errorf("bar %d is %d/%d/%d, want %d/%d/%d", i, y, cb, cr, ey, ecb, ecr)
+		}
+	}
+
+	counter := 0
+	cw := width / colorBarCounterBits
+	for bit := 0; bit < colorBarCounterBits; bit++ {
+		y, _, _ := averageYCbCr(frame, image.Rect(bit*cw+cw/4, stripTop+(height-stripTop)/4, bit*cw+cw*3/4, height-(height-stripTop)/4))
+		counter <<= 1
+		if y > 128 {
+			counter |= 1
+		}
+	}
+	return counter, nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// avPeer is a Tox and ToxAV instance which only talks to peers on the loopback interface.
+type avPeer struct {
+	t  *Tox
+	av *ToxAV
+}
+
+func newAVPeer(t *testing.T) *avPeer {
+	opts := NewToxOptions()
+	opts.IPv6Enabled = false
+	opts.UDPEnabled = true
+	opts.LocalDiscoveryEnabled = false
+	this := &avPeer{}
+	this.t = NewTox(opts)
+	if this.t == nil {
+		t.Fatal("cannot create tox")
+	}
+	av, err := NewToxAV(this.t)
+	if err != nil {
+		this.t.Kill()
+		t.Fatal(err)
+	}
+	this.av = av
+	return this
+}
+
+func (this *avPeer) kill() {
+	this.av.Kill()
+	this.t.Kill()
+}
+
+func (this *avPeer) iterate() {
+	this.t.Iterate()
+	this.av.Iterate()
+}
+
+// pumpAV iterates the peers in the calling goroutine, calling each between iterations,
+// until cond returns true or the timeout passes. It returns the result of cond.
+func pumpAV(peers []*avPeer, timeout time.Duration, each func(), cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, p := range peers {
+			p.iterate()
+		}
+		if each != nil {
+			each()
+		}
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+// newLoopbackPair creates two peers which are bootstrapped to each other on
+// 127.0.0.1 and befriended, and returns the friend number of b at a and of a at b.
+func newLoopbackPair(t *testing.T) (a *avPeer, b *avPeer, fa uint32, fb uint32) {
+	a, b = newAVPeer(t), newAVPeer(t)
+	port, err := a.t.SelfGetUdpPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.t.Bootstrap("127.0.0.1", port, a.t.SelfGetDhtId()); err != nil {
+		t.Fatal(err)
+	}
+	b.t.CallbackFriendRequest(func(_ *Tox, friendId string, msg string, _ interface{}) {
+		fb, _ = b.t.FriendAddNorequest(friendId)
+	}, nil)
+	if fa, err = a.t.FriendAdd(b.t.SelfGetAddress(), "av loopback"); err != nil {
+		t.Fatal(err)
+	}
+
+	connected := pumpAV([]*avPeer{a, b}, 60*time.Second, nil, func() bool {
+		sa, _ := a.t.FriendGetConnectionStatus(fa)
+		sb, _ := b.t.FriendGetConnectionStatus(fb)
+		return b.t.FriendExists(fb) && sa != ConnectionNone && sb != ConnectionNone
+	})
+	if !connected {
+		a.kill()
+		b.kill()
+		t.Fatal("peers did not connect on loopback")
+	}
+	return a, b, fa, fb
+}
+
+func TestAVGenerators(t *testing.T) {
+	t.Run("sine", func(t *testing.T) {
+		g := newSineGenerator(48000, 2, 440)
+		g.Next(480)
+		pcm := g.Next(960)
+		if len(pcm) != 1920 || pcm[0] != pcm[1] {
+			t.Fatal("wrong frame", len(pcm))
+		}
+		if p440, p1000 := tonePower(pcm, 2, 48000, 440), tonePower(pcm, 2, 48000, 1000); p440 < 100*p1000 {
+			t.Error("440 Hz must dominate", p440, p1000)
+		}
+	})
+	t.Run("dtmf", func(t *testing.T) {
+		for _, key := range []byte("159*#D") {
+			g := newDTMFGenerator(8000, 1, key)
+			if got := detectDTMF(g.Next(320), 1, 8000); got != key {
+				t.Errorf("detected %q, want %q", got, key)
+			}
+		}
+		if newDTMFGenerator(8000, 1, 'x') != nil {
+			t.Error("must nil for unknown key")
+		}
+		if detectDTMF(make([]int16, 320), 1, 8000) != 0 {
+			t.Error("must detect nothing in silence")
+		}
+	})
+	t.Run("color bars", func(t *testing.T) {
+		frame := colorBars(320, 240, 0xA5C3)
+		if frame.Rect.Dx() != 320 || frame.Rect.Dy() != 240 {
+			t.Error("wrong size", frame.Rect)
+		}
+		counter, err := checkColorBars(frame, 2)
+		if err != nil || counter != 0xA5C3 {
+			t.Error("wrong bars", counter, err)
+		}
+		frame.Y[frame.YOffset(20, 90)] = 0 // a single pixel is within tolerance
+		if _, err := checkColorBars(frame, 8); err != nil {
+			t.Error(err)
+		}
+		for y := 0; y < 180; y++ {
+			for x := 40; x < 80; x++ {
+				frame.Y[frame.YOffset(x, y)] = 0
+			}
+		}
+		if _, err := checkColorBars(frame, 8); err == nil {
+			t.Error("must detect wrong bar")
+		}
+	})
+}
+
+func TestAVLoopback(t *testing.T) {
+	a, b, fa, fb := newLoopbackPair(t)
+	defer a.kill()
+	defer b.kill()
+
+	b.av.CallbackCall(func(av *ToxAV, friendNumber uint32, audioEnabled bool, videoEnabled bool, _ interface{}) {
+		if _, err := av.Answer(friendNumber, 48, 2000); err != nil {
+			t.Error(err)
+		}
+	}, nil)
+
+	var audioFrames, videoFrames, toneFrames, lastCounter int
+	b.av.CallbackAudioReceiveFrameInt16(func(_ *ToxAV, friendNumber uint32, pcm []int16, channels int, samplingRate int, _ interface{}) {
+		if friendNumber != fb {
+			t.Error("wrong friend", friendNumber)
+		}
+		audioFrames++
+		if tonePower(pcm, channels, samplingRate, 440) > 10*tonePower(pcm, channels, samplingRate, 1000) {
+			toneFrames++
+		}
+	}, nil)
+	b.av.CallbackVideoReceiveFrameYUV(func(_ *ToxAV, friendNumber uint32, frame *image.YCbCr, _ interface{}) {
+		if frame.Rect.Dx() != 320 || frame.Rect.Dy() != 240 {
+			t.Error("wrong frame size", frame.Rect)
+			return
+		}
+		// lossy coding, only the approximate content survives
+		counter, err := checkColorBars(frame, 48)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if counter < lastCounter {
+			t.Error("frame counter went backwards", counter, lastCounter)
+		}
+		lastCounter = counter
+		videoFrames++
+	}, nil)
+
+	call, err := a.av.StartCall(fa, 48, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pumpAV([]*avPeer{a, b}, 30*time.Second, nil, func() bool { return call.State() == CallStateActive }) {
+		t.Fatal("call not answered", call.State())
+	}
+
+	sine := newSineGenerator(48000, 1, 440)
+	counter := 0
+	nextAudio, nextVideo := time.Now(), time.Now()
+	pumpAV([]*avPeer{a, b}, 5*time.Second, func() {
+		for now := time.Now(); !nextAudio.After(now); nextAudio = nextAudio.Add(20 * time.Millisecond) {
+			a.av.AudioSendFrameInt16(fa, sine.Next(960), 1, 48000)
+		}
+		for now := time.Now(); !nextVideo.After(now); nextVideo = nextVideo.Add(40 * time.Millisecond) {
+			counter++
+			a.av.VideoSendFrameYUV(fa, colorBars(320, 240, counter))
+		}
+	}, func() bool { return audioFrames >= 100 && videoFrames >= 25 })
+
+	if audioFrames == 0 || videoFrames == 0 {
+		t.Fatal("no frames received", audioFrames, videoFrames)
+	}
+	// the first frames of the decoder are still warming up
+	if toneFrames < audioFrames/2 {
+		t.Error("440 Hz tone not received", toneFrames, audioFrames)
+	}
+	if lastCounter == 0 || lastCounter > counter {
+		t.Error("wrong frame counter", lastCounter, counter)
+	}
+	call.Hangup()
+}
@@ -4,43 +4,76 @@ package tox
 #include <tox/toxencryptsave.h>
 */
 import "C"
+import (
+	"runtime"
+	"sync"
+)
 
 const PASS_KEY_LENGTH = int(C.TOX_PASS_KEY_LENGTH)
 const PASS_ENCRYPTION_EXTRA_LENGTH = int(C.TOX_PASS_ENCRYPTION_EXTRA_LENGTH)
+const PASS_SALT_LENGTH = int(C.TOX_PASS_SALT_LENGTH)
 
+// ToxPassKey is a key derived from a passphrase. Deriving is deliberately slow,
+// so keep the key for repeated encryptions instead of the passphrase.
+//
+// Free releases the key, a finalizer frees keys which are not freed explicitly.
 type ToxPassKey struct {
 	cpk *C.Tox_Pass_Key
 }
 
+func newToxPassKey(cpk *C.Tox_Pass_Key) *ToxPassKey {
+	this := &ToxPassKey{cpk: cpk}
+	runtime.SetFinalizer(this, (*ToxPassKey).Free)
+	return this
+}
+
+// Free releases the key. It is safe to call more than once, and on a nil key.
 func (this *ToxPassKey) Free() {
+	if this == nil || this.cpk == nil {
+		return
+	}
 	C.tox_pass_key_free(this.cpk)
+	this.cpk = nil
+	runtime.SetFinalizer(this, nil)
 }
 
-func Derive(passphrase []byte) (*ToxPassKey, error) {
-	this := &ToxPassKey{}
+// WipeBytes overwrites the buffer with zeros, to not leave passphrases or plaintext in memory.
+func WipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
 
+func Derive(passphrase []byte) (*ToxPassKey, error) {
+	if len(passphrase) == 0 {
+		return nil, toxerr("empty passphrase")
+	}
 	passphrase_ := (*C.uint8_t)(&passphrase[0])
 
 	var cerr C.TOX_ERR_KEY_DERIVATION
-	this.cpk = C.tox_pass_key_derive(passphrase_, C.size_t(len(passphrase)), &cerr)
+	cpk := C.tox_pass_key_derive(passphrase_, C.size_t(len(passphrase)), &cerr)
 	if cerr != C.TOX_ERR_KEY_DERIVATION_OK {
 		return nil, toxerr(cerr)
 	}
-	return this, nil
+	return newToxPassKey(cpk), nil
 }
 
 func DeriveWithSalt(passphrase []byte, salt []byte) (*ToxPassKey, error) {
-	this := &ToxPassKey{}
-
+	if len(passphrase) == 0 {
+		return nil, toxerr("empty passphrase")
+	}
+	if len(salt) != PASS_SALT_LENGTH {
+		return nil, toxerrf("salt must be %d bytes, not %d", PASS_SALT_LENGTH, len(salt))
+	}
 	passphrase_ := (*C.uint8_t)(&passphrase[0])
 	salt_ := (*C.uint8_t)(&salt[0])
 
 	var cerr C.TOX_ERR_KEY_DERIVATION
-	this.cpk = C.tox_pass_key_derive_with_salt(passphrase_, C.size_t(len(passphrase)), salt_, &cerr)
+	cpk := C.tox_pass_key_derive_with_salt(passphrase_, C.size_t(len(passphrase)), salt_, &cerr)
 	if cerr != C.TOX_ERR_KEY_DERIVATION_OK {
 		return nil, toxerr(cerr)
 	}
-	return this, nil
+	return newToxPassKey(cpk), nil
 }
 
 func (this *ToxPassKey) Encrypt(plaintext []byte) (bool, error, []byte) {
@@ -50,21 +83,26 @@ func (this *ToxPassKey) Encrypt(plaintext []byte) (bool, error, []byte) {
 
 	var cerr C.TOX_ERR_ENCRYPTION
 	ok := C.tox_pass_key_encrypt(this.cpk, plaintext_, C.size_t(len(plaintext)), ciphertext_, &cerr)
+	runtime.KeepAlive(this) // the finalizer must not free cpk during the call
 
 	var err error
 	if !bool(ok) {
-		err = toxerr(err)
+		err = toxerr(cerr)
 	}
 	return bool(ok), err, ciphertext
 }
 
 func (this *ToxPassKey) Decrypt(ciphertext []byte) (bool, error, []byte) {
+	if len(ciphertext) <= PASS_ENCRYPTION_EXTRA_LENGTH {
+		return false, toxerrf("ciphertext too short: %d bytes", len(ciphertext)), nil
+	}
 	ciphertext_ := (*C.uint8_t)(&ciphertext[0])
 	plaintext := make([]byte, len(ciphertext)-PASS_ENCRYPTION_EXTRA_LENGTH)
 	plaintext_ := (*C.uint8_t)(&plaintext[0])
 
 	var cerr C.TOX_ERR_DECRYPTION
 	ok := C.tox_pass_key_decrypt(this.cpk, ciphertext_, C.size_t(len(ciphertext)), plaintext_, &cerr)
+	runtime.KeepAlive(this)
 	var err error
 	if !bool(ok) {
 		err = toxerr(cerr)
@@ -74,7 +112,7 @@ func (this *ToxPassKey) Decrypt(ciphertext []byte) (bool, error, []byte) {
 
 func GetSalt(ciphertext []byte) (bool, error, []byte) {
 	ciphertext_ := (*C.uint8_t)(&ciphertext[0])
-	salt := make([]byte, int(C.TOX_PASS_SALT_LENGTH))
+	salt := make([]byte, PASS_SALT_LENGTH)
 	salt_ := (*C.uint8_t)(&salt[0])
 
 	var cerr C.TOX_ERR_GET_SALT
@@ -114,7 +152,7 @@ func PassDecrypt(ciphertext []byte, passphrase []byte) (plaintext []byte, err er
 	ciphertext_ := (*C.uint8_t)(&ciphertext[0])
 	plaintext = make([]byte, len(ciphertext)-PASS_ENCRYPTION_EXTRA_LENGTH)
 	plaintext_ := (*C.uint8_t)(&plaintext[0])
-	passphrase_ := (*C.uint8_t)(&plaintext[0])
+	passphrase_ := (*C.uint8_t)(&passphrase[0])
 
 	var cerr C.TOX_ERR_DECRYPTION
 	ok := C.tox_pass_decrypt(ciphertext_, C.size_t(len(ciphertext)), passphrase_, C.size_t(len(passphrase)), plaintext_, &cerr)
@@ -124,3 +162,163 @@ func PassDecrypt(ciphertext []byte, passphrase []byte) (plaintext []byte, err er
 	}
 	return
 }
+
+// ChangePassphrase decrypts the encrypted data with the old passphrase and encrypts it with the new one, under a new salt.
+//
+// Both passphrase buffers and the intermediate plaintext are zeroed.
+func ChangePassphrase(encrypted []byte, oldPassphrase []byte, newPassphrase []byte) ([]byte, error) {
+	defer WipeBytes(oldPassphrase)
+	defer WipeBytes(newPassphrase)
+
+	if len(encrypted) < PASS_ENCRYPTION_EXTRA_LENGTH || !IsDataEncrypted(encrypted) {
+		return nil, toxerr("data is not encrypted")
+	}
+	_, err, salt := GetSalt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	oldkey, err := DeriveWithSalt(oldPassphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer oldkey.Free()
+	_, err, plaintext := oldkey.Decrypt(encrypted)
+	defer WipeBytes(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	newkey, err := Derive(newPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer newkey.Free()
+	_, err, ciphertext := newkey.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return ciphertext, nil
+}
+
+// EncryptedProfile holds an encrypted savedata and, while unlocked, its pass key,
+// so repeated saves do not derive the key again. The passphrase itself is never kept.
+type EncryptedProfile struct {
+	mu   sync.Mutex
+	data []byte
+	key  *ToxPassKey
+}
+
+// NewEncryptedProfile wraps encrypted savedata, for example read from a file.
+func NewEncryptedProfile(encrypted []byte) (*EncryptedProfile, error) {
+	if len(encrypted) < PASS_ENCRYPTION_EXTRA_LENGTH || !IsDataEncrypted(encrypted) {
+		return nil, toxerr("data is not encrypted")
+	}
+	return &EncryptedProfile{data: append([]byte{}, encrypted...)}, nil
+}
+
+// CreateEncryptedProfile encrypts plaintext savedata into a new, unlocked profile. The passphrase buffer is zeroed.
+func CreateEncryptedProfile(plaintext []byte, passphrase []byte) (*EncryptedProfile, error) {
+	defer WipeBytes(passphrase)
+	key, err := Derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	_, err, ciphertext := key.Encrypt(plaintext)
+	if err != nil {
+		key.Free()
+		return nil, err
+	}
+	return &EncryptedProfile{data: ciphertext, key: key}, nil
+}
+
+// Data returns the encrypted savedata.
+func (this *EncryptedProfile) Data() []byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]byte{}, this.data...)
+}
+
+// Unlock derives the pass key and returns the decrypted savedata. The passphrase buffer is zeroed.
+func (this *EncryptedProfile) Unlock(passphrase []byte) ([]byte, error) {
+	defer WipeBytes(passphrase)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(this.data) < PASS_ENCRYPTION_EXTRA_LENGTH {
+		return nil, toxerr("data is not encrypted")
+	}
+	_, err, salt := GetSalt(this.data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := DeriveWithSalt(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err, plaintext := key.Decrypt(this.data)
+	if err != nil {
+		key.Free()
+		return nil, toxerrf("decrypt failed, wrong passphrase? %v", err)
+	}
+	this.key.Free()
+	this.key = key
+	return plaintext, nil
+}
+
+// Lock frees the cached pass key. Save needs another Unlock afterwards.
+func (this *EncryptedProfile) Lock() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.key.Free()
+	this.key = nil
+}
+
+// Locked returns whether the profile has no cached pass key.
+func (this *EncryptedProfile) Locked() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.key == nil
+}
+
+// Save encrypts new savedata with the cached pass key and returns the encrypted data.
+func (this *EncryptedProfile) Save(plaintext []byte) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.key == nil {
+		return nil, toxerr("profile is locked")
+	}
+	_, err, ciphertext := this.key.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	this.data = ciphertext
+	return append([]byte{}, ciphertext...), nil
+}
+
+// ChangePassphrase re-encrypts the profile with a new passphrase and keeps it unlocked with the new key.
+// Both passphrase buffers are zeroed.
+func (this *EncryptedProfile) ChangePassphrase(oldPassphrase []byte, newPassphrase []byte) error {
+	defer WipeBytes(newPassphrase)
+	plaintext, err := this.Unlock(oldPassphrase)
+	defer WipeBytes(plaintext)
+	if err != nil {
+		return err
+	}
+
+	key, err := Derive(newPassphrase)
+	if err != nil {
+		return err
+	}
+	_, err, ciphertext := key.Encrypt(plaintext)
+	if err != nil {
+		key.Free()
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.key.Free()
+	this.key = key
+	this.data = ciphertext
+	return nil
+}
@@ -0,0 +1,220 @@
+package tox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// Encrypted streams start with streamMagic, a version byte and a random stream id,
+// followed by chunks of a 4 byte big endian length and the chunk encrypted with a
+// ToxPassKey. Every chunk authenticates the stream id, its sequence number and
+// whether it is the last chunk, so chunks cannot be reordered, moved between
+// streams or cut off without the reader noticing.
+var streamMagic = []byte("toxEstrm")
+
+const (
+	streamVersion = 1
+	streamIDSize  = 16
+	// chunk plaintext header: stream id, sequence number, final flag
+	streamChunkHeader = streamIDSize + 8 + 1
+	// DefaultStreamChunkSize is the payload size of the chunks of NewEncryptWriter.
+	DefaultStreamChunkSize = 64 * 1024
+	maxStreamChunkSize     = 16 * 1024 * 1024
+)
+
+// EncryptWriter encrypts everything written to it in authenticated chunks.
+// Close must be called to write the final chunk.
+type EncryptWriter struct {
+	w         io.Writer
+	id        [streamIDSize]byte
+	seq       uint64
+	buf       []byte
+	chunkSize int
+	started   bool
+	closed    bool
+	err       error
+	sealfn    func(plaintext []byte) ([]byte, error)
+}
+
+// NewEncryptWriter returns a writer encrypting to w with the key, in chunks of DefaultStreamChunkSize.
+func NewEncryptWriter(w io.Writer, key *ToxPassKey) (*EncryptWriter, error) {
+	return NewEncryptWriterSize(w, key, DefaultStreamChunkSize)
+}
+
+// NewEncryptWriterSize returns a writer encrypting to w with the key, in chunks of chunkSize bytes.
+func NewEncryptWriterSize(w io.Writer, key *ToxPassKey, chunkSize int) (*EncryptWriter, error) {
+	if chunkSize <= 0 || chunkSize > maxStreamChunkSize {
+		return nil, toxerrf("Invalid chunk size: %d", chunkSize)
+	}
+	this := &EncryptWriter{w: w, chunkSize: chunkSize}
+	if _, err := io.ReadFull(rand.Reader, this.id[:]); err != nil {
+		return nil, err
+	}
+	this.buf = make([]byte, streamChunkHeader, streamChunkHeader+chunkSize)
+	this.sealfn = func(plaintext []byte) ([]byte, error) {
+		_, err, ciphertext := key.Encrypt(plaintext)
+		return ciphertext, err
+	}
+	return this, nil
+}
+
+func (this *EncryptWriter) Write(p []byte) (int, error) {
+	if this.closed {
+		return 0, toxerr("write to closed stream")
+	}
+	n := 0
+	for len(p) > 0 {
+		if this.err != nil {
+			return n, this.err
+		}
+		if len(this.buf) == cap(this.buf) {
+			this.err = this.flush(false)
+			continue
+		}
+		c := copy(this.buf[len(this.buf):cap(this.buf)], p)
+		this.buf = this.buf[:len(this.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, this.err
+}
+
+func (this *EncryptWriter) flush(final bool) error {
+	if !this.started {
+		hdr := append(append([]byte{}, streamMagic...), streamVersion)
+		if _, err := this.w.Write(append(hdr, this.id[:]...)); err != nil {
+			return err
+		}
+		this.started = true
+	}
+
+	copy(this.buf, this.id[:])
+	binary.BigEndian.PutUint64(this.buf[streamIDSize:], this.seq)
+	this.buf[streamIDSize+8] = 0
+	if final {
+		this.buf[streamIDSize+8] = 1
+	}
+	ciphertext, err := this.sealfn(this.buf)
+	WipeBytes(this.buf)
+	this.buf = this.buf[:streamChunkHeader]
+	if err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(ciphertext)))
+	if _, err := this.w.Write(append(length[:], ciphertext...)); err != nil {
+		return err
+	}
+	this.seq++
+	return nil
+}
+
+// Close writes the buffered data as the final chunk. It does not close the underlying writer.
+func (this *EncryptWriter) Close() error {
+	if this.closed {
+		return this.err
+	}
+	this.closed = true
+	if this.err == nil {
+		this.err = this.flush(true)
+	}
+	return this.err
+}
+
+// DecryptReader decrypts a stream written by EncryptWriter.
+type DecryptReader struct {
+	r      io.Reader
+	id     [streamIDSize]byte
+	seq    uint64
+	buf    []byte // decrypted payload not read yet
+	plain  []byte
+	done   bool
+	err    error
+	openfn func(ciphertext []byte) ([]byte, error)
+}
+
+// NewDecryptReader returns a reader decrypting r with the key, which must match the writing key.
+func NewDecryptReader(r io.Reader, key *ToxPassKey) (*DecryptReader, error) {
+	this := &DecryptReader{r: r}
+	this.openfn = func(ciphertext []byte) ([]byte, error) {
+		_, err, plaintext := key.Decrypt(ciphertext)
+		return plaintext, err
+	}
+	return this, this.readHeader()
+}
+
+func (this *DecryptReader) readHeader() error {
+	hdr := make([]byte, len(streamMagic)+1+streamIDSize)
+	if _, err := io.ReadFull(this.r, hdr); err != nil || !bytes.HasPrefix(hdr, streamMagic) {
+		return toxerr("not an encrypted stream")
+	}
+	if v := hdr[len(streamMagic)]; v != streamVersion {
+		return toxerrf("unsupported encrypted stream version %d", v)
+	}
+	copy(this.id[:], hdr[len(streamMagic)+1:])
+	return nil
+}
+
+func (this *DecryptReader) Read(p []byte) (int, error) {
+	for len(this.buf) == 0 {
+		if this.err != nil {
+			return 0, this.err
+		}
+		if this.done {
+			this.err = this.expectEOF()
+			continue
+		}
+		this.err = this.next()
+	}
+	n := copy(p, this.buf)
+	this.buf = this.buf[n:]
+	return n, nil
+}
+
+// next reads, decrypts and checks the next chunk.
+func (this *DecryptReader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(this.r, length[:]); err != nil {
+		if err == io.EOF {
+			return toxerr("encrypted stream truncated")
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxStreamChunkSize+streamChunkHeader+uint32(PASS_ENCRYPTION_EXTRA_LENGTH) {
+		return toxerrf("encrypted stream chunk too large: %d", size)
+	}
+	if size < streamChunkHeader+uint32(PASS_ENCRYPTION_EXTRA_LENGTH) {
+		return toxerrf("encrypted stream chunk too short: %d", size)
+	}
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(this.r, ciphertext); err != nil {
+		return toxerr("encrypted stream truncated")
+	}
+
+	WipeBytes(this.plain)
+	plaintext, err := this.openfn(ciphertext)
+	if err != nil {
+		return toxerrf("encrypted stream chunk %d: %v", this.seq, err)
+	}
+	if len(plaintext) < streamChunkHeader || !bytes.Equal(plaintext[:streamIDSize], this.id[:]) ||
+		binary.BigEndian.Uint64(plaintext[streamIDSize:]) != this.seq {
+		return toxerrf("encrypted stream chunk %d out of place", this.seq)
+	}
+	this.seq++
+	this.done = plaintext[streamIDSize+8] == 1
+	this.plain = plaintext
+	this.buf = plaintext[streamChunkHeader:]
+	return nil
+}
+
+func (this *DecryptReader) expectEOF() error {
+	var b [1]byte
+	if _, err := io.ReadFull(this.r, b[:]); err != io.EOF {
+		return toxerr("data after the end of the encrypted stream")
+	}
+	return io.EOF
+}
@@ -43,27 +43,20 @@ func FileExist(fname string) bool {
 	return true
 }
 
+// WriteSavedata writes the savedata to fname if it differs from the file content,
+// through a temporary file which is renamed over fname.
 func (this *Tox) WriteSavedata(fname string) error {
-	if !FileExist(fname) {
-		err := ioutil.WriteFile(fname, this.GetSavedata(), 0755)
-		if err != nil {
-			return err
-		}
-	} else {
+	liveData := this.GetSavedata()
+	if FileExist(fname) {
 		data, err := ioutil.ReadFile(fname)
 		if err != nil {
 			return err
 		}
-		liveData := this.GetSavedata()
-		if bytes.Compare(data, liveData) != 0 {
-			err := ioutil.WriteFile(fname, this.GetSavedata(), 0755)
-			if err != nil {
-				return err
-			}
+		if bytes.Compare(data, liveData) == 0 {
+			return nil
 		}
 	}
-
-	return nil
+	return WriteFileAtomic(fname, liveData, 0600)
 }
 
 func (this *Tox) LoadSavedata(fname string) ([]byte, error) {
@@ -85,3 +78,21 @@ func ConnStatusString(status int) (s string) {
 	}
 	return
 }
+
+// pcmToInt16 copies the interleaved host-endian 16 bit samples in pcm into a new []int16.
+func pcmToInt16(pcm []byte) []int16 {
+	samples := make([]int16, len(pcm)/2)
+	if len(samples) > 0 {
+		copy(samples, (*[1 << 28]int16)(unsafe.Pointer(&pcm[0]))[:len(samples):len(samples)])
+	}
+	return samples
+}
+
+// int16ToPCM copies the samples into a new byte slice laid out like toxav expects it.
+func int16ToPCM(samples []int16) []byte {
+	pcm := make([]byte, len(samples)*2)
+	if len(samples) > 0 {
+		copy(pcm, (*[1 << 29]byte)(unsafe.Pointer(&samples[0]))[:len(pcm):len(pcm)])
+	}
+	return pcm
+}